@@ -16,30 +16,42 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	kmpconfig "github.com/Uburro/kubelet-meta-proxy/internal/config"
 	"github.com/Uburro/kubelet-meta-proxy/internal/controller"
 	"github.com/Uburro/kubelet-meta-proxy/internal/metrics"
 	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+	"github.com/Uburro/kubelet-meta-proxy/internal/version"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -49,23 +61,25 @@ var (
 )
 
 type Config struct {
-	MaxConcurrency   int
-	MetricsPort      string
-	CacheSyncTimeout time.Duration
-	MetricsAddr      string
-	MetricsCertPath  string
-	MetricsCertName  string
-	MetricsCertKey   string
-	WebhookCertPath  string
-	WebhookCertName  string
-	WebhookCertKey   string
-	ProbeAddr        string
-	SecureMetrics    bool
-	EnableHTTP2      bool
-	NodeNameOrIP     string
-	KubeApiserver    string
-	NodePort         string
-	TLSOpts          []func(*tls.Config)
+	MaxConcurrency       int
+	MetricsPort          string
+	CacheSyncTimeout     time.Duration
+	SyncPeriod           time.Duration
+	MetricsAddr          string
+	MetricsCertPath      string
+	MetricsCertName      string
+	MetricsCertKey       string
+	WebhookCertPath      string
+	WebhookCertName      string
+	WebhookCertKey       string
+	ProbeAddr            string
+	SecureMetrics        bool
+	EnableHTTP2          bool
+	ConfigFile           string
+	ConfigReloadInterval time.Duration
+	ConfigMap            string
+	ConfigMapKey         string
+	TLSOpts              []func(*tls.Config)
 }
 
 func init() {
@@ -95,12 +109,25 @@ func main() {
 	flag.StringVar(&config.MetricsCertKey, "metrics-cert-key", "tls.key", "The name of the metrics server key file.")
 	flag.IntVar(&config.MaxConcurrency, "max-concurrency", config.MaxConcurrency, "The maximum number of concurrent reconciles.")
 	flag.DurationVar(&config.CacheSyncTimeout, "cache-sync-timeout", config.CacheSyncTimeout, "Cache sync timeout.")
+	flag.DurationVar(&config.SyncPeriod, "namespace-sync-period", config.SyncPeriod,
+		"How often every namespace is reconciled again, in case a namespace event was missed, e.g. 10m. "+
+			"Disabled when 0, the default.")
 	flag.BoolVar(&config.EnableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
 	flag.StringVar(&config.MetricsPort, "metrics-port", "8080", "Port to run our custom cAdvisor metrics server.")
-	flag.StringVar(&config.NodeNameOrIP, "node-name-or-ip", "localhost", "The name or IP of the node.")
-	flag.StringVar(&config.NodePort, "node-port", "10250", "The port of the kubelet.")
-	flag.StringVar(&config.KubeApiserver, "kube-apiserver", "", "The address of the kube-apiserver.")
+	flag.StringVar(&config.ConfigFile, "config", "",
+		"Path to a YAML file with the metrics proxy options. Flags given on the command line take precedence.")
+	flag.DurationVar(&config.ConfigReloadInterval, "config-reload-interval", 0,
+		"How often the config file is checked for changes to the namespace enrichment rules, "+
+			"which are then applied without a restart. 0 disables it.")
+	flag.StringVar(&config.ConfigMap, "config-map", "",
+		"ConfigMap, as namespace/name, holding metrics proxy options like the config file. "+
+			"The namespace enrichment rules are reloaded from it whenever it changes.")
+	flag.StringVar(&config.ConfigMapKey, "config-map-key", controller.DefaultConfigMapKey,
+		"Key of the --config-map data holding the options.")
+
+	proxyOpts := kmpconfig.Defaults()
+	kmpconfig.BindFlags(flag.CommandLine, &proxyOpts)
 
 	opts := zap.Options{
 		Development: true,
@@ -110,6 +137,41 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// Options are layered: flags over environment variables over the config file over defaults.
+	baseOpts := kmpconfig.Defaults()
+	if len(config.ConfigFile) > 0 {
+		setupLog.Info("Loading metrics proxy options from config file", "config", config.ConfigFile)
+		fileOpts, err := kmpconfig.Load(config.ConfigFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load config file")
+			os.Exit(1)
+		}
+		baseOpts = *fileOpts
+	}
+	if err := kmpconfig.ApplyEnv(&baseOpts); err != nil {
+		setupLog.Error(err, "unable to apply environment variables")
+		os.Exit(1)
+	}
+	if err := kmpconfig.ApplyFlags(&baseOpts, flag.CommandLine); err != nil {
+		setupLog.Error(err, "unable to apply flags on top of config file and environment variables")
+		os.Exit(1)
+	}
+	proxyOpts = baseOpts
+	if err := proxyOpts.Validate(); err != nil {
+		setupLog.Error(err, "invalid metrics proxy options")
+		os.Exit(1)
+	}
+
+	var configMap types.NamespacedName
+	if len(config.ConfigMap) > 0 {
+		namespace, name, ok := strings.Cut(config.ConfigMap, "/")
+		if !ok || namespace == "" || name == "" {
+			setupLog.Error(fmt.Errorf("%q is not namespace/name", config.ConfigMap), "invalid --config-map")
+			os.Exit(1)
+		}
+		configMap = types.NamespacedName{Namespace: namespace, Name: name}
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -199,8 +261,24 @@ func main() {
 		})
 	}
 
+	cacheOpts := cache.Options{ByObject: map[client.Object]cache.ByObject{}}
+	if configMap.Name != "" {
+		// Only the ConfigMap holding the options is cached, not every ConfigMap of the cluster.
+		cacheOpts.ByObject[&corev1.ConfigMap{}] = cache.ByObject{
+			Namespaces: map[string]cache.Config{configMap.Namespace: {}},
+			Field:      fields.OneTermEqualSelector("metadata.name", configMap.Name),
+		}
+	}
+	if nodeName := proxyOpts.ScrapedNodeName(); nodeName != "" {
+		// Only the pods of the scraped node can match its metrics, so the others are not cached.
+		cacheOpts.ByObject[&corev1.Pod{}] = cache.ByObject{
+			Field: fields.OneTermEqualSelector("spec.nodeName", nodeName),
+		}
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
+		Cache:                  cacheOpts,
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
 		HealthProbeBindAddress: config.ProbeAddr,
@@ -242,16 +320,50 @@ func main() {
 	}
 
 	namespaceMetrics := nsmetrics.NewNamespaceMetrics()
+	readiness := nsmetrics.NewReadiness()
+
+	var namespaceSelector labels.Selector
+	if proxyOpts.NamespaceSelector != nil {
+		if namespaceSelector, err = metav1.LabelSelectorAsSelector(proxyOpts.NamespaceSelector); err != nil {
+			setupLog.Error(err, "invalid namespace selector")
+			os.Exit(1)
+		}
+	}
 
-	if err = (&controller.NamespaceLabelReconciler{
-		Client:           mgr.GetClient(),
-		Scheme:           mgr.GetScheme(),
-		NamespaceMetrics: namespaceMetrics,
-	}).SetupWithManager(mgr, config.MaxConcurrency, config.CacheSyncTimeout); err != nil {
+	namespaceReconciler := &controller.NamespaceLabelReconciler{
+		Client:              mgr.GetClient(),
+		Scheme:              mgr.GetScheme(),
+		NamespaceMetrics:    namespaceMetrics,
+		AnnotationAllowlist: proxyOpts.AnnotationAllowlist,
+		StoreCreationTime:   proxyOpts.NamespaceCreationTime,
+		NamespaceSelector:   namespaceSelector,
+		ExcludeNamespaces:   proxyOpts.ExcludeNamespaces,
+		SyncPeriod:          config.SyncPeriod,
+		Readiness:           readiness,
+	}
+	if err = namespaceReconciler.SetupWithManager(mgr, config.MaxConcurrency, config.CacheSyncTimeout); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NodeConfigurator")
 		os.Exit(1)
 	}
 
+	var podReconciler *controller.PodLabelReconciler
+	if len(proxyOpts.PodLabelAllowlist) > 0 || proxyOpts.PodOwnerLabels {
+		proxyOpts.PodMetrics = nsmetrics.NewPodMetrics()
+		podReconciler = &controller.PodLabelReconciler{
+			Client:            mgr.GetClient(),
+			PodMetrics:        proxyOpts.PodMetrics,
+			LabelAllowlist:    proxyOpts.PodLabelAllowlist,
+			ExcludeNamespaces: proxyOpts.ExcludeNamespaces,
+			ResolveOwners:     proxyOpts.PodOwnerLabels,
+			// Owners are read directly and kept in a bounded cache instead of caching every ReplicaSet.
+			OwnerReader: mgr.GetAPIReader(),
+		}
+		if err = podReconciler.SetupWithManager(mgr, config.MaxConcurrency, config.CacheSyncTimeout); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Pod")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -261,27 +373,101 @@ func main() {
 		os.Exit(1)
 	}
 
-	metricsServerRunnable := metrics.NewServerRunnable(
-		mgr.GetConfig(),
-		config.MetricsPort,
-		namespaceMetrics,
-		config.KubeApiserver,
-		config.NodeNameOrIP,
-		config.NodePort,
-	)
+	proxyOpts.RestConfig = mgr.GetConfig()
+	// The Node is read once, a direct reader avoids caching every Node of the cluster.
+	proxyOpts.NodeReader = mgr.GetAPIReader()
+	proxyOpts.Readiness = readiness
+	metricsServerRunnable, err := metrics.NewServerRunnable(config.MetricsPort, namespaceMetrics, proxyOpts)
+	if err != nil {
+		setupLog.Error(err, "Unable to create metrics server runnable")
+		os.Exit(1)
+	}
 
 	// Register the metrics server runnable with the manager.
 	if err := mgr.Add(metricsServerRunnable); err != nil {
 		setupLog.Error(err, "Unable to add metrics server runnable")
 		os.Exit(1)
 	}
+	if proxyOpts.PushGatewayURL != "" {
+		setupLog.Info("Pushing metrics to the Pushgateway", "url", proxyOpts.PushGatewayURL)
+		if err := mgr.Add(metrics.NewPushRunnable(metricsServerRunnable)); err != nil {
+			setupLog.Error(err, "Unable to add push runnable")
+			os.Exit(1)
+		}
+	}
+
+	if proxyOpts.OTLPEndpoint != "" {
+		setupLog.Info("Exporting metrics over OTLP", "endpoint", proxyOpts.OTLPEndpoint)
+		if err := mgr.Add(metrics.NewOTLPRunnable(metricsServerRunnable)); err != nil {
+			setupLog.Error(err, "Unable to add OTLP runnable")
+			os.Exit(1)
+		}
+	}
+
+	// Only the namespace enrichment rules are reloaded, including the namespaces excluded from the pod labels,
+	// other options require a restart.
+	reloadRules := func(ctx context.Context, opts *metrics.ServerRunnableOpts) error {
+		rules := controller.NamespaceRules{
+			AnnotationAllowlist: opts.AnnotationAllowlist,
+			ExcludeNamespaces:   opts.ExcludeNamespaces,
+		}
+		if opts.NamespaceSelector != nil {
+			var err error
+			if rules.NamespaceSelector, err = metav1.LabelSelectorAsSelector(opts.NamespaceSelector); err != nil {
+				return err
+			}
+		}
+		if err := namespaceReconciler.Reload(ctx, rules); err != nil {
+			return err
+		}
+		if podReconciler != nil {
+			if err := podReconciler.Reload(ctx, opts.ExcludeNamespaces); err != nil {
+				return err
+			}
+		}
+		metricsServerRunnable.SetEnrichmentRules(opts.EnrichmentRules())
+		return nil
+	}
+	if len(config.ConfigFile) > 0 && config.ConfigReloadInterval > 0 {
+		if err := mgr.Add(&kmpconfig.Watcher{
+			Path:     config.ConfigFile,
+			Interval: config.ConfigReloadInterval,
+			FlagSet:  flag.CommandLine,
+			OnChange: reloadRules,
+		}); err != nil {
+			setupLog.Error(err, "Unable to add config watcher")
+			os.Exit(1)
+		}
+	}
+	if configMap.Name != "" {
+		if err := (&controller.ConfigMapReconciler{
+			Client:    mgr.GetClient(),
+			Namespace: configMap.Namespace,
+			Name:      configMap.Name,
+			Key:       config.ConfigMapKey,
+			FlagSet:   flag.CommandLine,
+			OnChange:  reloadRules,
+		}).SetupWithManager(mgr, config.CacheSyncTimeout); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ConfigMap")
+			os.Exit(1)
+		}
+	}
 
 	// go nsmetrics.StartMetricsServer("8080", namespaceMetrics, nodeIP, nodePort, nodeCadvisorPath)
 
-	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	ctx := ctrl.SetupSignalHandler()
+	if proxyOpts.Preflight {
+		// Fail fast on a kubelet that can not be scraped instead of failing every scrape.
+		if err := metricsServerRunnable.Preflight(ctx); err != nil {
+			setupLog.Error(err, "Kubelet preflight check failed")
+			os.Exit(1)
+		}
+		setupLog.Info("Kubelet preflight check passed")
+	}
+
+	setupLog.Info("starting manager", "version", version.Version, "commit", version.Commit)
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
-
 }
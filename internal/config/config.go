@@ -0,0 +1,413 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+// Defaults returns the options used when neither a config file nor flags set a value.
+func Defaults() metrics.ServerRunnableOpts {
+	return metrics.ServerRunnableOpts{
+		NodeNameOrIP:           "localhost",
+		NodePort:               "10250",
+		Scheme:                 metrics.DefaultScheme,
+		NamespaceLabelKey:      metrics.DefaultNamespaceLabelKey,
+		FetchMaxAttempts:       1,
+		FetchRetryBaseDelay:    100 * time.Millisecond,
+		ScrapeQueueTimeout:     5 * time.Second,
+		CircuitBreakerCooldown: metrics.DefaultCircuitBreakerCooldown,
+		MaxResponseBytes:       metrics.DefaultMaxResponseBytes,
+		PushInterval:           metrics.DefaultPushInterval,
+		OTLPInterval:           metrics.DefaultOTLPInterval,
+		OTLPKubeletPath:        metrics.DefaultOTLPKubeletPath,
+		PushJob:                metrics.DefaultPushJob,
+		PushKubeletPath:        metrics.DefaultPushKubeletPath,
+	}
+}
+
+// Load reads the YAML config file at path on top of Defaults.
+// Durations are written as Go duration strings, e.g. "30s".
+func Load(path string) (*metrics.ServerRunnableOpts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	opts, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %q: %w", path, err)
+	}
+	return opts, nil
+}
+
+// Parse reads options written like the config file from data on top of Defaults.
+func Parse(data []byte) (*metrics.ServerRunnableOpts, error) {
+	file := fileConfig{ServerRunnableOpts: Defaults()}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return file.options()
+}
+
+// Reload parses data like Parse, then applies the environment variables and the flags set on fs, if any,
+// on top and validates the result, so reloaded options are layered like the ones read at startup.
+func Reload(data []byte, fs *flag.FlagSet) (*metrics.ServerRunnableOpts, error) {
+	opts, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := ApplyEnv(opts); err != nil {
+		return nil, fmt.Errorf("apply environment variables: %w", err)
+	}
+	if fs != nil {
+		if err := ApplyFlags(opts, fs); err != nil {
+			return nil, err
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// fileConfig is the layout of the config file: the options plus those written
+// differently than their Go type, such as selectors in their string form.
+type fileConfig struct {
+	metrics.ServerRunnableOpts `yaml:",inline"`
+
+	NamespaceSelector string `yaml:"namespaceSelector"`
+}
+
+// options returns the options with the fields written in another form converted.
+func (f *fileConfig) options() (*metrics.ServerRunnableOpts, error) {
+	opts := f.ServerRunnableOpts
+	if f.NamespaceSelector != "" {
+		selector, err := metav1.ParseToLabelSelector(f.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("namespaceSelector: %w", err)
+		}
+		opts.NamespaceSelector = selector
+	}
+	return &opts, nil
+}
+
+// BindFlags registers the command-line flags for opts on fs.
+// The current values of opts are used as flag defaults.
+func BindFlags(fs *flag.FlagSet, opts *metrics.ServerRunnableOpts) {
+	fs.StringVar(&opts.NodeNameOrIP, "node-name-or-ip", opts.NodeNameOrIP, "The name or IP of the node.")
+	fs.StringVar(&opts.NodePort, "node-port", opts.NodePort, "The port of the kubelet.")
+	fs.StringVar(&opts.Scheme, "kubelet-scheme", opts.Scheme,
+		"The scheme of the kubelet URL, http or https. http is only meant for read-only kubelet ports.")
+	fs.BoolVar(&opts.LocalNodeOnly, "local-node-only", opts.LocalNodeOnly,
+		"If set, only the kubelet of the local node named by the NODE_NAME environment variable is scraped, "+
+			"directly and not through --kube-apiserver. Without NODE_NAME, 127.0.0.1 is used.")
+	fs.StringVar(&opts.UnixSocketPath, "kubelet-unix-socket", opts.UnixSocketPath,
+		"Path of a Unix domain socket the kubelet is reached on. Takes precedence over --node-name-or-ip, "+
+			"--node-port, --local-node-only and --kube-apiserver.")
+	fs.BoolVar(&opts.ResolveNodeIP, "resolve-node-ip", opts.ResolveNodeIP,
+		"If set, --node-name-or-ip is a node name and the kubelet is reached on the InternalIP of that Node.")
+	fs.StringVar(&opts.KubeApiserver, "kube-apiserver", opts.KubeApiserver, "The address of the kube-apiserver.")
+	fs.BoolVar(&opts.InsecureSkipVerify, "kubelet-insecure-skip-verify", opts.InsecureSkipVerify,
+		"If set, the kubelet serving certificate is not verified.")
+	fs.StringVar(&opts.KubeletCAFile, "kubelet-ca-file", opts.KubeletCAFile,
+		"Path to a PEM CA bundle used to verify the kubelet serving certificate. Takes precedence over "+
+			"--kubelet-insecure-skip-verify.")
+	fs.StringVar(&opts.UpstreamProxyURL, "kubelet-proxy-url", opts.UpstreamProxyURL,
+		"Forward proxy the kubelet requests are sent through, e.g. http://proxy:3128. "+
+			"If empty, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.")
+	fs.Var((*stringMap)(&opts.UpstreamHeaders), "kubelet-headers",
+		"Comma-separated list of Name=value headers added to every kubelet request, e.g. X-Gateway-Token=secret.")
+	fs.DurationVar(&opts.FetchTimeout, "kubelet-fetch-timeout", opts.FetchTimeout,
+		"Timeout for a single kubelet fetch. 0 disables the timeout.")
+	fs.IntVar(&opts.FetchMaxAttempts, "kubelet-fetch-max-attempts", opts.FetchMaxAttempts,
+		"Maximum number of attempts for a kubelet fetch. Network errors and 5xx responses are retried.")
+	fs.DurationVar(&opts.FetchRetryBaseDelay, "kubelet-fetch-retry-delay", opts.FetchRetryBaseDelay,
+		"Delay before the first kubelet fetch retry, doubled for every following retry.")
+	fs.BoolVar(&opts.Preflight, "kubelet-preflight", opts.Preflight,
+		"If set, the kubelet metrics are fetched once at startup and the proxy exits when they can not be.")
+	fs.BoolVar(&opts.ServeResourceMetrics, "serve-resource-metrics", opts.ServeResourceMetrics,
+		"If set, the kubelet /metrics/resource endpoint is served on /metrics/resource.")
+	fs.BoolVar(&opts.ServeProbeMetrics, "serve-probe-metrics", opts.ServeProbeMetrics,
+		"If set, the kubelet /metrics/probes endpoint is served on /metrics/probes.")
+	fs.Var((*stringList)(&opts.ProbeAllowedPaths), "probe-allowed-paths",
+		"Comma-separated list of kubelet paths that can be fetched on demand with /probe?path=, e.g. /metrics/resource.")
+	fs.StringVar(&opts.PushGatewayURL, "push-gateway-url", opts.PushGatewayURL,
+		"If set, the enriched metrics are also pushed to this Prometheus Pushgateway, e.g. http://pushgateway:9091.")
+	fs.DurationVar(&opts.PushInterval, "push-interval", opts.PushInterval, "How often metrics are pushed to the Pushgateway.")
+	fs.StringVar(&opts.PushJob, "push-job", opts.PushJob, "The job the metrics are pushed under.")
+	fs.Var((*stringMap)(&opts.PushGroupingKey), "push-grouping-key",
+		"Comma-separated list of name=value labels grouping the pushed metrics, e.g. instance=worker-1.")
+	fs.StringVar(&opts.PushKubeletPath, "push-kubelet-path", opts.PushKubeletPath, "The kubelet path whose metrics are pushed.")
+	fs.StringVar(&opts.OTLPEndpoint, "otlp-endpoint", opts.OTLPEndpoint,
+		"If set, the enriched metrics are also exported to this OTLP/gRPC host:port, e.g. otel-collector:4317.")
+	fs.DurationVar(&opts.OTLPInterval, "otlp-interval", opts.OTLPInterval, "How often metrics are exported over OTLP.")
+	fs.BoolVar(&opts.OTLPInsecure, "otlp-insecure", opts.OTLPInsecure, "If set, the OTLP endpoint is reached without TLS.")
+	fs.StringVar(&opts.OTLPKubeletPath, "otlp-kubelet-path", opts.OTLPKubeletPath, "The kubelet path whose metrics are exported over OTLP.")
+	fs.Int64Var(&opts.MaxResponseBytes, "kubelet-max-response-bytes", opts.MaxResponseBytes,
+		"Largest kubelet response in bytes that is read. Larger responses fail the scrape.")
+	fs.BoolVar(&opts.LenientParsing, "lenient-parsing", opts.LenientParsing,
+		"If set, malformed metric families of the kubelet response are skipped instead of failing the scrape.")
+	fs.IntVar(&opts.MaxConcurrentScrapes, "max-concurrent-scrapes", opts.MaxConcurrentScrapes,
+		"Maximum number of kubelet fetches running at the same time. 0 means no limit.")
+	fs.DurationVar(&opts.ScrapeQueueTimeout, "scrape-queue-timeout", opts.ScrapeQueueTimeout,
+		"How long a scrape waits for a free kubelet fetch slot before it is answered with 429.")
+	fs.IntVar(&opts.CircuitBreakerThreshold, "kubelet-circuit-breaker-threshold", opts.CircuitBreakerThreshold,
+		"Consecutive failed kubelet fetches after which scrapes are answered with 503 without contacting the kubelet. 0 disables it.")
+	fs.DurationVar(&opts.CircuitBreakerCooldown, "kubelet-circuit-breaker-cooldown", opts.CircuitBreakerCooldown,
+		"How long the kubelet is not contacted once the circuit breaker tripped, before a single probe is let through.")
+	fs.DurationVar(&opts.CacheTTL, "metrics-cache-ttl", opts.CacheTTL,
+		"How long a kubelet response is reused for subsequent scrapes. 0 disables caching.")
+	fs.Var((*durationMap)(&opts.CacheTTLs), "metrics-cache-ttls",
+		"Comma-separated list of path=ttl overriding --metrics-cache-ttl per served endpoint, e.g. /metrics/cadvisor=30s,/metrics=5s.")
+	fs.DurationVar(&opts.MinScrapeInterval, "min-scrape-interval", opts.MinScrapeInterval,
+		"Shortest time between two kubelet fetches of an endpoint. Scrapes arriving sooner are served the last response.")
+	fs.Var(labelSelector{&opts.NamespaceSelector}, "namespace-selector",
+		"Label selector of the namespaces whose labels are stored, e.g. team,tier=web. If empty, all namespaces are.")
+	fs.Var((*stringList)(&opts.ExcludeNamespaces), "exclude-namespaces",
+		"Comma-separated list of namespaces whose labels are never stored nor injected, e.g. kube-system,kube-public.")
+	fs.BoolVar(&opts.OnlyEnriched, "only-enriched", opts.OnlyEnriched,
+		"If set, metrics whose namespace label does not match a stored namespace are dropped.")
+	fs.StringVar(&opts.NamespaceLabelKey, "namespace-label-key", opts.NamespaceLabelKey,
+		"The metric label that holds the namespace name of a series.")
+	fs.Var((*stringList)(&opts.LabelAllowlist), "namespace-label-allowlist",
+		"Comma-separated list of namespace label keys to attach to metrics. If empty, all labels are attached.")
+	fs.Var((*stringList)(&opts.LabelDenylist), "namespace-label-denylist",
+		"Comma-separated list of namespace label keys never attached to metrics. Applied after the allowlist.")
+	fs.StringVar(&opts.LabelPrefix, "namespace-label-prefix", opts.LabelPrefix,
+		"Prefix prepended to the name of every injected namespace label, e.g. ns_.")
+	fs.Var((*stringList)(&opts.AnnotationAllowlist), "namespace-annotation-allowlist",
+		"Comma-separated list of namespace annotation keys to attach to metrics as labels.")
+	fs.Var((*stringList)(&opts.DropLabels), "drop-labels",
+		"Comma-separated list of labels removed from the kubelet metrics before enrichment, e.g. id,image.")
+	fs.Var((*stringMap)(&opts.RenameLabels), "rename-labels",
+		"Comma-separated list of old=new label renames applied to the kubelet metrics, e.g. container=container_name.")
+	fs.Var((*stringMap)(&opts.StaticLabels), "static-labels",
+		"Comma-separated list of name=value labels added to every metric that does not have them, e.g. cluster=prod-eu.")
+	fs.Var((*stringList)(&opts.LabelPrecedence), "label-precedence",
+		"Comma-separated order of the label sources namespace, pod, static and node. An earlier source wins a "+
+			"name clash, sources left out follow in the default order namespace,pod,static,node.")
+	fs.BoolVar(&opts.NamespaceCreationTime, "namespace-creation-time", opts.NamespaceCreationTime,
+		"If set, the creation time of the namespace of a metric is attached as namespace_created, in unix seconds.")
+	fs.Var((*stringList)(&opts.PodLabelAllowlist), "pod-label-allowlist",
+		"Comma-separated list of pod label keys attached to the metrics of the pod, e.g. app,team. "+
+			"Pods are not watched when empty and --pod-owner-labels is not set.")
+	fs.BoolVar(&opts.PodOwnerLabels, "pod-owner-labels", opts.PodOwnerLabels,
+		"If set, the workload owning the pod of a metric, e.g. its Deployment, is attached as owner_kind and owner_name.")
+	fs.IntVar(&opts.MaxInjectedLabels, "max-injected-labels", opts.MaxInjectedLabels,
+		"Maximum number of namespace labels, annotations and pod labels attached to a single metric. 0 means no limit.")
+	fs.BoolVar(&opts.NormalizeLabelValues, "normalize-label-values", opts.NormalizeLabelValues,
+		"If set, the values of the namespace labels, annotations and pod labels attached to metrics are trimmed "+
+			"and lowercased.")
+	fs.BoolVar(&opts.StripTimestamps, "strip-timestamps", opts.StripTimestamps,
+		"If set, explicit timestamps are removed from the kubelet metrics, so the scrape time is used instead.")
+	fs.StringVar(&opts.NodeLabelName, "node-label-name", opts.NodeLabelName,
+		"Label set to --node-name-or-ip on every metric that does not have it yet, e.g. node. Disabled when empty.")
+	fs.StringVar(&opts.Instance, "instance", opts.Instance,
+		"Value of the kmp_instance label added to every metric, e.g. the pod name. "+
+			"Defaults to the POD_NAME environment variable, disabled when both are empty.")
+	fs.Var((*repeatedList)(&opts.MetricNameKeep), "metric-name-keep",
+		"Regex of metric names to export; all other metrics are dropped. May be repeated.")
+	fs.Var((*repeatedList)(&opts.MetricNameDrop), "metric-name-drop",
+		"Regex of metric names to drop unless they match --metric-name-keep. May be repeated.")
+	fs.StringVar(&opts.Preset, "preset", opts.Preset,
+		"Curated list of metric names to export, e.g. resource-basic for the container CPU, memory and network "+
+			"metrics. --metric-name-keep replaces it and --metric-name-drop removes names from it.")
+	fs.StringVar(&opts.BindAddress, "proxy-bind-address", opts.BindAddress,
+		"The host:port the custom metrics server binds to, e.g. 127.0.0.1:8080. Overrides --metrics-port.")
+	fs.StringVar(&opts.AuthTokenFile, "metrics-auth-token-file", opts.AuthTokenFile,
+		"File with a bearer token required to scrape the custom metrics server. If empty, no authentication is required.")
+	fs.BoolVar(&opts.EnablePprof, "enable-pprof", opts.EnablePprof,
+		"If set, pprof profiles are served on /debug/pprof/ of the custom metrics server.")
+	fs.BoolVar(&opts.EnableDebugEndpoints, "enable-debug-endpoints", opts.EnableDebugEndpoints,
+		"If set, the custom metrics server serves the stored namespace labels on /debug/namespaces, the enrichment "+
+			"preview on /debug/preview and the un-enriched kubelet metrics on /metrics/raw. Without "+
+			"--metrics-auth-token-file, anyone reaching the server can read the raw kubelet output.")
+	fs.BoolVar(&opts.RegisterManagerMetrics, "register-manager-metrics", opts.RegisterManagerMetrics,
+		"If set, the kmp_* metrics are also served by the manager metrics endpoint (--metrics-bind-address).")
+	fs.BoolVar(&opts.JSONErrors, "json-errors", opts.JSONErrors,
+		"If set, failed scrapes are answered with a JSON body holding a sanitized message and an error code.")
+	fs.StringVar(&opts.TextContentType, "text-content-type", opts.TextContentType,
+		"Content-Type of the responses in the text format, e.g. 'text/plain; version=0.0.4'. "+
+			"If empty, it is derived from the format.")
+	fs.BoolVar(&opts.AccessLog, "access-log", opts.AccessLog,
+		"If set, every request to the custom metrics server is logged with its status, size and duration.")
+	fs.IntVar(&opts.AccessLogVerbosity, "access-log-verbosity", opts.AccessLogVerbosity,
+		"Log verbosity of the access log, e.g. 1 to only log requests with --zap-log-level=debug.")
+	fs.StringVar(&opts.TLSCertFile, "metrics-tls-cert-file", opts.TLSCertFile,
+		"Certificate file to serve the custom metrics server over HTTPS. Requires --metrics-tls-key-file.")
+	fs.StringVar(&opts.TLSKeyFile, "metrics-tls-key-file", opts.TLSKeyFile,
+		"Key file to serve the custom metrics server over HTTPS. Requires --metrics-tls-cert-file.")
+}
+
+// ApplyFlags overrides opts with every flag registered by BindFlags that was explicitly set on fs.
+// It is used to give command-line flags precedence over values loaded from a config file.
+func ApplyFlags(opts *metrics.ServerRunnableOpts, fs *flag.FlagSet) error {
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	BindFlags(overrides, opts)
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil || overrides.Lookup(f.Name) == nil {
+			return
+		}
+		if list, ok := f.Value.(listValue); ok {
+			*overrides.Lookup(f.Name).Value.(listValue).list() = slices.Clone(*list.list())
+			return
+		}
+		if setErr := overrides.Set(f.Name, f.Value.String()); setErr != nil {
+			err = fmt.Errorf("apply flag --%s: %w", f.Name, setErr)
+		}
+	})
+	return err
+}
+
+// listValue is implemented by the flag values holding a list, so ApplyFlags can copy
+// them as is instead of round-tripping through their string form.
+type listValue interface {
+	list() *[]string
+}
+
+// stringList is a flag.Value holding a comma-separated list. Empty entries are dropped.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*l = items
+	return nil
+}
+
+func (l *stringList) list() *[]string { return (*[]string)(l) }
+
+// repeatedList is a flag.Value collecting one item per occurrence of the flag.
+// Unlike stringList it does not split on commas, so items may be regexes such as "a{1,3}".
+type repeatedList []string
+
+func (l *repeatedList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *repeatedList) list() *[]string { return (*[]string)(l) }
+
+// stringMap is a flag.Value holding a comma-separated list of key=value pairs.
+type stringMap map[string]string
+
+func (m *stringMap) String() string {
+	if m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*m))
+	for k, v := range *m {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *stringMap) Set(value string) error {
+	pairs := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || k == "" || v == "" {
+			return fmt.Errorf("expected key=value, got %q", item)
+		}
+		pairs[k] = v
+	}
+	*m = pairs
+	return nil
+}
+
+// durationMap is a flag.Value holding a comma-separated list of key=duration pairs, e.g. /metrics=5s.
+type durationMap map[string]time.Duration
+
+func (m *durationMap) String() string {
+	if m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*m))
+	for k, v := range *m {
+		pairs = append(pairs, k+"="+v.String())
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *durationMap) Set(value string) error {
+	var pairs stringMap
+	if err := pairs.Set(value); err != nil {
+		return err
+	}
+	durations := make(map[string]time.Duration, len(pairs))
+	for k, v := range pairs {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %q: %w", k, err)
+		}
+		durations[k] = d
+	}
+	*m = durations
+	return nil
+}
+
+// labelSelector is a flag.Value holding a label selector in its string form, e.g. "team,tier in (web,db)".
+type labelSelector struct {
+	selector **metav1.LabelSelector
+}
+
+func (s labelSelector) String() string {
+	if s.selector == nil || *s.selector == nil {
+		return ""
+	}
+	if formatted := metav1.FormatLabelSelector(*s.selector); formatted != "<none>" {
+		return formatted
+	}
+	return ""
+}
+
+func (s labelSelector) Set(value string) error {
+	if strings.TrimSpace(value) == "" {
+		*s.selector = nil
+		return nil
+	}
+	selector, err := metav1.ParseToLabelSelector(value)
+	if err != nil {
+		return err
+	}
+	*s.selector = selector
+	return nil
+}
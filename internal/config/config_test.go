@@ -0,0 +1,245 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/relabel"
+)
+
+const sampleConfig = `
+nodeNameOrIP: 10.0.0.7
+nodePort: "10255"
+kubeApiserver: kubernetes.default.svc
+labelAllowlist: [team, tier]
+labelDenylist: [tier]
+labelPrefix: ns_
+namespaceSelector: monitored=true
+cacheTTL: 15s
+fetchTimeout: 2s
+fetchMaxAttempts: 3
+relabelConfigs:
+  - source_labels: [namespace]
+    regex: kube-.*
+    action: drop
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	opts, err := Load(writeConfig(t, sampleConfig))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if opts.NodeNameOrIP != "10.0.0.7" || opts.NodePort != "10255" || opts.KubeApiserver != "kubernetes.default.svc" {
+		t.Errorf("unexpected node settings: %+v", opts)
+	}
+	if !reflect.DeepEqual(opts.LabelAllowlist, []string{"team", "tier"}) ||
+		!reflect.DeepEqual(opts.LabelDenylist, []string{"tier"}) || opts.LabelPrefix != "ns_" {
+		t.Errorf("unexpected label settings: %+v", opts)
+	}
+	if opts.CacheTTL != 15*time.Second || opts.FetchTimeout != 2*time.Second || opts.FetchMaxAttempts != 3 {
+		t.Errorf("unexpected fetch settings: %+v", opts)
+	}
+	if len(opts.RelabelConfigs) != 1 || opts.RelabelConfigs[0].Action != relabel.Drop ||
+		opts.RelabelConfigs[0].Separator != relabel.DefaultSeparator {
+		t.Errorf("unexpected relabel configs: %+v", opts.RelabelConfigs)
+	}
+	if sel := opts.NamespaceSelector; sel == nil || sel.MatchLabels["monitored"] != "true" {
+		t.Errorf("unexpected namespace selector: %+v", sel)
+	}
+	// Values missing from the file keep their defaults.
+	if opts.NamespaceLabelKey != Defaults().NamespaceLabelKey {
+		t.Errorf("NamespaceLabelKey = %q, want default", opts.NamespaceLabelKey)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	if _, err := Load(writeConfig(t, "nodeNameOrIp: typo\n")); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
+
+func TestApplyFlagsPrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagOpts := Defaults()
+	BindFlags(fs, &flagOpts)
+	args := []string{
+		"--node-port=10250", "--namespace-label-allowlist=owner",
+		"--rename-labels=container=container_name,pod=pod_name", "--namespace-selector=tier in (web,db)",
+		"--metric-name-keep=container_cpu_.*", "--metric-name-keep=container_fs_(reads|writes){1,2}_total",
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+
+	opts, err := Load(writeConfig(t, sampleConfig))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := ApplyFlags(opts, fs); err != nil {
+		t.Fatalf("ApplyFlags: %v", err)
+	}
+
+	// Flags given on the command line win.
+	if opts.NodePort != "10250" {
+		t.Errorf("NodePort = %q, want flag value 10250", opts.NodePort)
+	}
+	if !reflect.DeepEqual(opts.LabelAllowlist, []string{"owner"}) {
+		t.Errorf("LabelAllowlist = %v, want flag value [owner]", opts.LabelAllowlist)
+	}
+	if want := map[string]string{"container": "container_name", "pod": "pod_name"}; !reflect.DeepEqual(opts.RenameLabels, want) {
+		t.Errorf("RenameLabels = %v, want %v", opts.RenameLabels, want)
+	}
+	if got := metav1.FormatLabelSelector(opts.NamespaceSelector); got != "tier in (db,web)" {
+		t.Errorf("NamespaceSelector = %q, want flag value tier in (db,web)", got)
+	}
+	wantKeep := []string{"container_cpu_.*", "container_fs_(reads|writes){1,2}_total"}
+	if !reflect.DeepEqual(opts.MetricNameKeep, wantKeep) {
+		t.Errorf("MetricNameKeep = %v, want %v", opts.MetricNameKeep, wantKeep)
+	}
+	// Flags left at their defaults do not clobber file values.
+	if opts.NodeNameOrIP != "10.0.0.7" || opts.CacheTTL != 15*time.Second {
+		t.Errorf("file values were overridden by flag defaults: %+v", opts)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("KMP_NODE_PORT", "10255")
+	t.Setenv("KMP_CACHE_TTL", "30s")
+	t.Setenv("KMP_INSECURE_SKIP_VERIFY", "true")
+	t.Setenv("KMP_FETCH_MAX_ATTEMPTS", "4")
+	t.Setenv("KMP_KUBELET_CA_FILE", "/etc/ca.crt")
+	t.Setenv("KMP_LABEL_ALLOWLIST", "team, tier")
+	t.Setenv("KMP_METRIC_NAME_KEEP", `["container_fs_(reads|writes){1,2}_total"]`)
+	t.Setenv("KMP_STATIC_LABELS", "cluster=prod-eu")
+	t.Setenv("KMP_CACHE_TTLS", "/metrics/cadvisor=1m,/metrics=5s")
+	t.Setenv("KMP_NAMESPACE_SELECTOR", "monitored=true")
+	t.Setenv("KMP_NODES", "[{name: worker-1, address: 10.0.0.7}]")
+
+	opts := Defaults()
+	if err := ApplyEnv(&opts); err != nil {
+		t.Fatalf("ApplyEnv: %v", err)
+	}
+
+	if opts.NodePort != "10255" || opts.CacheTTL != 30*time.Second || !opts.InsecureSkipVerify ||
+		opts.FetchMaxAttempts != 4 || opts.KubeletCAFile != "/etc/ca.crt" {
+		t.Errorf("unexpected scalar settings: %+v", opts)
+	}
+	if !reflect.DeepEqual(opts.LabelAllowlist, []string{"team", "tier"}) {
+		t.Errorf("LabelAllowlist = %v, want [team tier]", opts.LabelAllowlist)
+	}
+	if !reflect.DeepEqual(opts.MetricNameKeep, []string{"container_fs_(reads|writes){1,2}_total"}) {
+		t.Errorf("MetricNameKeep = %v", opts.MetricNameKeep)
+	}
+	if !reflect.DeepEqual(opts.StaticLabels, map[string]string{"cluster": "prod-eu"}) {
+		t.Errorf("StaticLabels = %v", opts.StaticLabels)
+	}
+	if want := map[string]time.Duration{"/metrics/cadvisor": time.Minute, "/metrics": 5 * time.Second}; !reflect.DeepEqual(opts.CacheTTLs, want) {
+		t.Errorf("CacheTTLs = %v, want %v", opts.CacheTTLs, want)
+	}
+	if sel := opts.NamespaceSelector; sel == nil || sel.MatchLabels["monitored"] != "true" {
+		t.Errorf("unexpected namespace selector: %+v", sel)
+	}
+	if len(opts.Nodes) != 1 || opts.Nodes[0].Name != "worker-1" || opts.Nodes[0].Address != "10.0.0.7" {
+		t.Errorf("unexpected nodes: %+v", opts.Nodes)
+	}
+	// Unset variables keep their defaults.
+	if opts.NodeNameOrIP != Defaults().NodeNameOrIP {
+		t.Errorf("NodeNameOrIP = %q, want default", opts.NodeNameOrIP)
+	}
+}
+
+func TestApplyEnvPrecedence(t *testing.T) {
+	t.Setenv("KMP_NODE_PORT", "10255")
+	t.Setenv("KMP_LABEL_PREFIX", "env_")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagOpts := Defaults()
+	BindFlags(fs, &flagOpts)
+	if err := fs.Parse([]string{"--node-port=10250"}); err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+
+	opts, err := Load(writeConfig(t, sampleConfig))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := ApplyEnv(opts); err != nil {
+		t.Fatalf("ApplyEnv: %v", err)
+	}
+	if err := ApplyFlags(opts, fs); err != nil {
+		t.Fatalf("ApplyFlags: %v", err)
+	}
+
+	if opts.NodePort != "10250" {
+		t.Errorf("NodePort = %q, want flag value 10250", opts.NodePort)
+	}
+	if opts.LabelPrefix != "env_" {
+		t.Errorf("LabelPrefix = %q, want env value env_ over file value", opts.LabelPrefix)
+	}
+	if opts.NodeNameOrIP != "10.0.0.7" {
+		t.Errorf("NodeNameOrIP = %q, want file value 10.0.0.7", opts.NodeNameOrIP)
+	}
+}
+
+func TestApplyEnvReplacesMaps(t *testing.T) {
+	t.Setenv("KMP_STATIC_LABELS", "cluster=staging")
+
+	opts, err := Load(writeConfig(t, `
+staticLabels:
+  cluster: prod
+  region: eu
+cacheTTLs:
+  /metrics: 5s
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := ApplyEnv(opts); err != nil {
+		t.Fatalf("ApplyEnv: %v", err)
+	}
+	if want := map[string]string{"cluster": "staging"}; !reflect.DeepEqual(opts.StaticLabels, want) {
+		t.Errorf("StaticLabels = %v, want only the env value %v", opts.StaticLabels, want)
+	}
+	if want := map[string]time.Duration{"/metrics": 5 * time.Second}; !reflect.DeepEqual(opts.CacheTTLs, want) {
+		t.Errorf("CacheTTLs = %v, want the file value %v", opts.CacheTTLs, want)
+	}
+}
+
+func TestApplyEnvInvalidValue(t *testing.T) {
+	t.Setenv("KMP_CACHE_TTL", "soon")
+	opts := Defaults()
+	if err := ApplyEnv(&opts); err == nil {
+		t.Fatal("expected an error for an invalid duration")
+	}
+}
+
+func TestUpperSnakeCase(t *testing.T) {
+	for in, want := range map[string]string{
+		"nodePort":      "NODE_PORT",
+		"cacheTTL":      "CACHE_TTL",
+		"cacheTTLs":     "CACHE_TTLS",
+		"nodeNameOrIP":  "NODE_NAME_OR_IP",
+		"kubeletCAFile": "KUBELET_CA_FILE",
+		"tlsCertFile":   "TLS_CERT_FILE",
+	} {
+		if got := upperSnakeCase(in); got != want {
+			t.Errorf("upperSnakeCase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
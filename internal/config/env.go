@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+// EnvPrefix prefixes the environment variables read by ApplyEnv.
+const EnvPrefix = "KMP_"
+
+// ApplyEnv overrides opts with the environment variables set for the config file keys.
+// The variable of a key is EnvPrefix followed by the key in upper snake case, e.g. KMP_NODE_PORT
+// for nodePort and KMP_CACHE_TTL for cacheTTL. Values are written like in the config file, except
+// for lists of strings and maps which are comma-separated like their flags, e.g. "team,tier" and
+// "cluster=prod-eu". Lists starting with "[" are read as YAML, which allows commas in items such as
+// regexes and lists of objects, e.g. "[{name: worker-1}]". A variable replaces the whole value,
+// maps are not merged with the keys set in the config file.
+func ApplyEnv(opts *metrics.ServerRunnableOpts) error {
+	file := fileConfig{ServerRunnableOpts: *opts}
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, field := range envFields() {
+		value, ok := os.LookupEnv(field.env)
+		if !ok {
+			continue
+		}
+		node, err := envNode(field.typ, value)
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %w", field.env, err)
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: field.key}, node)
+		// Decoding into a map merges the keys with those already set, e.g. from the config file.
+		// The variable replaces the value instead, like a flag.
+		reflect.ValueOf(&file).Elem().FieldByIndex(field.index).SetZero()
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	if err := doc.Decode(&file); err != nil {
+		return fmt.Errorf("parse environment variables: %w", err)
+	}
+	parsed, err := file.options()
+	if err != nil {
+		return fmt.Errorf("parse environment variables: %w", err)
+	}
+	*opts = *parsed
+	return nil
+}
+
+type envField struct {
+	key string
+	env string
+	typ reflect.Type
+	// index is the index sequence of the field in fileConfig.
+	index []int
+}
+
+// envFields lists the config file keys with their environment variable.
+func envFields() []envField {
+	var fields []envField
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			fieldIndex := append(slices.Clone(index), i)
+			name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			switch {
+			case opts == "inline":
+				walk(f.Type, fieldIndex)
+			case name != "" && name != "-" && f.IsExported():
+				fields = append(fields, envField{
+					key: name, env: EnvPrefix + upperSnakeCase(name), typ: f.Type, index: fieldIndex,
+				})
+			}
+		}
+	}
+	walk(reflect.TypeOf(fileConfig{}), nil)
+	return fields
+}
+
+// envNode converts the value of an environment variable into the YAML node of a field of type t.
+func envNode(t reflect.Type, value string) (*yaml.Node, error) {
+	switch {
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String && !strings.HasPrefix(value, "["):
+		var list stringList
+		_ = list.Set(value)
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range list {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+		}
+		return node, nil
+	case t.Kind() == reflect.Map:
+		var m stringMap
+		if err := m.Set(value); err != nil {
+			return nil, err
+		}
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k},
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: m[k]})
+		}
+		return node, nil
+	case t.Kind() == reflect.Slice:
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(value), &doc); err != nil {
+			return nil, err
+		}
+		if len(doc.Content) == 0 {
+			return &yaml.Node{Kind: yaml.SequenceNode}, nil
+		}
+		return doc.Content[0], nil
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: value}, nil
+	}
+}
+
+// upperSnakeCase converts a camelCase key to UPPER_SNAKE_CASE, keeping acronyms together:
+// nodeNameOrIP becomes NODE_NAME_OR_IP and kubeletCAFile becomes KUBELET_CA_FILE.
+func upperSnakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || startsWord(runes, i) && !pluralAcronym(runes, i)) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// startsWord reports whether the upper case rune at i is followed by a lower case one.
+func startsWord(runes []rune, i int) bool {
+	return i+1 < len(runes) && unicode.IsLower(runes[i+1])
+}
+
+// pluralAcronym reports whether the rune at i ends an acronym followed by a plural "s", as in cacheTTLs.
+func pluralAcronym(runes []rune, i int) bool {
+	return runes[i+1] == 's' && (i+2 == len(runes) || unicode.IsUpper(runes[i+2]))
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+// Watcher reloads the config file when its content changes, e.g. a mounted ConfigMap that was updated,
+// and passes the new options to OnChange. The environment variables and the flags set on FlagSet
+// are applied on top, like at startup. It implements the manager Runnable interface.
+type Watcher struct {
+	Path string
+	// Interval is how often the file is read.
+	Interval time.Duration
+	FlagSet  *flag.FlagSet
+	OnChange func(ctx context.Context, opts *metrics.ServerRunnableOpts) error
+	// Clock drives the checks. Defaults to the real clock.
+	Clock clock.WithTicker
+}
+
+// Start checks the file every Interval until ctx is done.
+// A file that can not be loaded is logged and the options in effect are kept until it is fixed.
+// When OnChange fails, the file is applied again at the next check.
+func (w *Watcher) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("config.Watcher")
+	clk := w.Clock
+	if clk == nil {
+		clk = clock.RealClock{}
+	}
+
+	// last is the content applied last, invalid is the content last found invalid.
+	last, err := os.ReadFile(w.Path)
+	if err != nil {
+		logger.Error(err, "unable to read config file", "config", w.Path)
+	}
+	var invalid []byte
+	ticker := clk.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+
+		data, err := os.ReadFile(w.Path)
+		if err != nil {
+			logger.Error(err, "unable to read config file", "config", w.Path)
+			continue
+		}
+		if bytes.Equal(data, last) || (invalid != nil && bytes.Equal(data, invalid)) {
+			continue
+		}
+
+		opts, err := Reload(data, w.FlagSet)
+		if err != nil {
+			// Retrying would not help until the file changes again.
+			logger.Error(err, "ignoring invalid config file", "config", w.Path)
+			invalid = data
+			continue
+		}
+		logger.Info("Config file changed, reloading", "config", w.Path)
+		if err := w.OnChange(ctx, opts); err != nil {
+			logger.Error(err, "unable to apply the reloaded config file", "config", w.Path)
+			continue
+		}
+		last = data
+	}
+}
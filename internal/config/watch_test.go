@@ -0,0 +1,89 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+func TestWatcherReloadsChangedConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := writeConfig(t, "labelAllowlist: [team]\n")
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	reloaded := make(chan *metrics.ServerRunnableOpts, 1)
+	// The first change fails to apply and must be applied again at the next check.
+	failures := 1
+	w := &Watcher{
+		Path:     path,
+		Interval: time.Minute,
+		Clock:    fakeClock,
+		OnChange: func(_ context.Context, opts *metrics.ServerRunnableOpts) error {
+			reloaded <- opts
+			if failures > 0 {
+				failures--
+				return errors.New("apply failed")
+			}
+			return nil
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = w.Start(ctx)
+	}()
+
+	step := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !fakeClock.HasWaiters() {
+			if time.Now().After(deadline) {
+				t.Fatal("watcher is not waiting for the next check")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		fakeClock.Step(time.Minute)
+	}
+
+	// An unchanged file is not reloaded.
+	step()
+	// An invalid file is ignored.
+	if err := os.WriteFile(path, []byte("unknownField: true\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	step()
+	if err := os.WriteFile(path, []byte("labelAllowlist: [tier]\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	step()
+
+	for _, attempt := range []string{"failed", "retried"} {
+		select {
+		case opts := <-reloaded:
+			if !slices.Equal(opts.LabelAllowlist, []string{"tier"}) {
+				t.Errorf("%s reload LabelAllowlist = %v, want [tier]", attempt, opts.LabelAllowlist)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("config change not reloaded (%s attempt)", attempt)
+		}
+		if attempt == "failed" {
+			step()
+		}
+	}
+	select {
+	case opts := <-reloaded:
+		t.Errorf("unexpected second reload: %v", opts.LabelAllowlist)
+	default:
+	}
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	kmpconfig "github.com/Uburro/kubelet-meta-proxy/internal/config"
+	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+
+// DefaultConfigMapKey is the key of the ConfigMap data holding the options when ConfigMapReconciler.Key is empty.
+const DefaultConfigMapKey = "config.yaml"
+
+// ConfigMapReconciler reloads the options written like the config file in a ConfigMap when it changes
+// and passes them to OnChange, so the enrichment rules can be changed without a restart.
+// The environment variables and the flags set on FlagSet are applied on top, like at startup.
+// Options that fail to parse or validate are logged and ignored, the ones applied last stay in effect.
+type ConfigMapReconciler struct {
+	client.Client
+	// Namespace and Name of the ConfigMap.
+	Namespace string
+	Name      string
+	// Key of the ConfigMap data holding the options. Defaults to DefaultConfigMapKey.
+	Key      string
+	FlagSet  *flag.FlagSet
+	OnChange func(ctx context.Context, opts *nsmetrics.ServerRunnableOpts) error
+
+	mu sync.Mutex
+	// applied is the data last passed to OnChange successfully.
+	applied string
+}
+
+// Reconcile reloads the options when the ConfigMap data differs from the data applied last.
+func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx).WithName("ConfigMapReconciler")
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(ctx, req.NamespacedName, configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.Info("ConfigMap not found, keeping the options in effect", "configMap", req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	key := r.Key
+	if key == "" {
+		key = DefaultConfigMapKey
+	}
+	data, ok := configMap.Data[key]
+	if !ok {
+		logger.Info("ConfigMap has no options, keeping the options in effect", "configMap", req.NamespacedName, "key", key)
+		return ctrl.Result{}, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if data == r.applied {
+		return ctrl.Result{}, nil
+	}
+	opts, err := kmpconfig.Reload([]byte(data), r.FlagSet)
+	if err != nil {
+		// Retrying would not help until the ConfigMap changes again.
+		logger.Error(err, "ignoring invalid options", "configMap", req.NamespacedName, "key", key)
+		return ctrl.Result{}, nil
+	}
+	logger.Info("ConfigMap changed, reloading", "configMap", req.NamespacedName)
+	if err := r.OnChange(ctx, opts); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.applied = data
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager. Only the configured ConfigMap is reconciled.
+func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager, cacheSyncTimeout time.Duration) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("configmap").
+		For(&corev1.ConfigMap{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return obj.GetNamespace() == r.Namespace && obj.GetName() == r.Name
+		}))).
+		WithOptions(controllerOptions(1, cacheSyncTimeout)).
+		Complete(r)
+}
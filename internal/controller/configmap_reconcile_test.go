@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+func TestConfigMapReconcileReloadsChangedRules(t *testing.T) {
+	ctx := context.Background()
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "kubelet-meta-proxy"},
+		Data:       map[string]string{DefaultConfigMapKey: "labelAllowlist: [team]\n"},
+	}
+	var applied []*nsmetrics.ServerRunnableOpts
+	r := &ConfigMapReconciler{
+		Client:    newTestReconciler(t, configMap).Client,
+		Namespace: configMap.Namespace,
+		Name:      configMap.Name,
+		OnChange: func(_ context.Context, opts *nsmetrics.ServerRunnableOpts) error {
+			applied = append(applied, opts)
+			return nil
+		},
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name}}
+	update := func(data string) {
+		t.Helper()
+		configMap.Data[DefaultConfigMapKey] = data
+		if err := r.Update(ctx, configMap); err != nil {
+			t.Fatalf("update ConfigMap: %v", err)
+		}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+	}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	// Unchanged data is not applied again.
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	// Invalid options are ignored.
+	update("unknownField: true\n")
+	update("labelAllowlist: [team]\nlabelPrecedence: [cluster]\n")
+	update("labelAllowlist: [team, tier]\nrenameLabels:\n  container: container_name\n")
+
+	if len(applied) != 2 {
+		t.Fatalf("options applied %d times, want 2", len(applied))
+	}
+	if got := applied[0].LabelAllowlist; !slices.Equal(got, []string{"team"}) {
+		t.Errorf("first LabelAllowlist = %v, want [team]", got)
+	}
+	rules := applied[1].EnrichmentRules()
+	if !slices.Equal(rules.LabelAllowlist, []string{"team", "tier"}) {
+		t.Errorf("reloaded LabelAllowlist = %v, want [team tier]", rules.LabelAllowlist)
+	}
+	if rules.RenameLabels["container"] != "container_name" {
+		t.Errorf("reloaded RenameLabels = %v, want container renamed", rules.RenameLabels)
+	}
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/lru"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get
+
+// DefaultOwnerCacheSize is the number of resolved ReplicaSets and Jobs kept by the pod reconciler.
+const DefaultOwnerCacheSize = 4096
+
+// intermediateOwners are the kinds that are owned by the workload users care about:
+// a ReplicaSet by its Deployment and a Job by its CronJob.
+var intermediateOwners = map[schema.GroupKind]bool{
+	{Group: "apps", Kind: "ReplicaSet"}: true,
+	{Group: "batch", Kind: "Job"}:       true,
+}
+
+// ownerResolver finds the workload owning a pod, following ReplicaSets and Jobs to their own owner.
+// The owners of ReplicaSets and Jobs are read with reader and kept in a bounded LRU cache,
+// which avoids caching every ReplicaSet of the cluster.
+type ownerResolver struct {
+	reader client.Reader
+	cache  *lru.Cache
+}
+
+func newOwnerResolver(reader client.Reader, size int) *ownerResolver {
+	return &ownerResolver{reader: reader, cache: lru.New(size)}
+}
+
+// resolve returns the workload owning obj, or false when it has no controller owner.
+// A ReplicaSet or Job without an owner of its own, or already deleted, is the owner itself.
+func (r *ownerResolver) resolve(ctx context.Context, obj metav1.Object) (nsmetrics.PodOwner, bool, error) {
+	ref := metav1.GetControllerOfNoCopy(obj)
+	if ref == nil {
+		return nsmetrics.PodOwner{}, false, nil
+	}
+	owner := nsmetrics.PodOwner{Kind: ref.Kind, Name: ref.Name}
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil || !intermediateOwners[gv.WithKind(ref.Kind).GroupKind()] {
+		return owner, true, nil
+	}
+
+	key := obj.GetNamespace() + "/" + ref.Kind + "/" + ref.Name
+	if cached, ok := r.cache.Get(key); ok {
+		return cached.(nsmetrics.PodOwner), true, nil
+	}
+
+	intermediate := &metav1.PartialObjectMetadata{}
+	intermediate.SetGroupVersionKind(gv.WithKind(ref.Kind))
+	err = r.reader.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: ref.Name}, intermediate)
+	if apierrors.IsNotFound(err) {
+		return owner, true, nil
+	}
+	if err != nil {
+		return nsmetrics.PodOwner{}, false, fmt.Errorf("get %s %q: %w", ref.Kind, ref.Name, err)
+	}
+	if parent := metav1.GetControllerOfNoCopy(intermediate); parent != nil {
+		owner = nsmetrics.PodOwner{Kind: parent.Kind, Name: parent.Name}
+	}
+	r.cache.Add(key, owner)
+	return owner, true, nil
+}
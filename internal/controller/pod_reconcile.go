@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+// PodLabelReconciler reconciles the metadata of a Pod object.
+// Only the metadata of pods is watched and cached, which is all the labels need.
+type PodLabelReconciler struct {
+	client.Client
+	PodMetrics *nsmetrics.PodMetrics
+
+	// LabelAllowlist lists the pod labels stored. Pods without any of them nor an owner are not stored.
+	LabelAllowlist []string
+	// ExcludeNamespaces are never stored.
+	ExcludeNamespaces []string
+
+	// ResolveOwners stores the workload owning every pod, e.g. the Deployment of its ReplicaSet.
+	ResolveOwners bool
+	// OwnerReader reads the ReplicaSets and Jobs owning pods. Defaults to the Client.
+	OwnerReader client.Reader
+	// OwnerCacheSize bounds the resolved ReplicaSets and Jobs kept. Defaults to DefaultOwnerCacheSize.
+	OwnerCacheSize int
+
+	ownersOnce sync.Once
+	owners     *ownerResolver
+
+	// rulesMu guards ExcludeNamespaces, which Reload replaces.
+	rulesMu sync.RWMutex
+}
+
+// Reconcile stores the allowlisted labels and the owner of a Pod in PodMetrics and removes deleted pods.
+func (r *PodLabelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx).WithName("PodLabelReconciler")
+
+	pod := &metav1.PartialObjectMetadata{}
+	pod.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Pod"))
+	if err := r.Get(ctx, req.NamespacedName, pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.PodMetrics.Delete(req.Namespace, req.Name)
+			logger.V(1).Info("Pod removed from PodMetrics", "pod", req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	r.rulesMu.RLock()
+	defer r.rulesMu.RUnlock()
+	return ctrl.Result{}, r.store(ctx, pod)
+}
+
+// store stores the allowlisted labels and the owner of pod in PodMetrics, or removes the pod when nothing
+// is stored for it. The caller holds rulesMu.
+func (r *PodLabelReconciler) store(ctx context.Context, pod *metav1.PartialObjectMetadata) error {
+	if slices.Contains(r.ExcludeNamespaces, pod.Namespace) {
+		r.PodMetrics.Delete(pod.Namespace, pod.Name)
+		return nil
+	}
+
+	var owner nsmetrics.PodOwner
+	var hasOwner bool
+	if r.ResolveOwners {
+		var err error
+		if owner, hasOwner, err = r.ownerResolver().resolve(ctx, pod); err != nil {
+			return err
+		}
+	}
+
+	labels := r.selectLabels(pod.GetLabels())
+	// Nothing is stored for pods that would get no label, to bound the memory used.
+	if len(labels) == 0 && !hasOwner {
+		r.PodMetrics.Delete(pod.Namespace, pod.Name)
+		return nil
+	}
+	r.PodMetrics.Set(pod.Namespace, pod.Name, labels)
+	if hasOwner {
+		r.PodMetrics.SetOwner(pod.Namespace, pod.Name, owner)
+	} else {
+		// The pod may have lost its owner since it was stored.
+		r.PodMetrics.DeleteOwner(pod.Namespace, pod.Name)
+	}
+	log.FromContext(ctx).WithName("PodLabelReconciler").V(1).Info("Pod stored in PodMetrics",
+		"pod", client.ObjectKeyFromObject(pod), "labels", labels, "owner", owner)
+	return nil
+}
+
+// ownerResolver returns the resolver of pod owners, created on first use.
+func (r *PodLabelReconciler) ownerResolver() *ownerResolver {
+	r.ownersOnce.Do(func() {
+		reader, size := r.OwnerReader, r.OwnerCacheSize
+		if reader == nil {
+			reader = r.Client
+		}
+		if size <= 0 {
+			size = DefaultOwnerCacheSize
+		}
+		r.owners = newOwnerResolver(reader, size)
+	})
+	return r.owners
+}
+
+// selectLabels returns the pod labels listed in the LabelAllowlist.
+func (r *PodLabelReconciler) selectLabels(labels map[string]string) map[string]string {
+	selected := make(map[string]string)
+	for _, key := range r.LabelAllowlist {
+		if value, ok := labels[key]; ok {
+			selected[key] = value
+		}
+	}
+	return selected
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Pod updates are only reconciled when their labels or owner references changed. The pods of every node are watched unless
+// the manager cache restricts Pods, e.g. with a spec.nodeName field selector when a single node is scraped.
+func (r *PodLabelReconciler) SetupWithManager(mgr ctrl.Manager, maxConcurrency int, cacheSyncTimeout time.Duration) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Pod{}, builder.OnlyMetadata, builder.WithPredicates(predicate.Or[client.Object](
+			predicate.LabelChangedPredicate{}, ownerReferencesChangedPredicate(),
+		))).
+		WithOptions(controllerOptions(maxConcurrency, cacheSyncTimeout)).
+		Complete(r)
+}
+
+// ownerReferencesChangedPredicate lets through the updates changing the owner references of an object.
+func ownerReferencesChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.ObjectOld == nil || e.ObjectNew == nil {
+				return false
+			}
+			return !equality.Semantic.DeepEqual(e.ObjectOld.GetOwnerReferences(), e.ObjectNew.GetOwnerReferences())
+		},
+	}
+}
@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+func TestPodReconcileStoresAllowlistedLabels(t *testing.T) {
+	ctx := context.Background()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: "frontend",
+			Labels:    map[string]string{"app": "web", "pod-template-hash": "5d8f"},
+		},
+	}
+	unlabeled := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "job-1", Namespace: "frontend"}}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("add scheme: %v", err)
+	}
+	r := &PodLabelReconciler{
+		Client:         fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(pod, unlabeled).Build(),
+		PodMetrics:     nsmetrics.NewPodMetrics(),
+		LabelAllowlist: []string{"app", "team"},
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	labels, ok := r.PodMetrics.Get(pod.Namespace, pod.Name)
+	if !ok || len(labels) != 1 || labels["app"] != "web" {
+		t.Fatalf("stored labels = %v (ok=%v), want only app=web", labels, ok)
+	}
+
+	unlabeledReq := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: unlabeled.Namespace, Name: unlabeled.Name}}
+	if _, err := r.Reconcile(ctx, unlabeledReq); err != nil {
+		t.Fatalf("reconcile unlabeled pod: %v", err)
+	}
+	if _, ok := r.PodMetrics.Get(unlabeled.Namespace, unlabeled.Name); ok {
+		t.Errorf("pod without allowlisted labels was stored")
+	}
+
+	if err := r.Delete(ctx, pod); err != nil {
+		t.Fatalf("delete pod: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile after delete: %v", err)
+	}
+	if n := r.PodMetrics.Len(); n != 0 {
+		t.Errorf("PodMetrics.Len() = %d after delete, want 0", n)
+	}
+}
+
+func TestPodReconcileResolvesDeploymentOwner(t *testing.T) {
+	ctx := context.Background()
+	controllerRef := func(apiVersion, kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{
+			APIVersion: apiVersion, Kind: kind, Name: name, UID: types.UID(name), Controller: ptr.To(true),
+		}}
+	}
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Name: "web-5d8f", Namespace: "frontend", OwnerReferences: controllerRef("apps/v1", "Deployment", "web"),
+	}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "web-5d8f-x2k", Namespace: "frontend", OwnerReferences: controllerRef("apps/v1", "ReplicaSet", rs.Name),
+	}}
+	daemon := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "agent-7gq", Namespace: "frontend", OwnerReferences: controllerRef("apps/v1", "DaemonSet", "agent"),
+	}}
+	bare := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "debug", Namespace: "frontend"}}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("add scheme: %v", err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(rs, pod, daemon, bare).Build()
+	r := &PodLabelReconciler{
+		Client:        c,
+		PodMetrics:    nsmetrics.NewPodMetrics(),
+		ResolveOwners: true,
+	}
+	reconcilePod := func(p *corev1.Pod) {
+		t.Helper()
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: p.Namespace, Name: p.Name}}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("reconcile %s: %v", p.Name, err)
+		}
+	}
+
+	reconcilePod(pod)
+	want := nsmetrics.PodOwner{Kind: "Deployment", Name: "web"}
+	if owner, ok := r.PodMetrics.GetOwner(pod.Namespace, pod.Name); !ok || owner != want {
+		t.Errorf("owner = %+v (ok=%v), want %+v", owner, ok, want)
+	}
+
+	// The owner of the ReplicaSet is cached, the ReplicaSet is not read again.
+	if err := c.Delete(ctx, rs); err != nil {
+		t.Fatalf("delete replicaset: %v", err)
+	}
+	reconcilePod(pod)
+	if owner, _ := r.PodMetrics.GetOwner(pod.Namespace, pod.Name); owner != want {
+		t.Errorf("owner after the ReplicaSet was deleted = %+v, want the cached %+v", owner, want)
+	}
+
+	reconcilePod(daemon)
+	if owner, ok := r.PodMetrics.GetOwner(daemon.Namespace, daemon.Name); !ok || owner.Kind != "DaemonSet" || owner.Name != "agent" {
+		t.Errorf("daemon pod owner = %+v (ok=%v), want DaemonSet agent", owner, ok)
+	}
+
+	reconcilePod(bare)
+	if owner, ok := r.PodMetrics.GetOwner(bare.Namespace, bare.Name); ok {
+		t.Errorf("pod without owner got owner %+v", owner)
+	}
+}
+
+func TestPodReconcileRemovesLostOwner(t *testing.T) {
+	ctx := context.Background()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "agent-7gq", Namespace: "frontend", Labels: map[string]string{"app": "agent"},
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion: "apps/v1", Kind: "DaemonSet", Name: "agent", UID: "agent", Controller: ptr.To(true),
+		}},
+	}}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("add scheme: %v", err)
+	}
+	r := &PodLabelReconciler{
+		Client:         fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(pod).Build(),
+		PodMetrics:     nsmetrics.NewPodMetrics(),
+		LabelAllowlist: []string{"app"},
+		ResolveOwners:  true,
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if _, ok := r.PodMetrics.GetOwner(pod.Namespace, pod.Name); !ok {
+		t.Fatal("owner not stored")
+	}
+
+	// The pod is orphaned but keeps its allowlisted labels.
+	pod.OwnerReferences = nil
+	if err := r.Update(ctx, pod); err != nil {
+		t.Fatalf("update pod: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if owner, ok := r.PodMetrics.GetOwner(pod.Namespace, pod.Name); ok {
+		t.Errorf("owner of the orphaned pod = %+v, want none", owner)
+	}
+	if labels, ok := r.PodMetrics.Get(pod.Namespace, pod.Name); !ok || labels["app"] != "agent" {
+		t.Errorf("labels of the orphaned pod = %v (ok=%v), want app=agent", labels, ok)
+	}
+}
+
+func TestPodReloadExcludeNamespaces(t *testing.T) {
+	ctx := context.Background()
+	frontend := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "web-1", Namespace: "frontend", Labels: map[string]string{"app": "web"},
+	}}
+	system := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "dns-1", Namespace: "kube-system", Labels: map[string]string{"app": "dns"},
+	}}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("add scheme: %v", err)
+	}
+	r := &PodLabelReconciler{
+		Client:            fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(frontend, system).Build(),
+		PodMetrics:        nsmetrics.NewPodMetrics(),
+		LabelAllowlist:    []string{"app"},
+		ExcludeNamespaces: []string{"kube-system"},
+	}
+	for _, p := range []*corev1.Pod{frontend, system} {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: p.Namespace, Name: p.Name}}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("reconcile %s: %v", p.Name, err)
+		}
+	}
+
+	if err := r.Reload(ctx, []string{"frontend"}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, ok := r.PodMetrics.Get(frontend.Namespace, frontend.Name); ok {
+		t.Error("pod of a newly excluded namespace kept after the reload")
+	}
+	if labels, ok := r.PodMetrics.Get(system.Namespace, system.Name); !ok || labels["app"] != "dns" {
+		t.Errorf("pod of a no longer excluded namespace = %v (ok=%v), want app=dns", labels, ok)
+	}
+}
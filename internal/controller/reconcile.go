@@ -2,16 +2,24 @@ package controller
 
 import (
 	"context"
+	"slices"
 	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
@@ -19,62 +27,155 @@ import (
 
 // +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=node/proxy,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get
 
 // NamespaceLabelReconciler reconciles a Namespace object.
 type NamespaceLabelReconciler struct {
 	client.Client
 	Scheme           *runtime.Scheme
 	NamespaceMetrics *nsmetrics.NamespaceMetrics
+
+	// AnnotationAllowlist lists namespace annotations stored alongside the labels.
+	AnnotationAllowlist []string
+	// StoreCreationTime stores the creationTimestamp of every namespace alongside the labels.
+	StoreCreationTime bool
+
+	// NamespaceSelector restricts the stored namespaces to those it matches. Nil matches every namespace.
+	NamespaceSelector labels.Selector
+	// ExcludeNamespaces are never stored.
+	ExcludeNamespaces []string
+
+	// SyncPeriod re-reconciles every namespace periodically, in case an event was missed. Zero disables it.
+	SyncPeriod time.Duration
+	// Clock drives the periodic resync. Defaults to the real clock.
+	Clock clock.WithTicker
+
+	// Readiness is marked as cache synced once the namespace informer has synced.
+	Readiness *nsmetrics.Readiness
+
+	// rulesMu guards AnnotationAllowlist, NamespaceSelector and ExcludeNamespaces, which Reload replaces.
+	// Reconciles hold it for reading so none of them stores labels selected with the previous rules.
+	rulesMu sync.RWMutex
 }
 
 // Reconcile reads that state of the cluster for a Namespace object and add labels to NamespaceMetrics map.
 func (r *NamespaceLabelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx).WithName("NamespaceLabelReconciler")
 	logger.Info("Reconciling Namespace", "namespace", req.NamespacedName)
+	r.rulesMu.RLock()
+	defer r.rulesMu.RUnlock()
 
 	ns := &corev1.Namespace{}
 	if err := r.Get(ctx, req.NamespacedName, ns); err != nil {
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		if apierrors.IsNotFound(err) {
+			r.NamespaceMetrics.Delete(req.Name)
+			logger.Info("Namespace removed from NamespaceMetrics", "namespace", req.Name)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
 	}
 
-	labels := ns.GetLabels()
-	if len(labels) == 0 {
+	if !r.selected(ns) {
+		// The namespace may have been stored before its labels stopped matching.
+		r.NamespaceMetrics.Delete(ns.Name)
+		logger.Info("Namespace not selected, removed from NamespaceMetrics", "namespace", ns.Name)
 		return ctrl.Result{}, nil
 	}
 
-	for label := range labels {
-		if label == corev1.LabelMetadataName {
-			delete(labels, label)
+	if len(r.AnnotationAllowlist) > 0 {
+		annotations := r.selectAnnotations(ns.GetAnnotations())
+		r.NamespaceMetrics.SetAnnotations(ns.Name, annotations)
+		logger.Info("Namespace annotations added to NamespaceMetrics", "namespace", ns.Name, "annotations", annotations)
+	}
+
+	if r.StoreCreationTime && !ns.CreationTimestamp.IsZero() {
+		// The creation time never changes, it is only stored once.
+		if _, ok := r.NamespaceMetrics.GetCreated(ns.Name); !ok {
+			r.NamespaceMetrics.SetCreated(ns.Name, ns.CreationTimestamp.Time)
 		}
 	}
 
-	r.NamespaceMetrics.Namespaces[ns.Name] = labels
-	logger.Info("Namespace labels added to NamespaceMetrics", "namespace", ns.Name, "labels", labels)
+	// Only the changed keys are applied, so reconciles of unchanged namespaces do not allocate a new label set.
+	// An empty set is stored as well for a namespace seen for the first time.
+	diff := r.NamespaceMetrics.DiffLabels(ns.Name, ns.GetLabels(), corev1.LabelMetadataName)
+	if diff.Empty() {
+		logger.V(1).Info("Namespace labels unchanged", "namespace", ns.Name)
+		return ctrl.Result{}, nil
+	}
+	r.NamespaceMetrics.ApplyLabelDiff(ns.Name, diff)
+	logger.Info("Namespace labels updated in NamespaceMetrics", "namespace", ns.Name,
+		"changed", diff.Changed, "removed", diff.Removed)
 	return ctrl.Result{}, nil
 }
 
+// selected reports whether the namespace is not excluded and matches the NamespaceSelector.
+func (r *NamespaceLabelReconciler) selected(obj client.Object) bool {
+	if slices.Contains(r.ExcludeNamespaces, obj.GetName()) {
+		return false
+	}
+	return r.NamespaceSelector == nil || r.NamespaceSelector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// namespacePredicate filters out events of namespaces that are not selected.
+// Updates are let through when either version matches, so a namespace whose labels stop
+// matching is removed, and deletes always are.
+func (r *NamespaceLabelReconciler) namespacePredicate() predicate.Predicate {
+	selected := func(objs ...client.Object) bool {
+		r.rulesMu.RLock()
+		defer r.rulesMu.RUnlock()
+		return slices.ContainsFunc(objs, r.selected)
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool { return selected(e.Object) },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return selected(e.ObjectOld, e.ObjectNew)
+		},
+		DeleteFunc:  func(event.DeleteEvent) bool { return true },
+		GenericFunc: func(e event.GenericEvent) bool { return selected(e.Object) },
+	}
+}
+
+// selectAnnotations returns the namespace annotations listed in the AnnotationAllowlist.
+func (r *NamespaceLabelReconciler) selectAnnotations(annotations map[string]string) map[string]string {
+	selected := make(map[string]string)
+	for _, key := range r.AnnotationAllowlist {
+		if value, ok := annotations[key]; ok {
+			selected[key] = value
+		}
+	}
+	return selected
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *NamespaceLabelReconciler) SetupWithManager(mgr ctrl.Manager, maxConcurrency int, cacheSyncTimeout time.Duration) error {
+	if r.Readiness != nil {
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			if mgr.GetCache().WaitForCacheSync(ctx) {
+				r.Readiness.SetCacheSynced()
+			}
+			return nil
+		})); err != nil {
+			return err
+		}
+	}
+
+	if r.SyncPeriod > 0 {
+		if err := mgr.Add(manager.RunnableFunc(r.resyncLoop)); err != nil {
+			return err
+		}
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Namespace{}).
+		For(&corev1.Namespace{}, builder.WithPredicates(r.namespacePredicate())).
 		WithOptions(controllerOptions(maxConcurrency, cacheSyncTimeout)).
 		Complete(r)
 }
 
-var (
-	optionsInit    sync.Once
-	defaultOptions *controller.Options
-)
-
 // ControllerOptions is rate limiters and cache sync timeout for the controller.
 func controllerOptions(maxConcurrency int, cacheSyncTimeout time.Duration) controller.Options {
-	rateLimiters := workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](30*time.Second, 5*time.Minute)
-	optionsInit.Do(func() {
-		defaultOptions = &controller.Options{
-			RateLimiter:             rateLimiters,
-			CacheSyncTimeout:        cacheSyncTimeout,
-			MaxConcurrentReconciles: maxConcurrency,
-		}
-	})
-	return *defaultOptions
+	return controller.Options{
+		RateLimiter:             workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](30*time.Second, 5*time.Minute),
+		CacheSyncTimeout:        cacheSyncTimeout,
+		MaxConcurrentReconciles: maxConcurrency,
+	}
 }
@@ -0,0 +1,396 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+func newTestReconciler(t *testing.T, objs ...runtime.Object) *NamespaceLabelReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("add scheme: %v", err)
+	}
+	return &NamespaceLabelReconciler{
+		Client:           fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build(),
+		Scheme:           scheme,
+		NamespaceMetrics: nsmetrics.NewNamespaceMetrics(),
+	}
+}
+
+func TestReconcileRemovesDeletedNamespace(t *testing.T) {
+	ctx := context.Background()
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "frontend",
+			Labels: map[string]string{"team": "frontend"},
+		},
+	}
+	r := newTestReconciler(t, ns)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	labels, ok := r.NamespaceMetrics.Get(ns.Name)
+	if !ok || labels["team"] != "frontend" {
+		t.Fatalf("expected team=frontend for %q, got %v (ok=%v)", ns.Name, labels, ok)
+	}
+
+	if err := r.Delete(ctx, ns); err != nil {
+		t.Fatalf("delete namespace: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile after delete: %v", err)
+	}
+	if _, ok := r.NamespaceMetrics.Get(ns.Name); ok {
+		t.Fatalf("expected %q to be removed from NamespaceMetrics", ns.Name)
+	}
+}
+
+func TestControllerOptionsHonorsArguments(t *testing.T) {
+	first := controllerOptions(1, time.Second)
+	second := controllerOptions(7, time.Minute)
+
+	if first.MaxConcurrentReconciles != 1 {
+		t.Errorf("first MaxConcurrentReconciles = %d, want 1", first.MaxConcurrentReconciles)
+	}
+	if second.MaxConcurrentReconciles != 7 {
+		t.Errorf("second MaxConcurrentReconciles = %d, want 7", second.MaxConcurrentReconciles)
+	}
+	if second.CacheSyncTimeout != time.Minute {
+		t.Errorf("second CacheSyncTimeout = %s, want %s", second.CacheSyncTimeout, time.Minute)
+	}
+}
+
+func TestReconcileStoresAllowlistedAnnotations(t *testing.T) {
+	ctx := context.Background()
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "billing",
+			Annotations: map[string]string{
+				"example.com/cost-center": "cc-42",
+				"example.com/notes":       "free text",
+			},
+		},
+	}
+	r := newTestReconciler(t, ns)
+	r.AnnotationAllowlist = []string{"example.com/cost-center"}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	annotations, ok := r.NamespaceMetrics.GetAnnotations(ns.Name)
+	if !ok {
+		t.Fatalf("expected annotations for %q", ns.Name)
+	}
+	if annotations["example.com/cost-center"] != "cc-42" {
+		t.Errorf("expected cost-center annotation, got %v", annotations)
+	}
+	if _, ok := annotations["example.com/notes"]; ok {
+		t.Errorf("expected non-allowlisted annotation to be dropped, got %v", annotations)
+	}
+}
+
+func TestReconcileStoresCreationTime(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "billing",
+			Labels:            map[string]string{"team": "billing"},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+	}
+	r := newTestReconciler(t, ns)
+	r.StoreCreationTime = true
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	got, ok := r.NamespaceMetrics.GetCreated(ns.Name)
+	if !ok || !got.Equal(created) {
+		t.Fatalf("stored creation time = %v (ok=%v), want %v", got, ok, created)
+	}
+
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader(`container_memory_working_set_bytes{namespace="billing"} 1` + "\n"))
+	if err != nil {
+		t.Fatalf("parse metrics: %v", err)
+	}
+	out, err := nsmetrics.EnrichMetricFamilies(ctx, mfs, r.NamespaceMetrics,
+		&nsmetrics.ServerRunnableOpts{NamespaceCreationTime: true})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if want := `container_memory_working_set_bytes{namespace="billing",team="billing",namespace_created="1709294400"} 1`; !strings.Contains(out, want) {
+		t.Errorf("output lacks %s:\n%s", want, out)
+	}
+}
+
+func TestDebugNamespacesShowsReconciledLabels(t *testing.T) {
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "frontend",
+			Labels:      map[string]string{"team": "frontend"},
+			Annotations: map[string]string{"example.com/owner": "alice"},
+		},
+	}
+	r := newTestReconciler(t, ns)
+	r.AnnotationAllowlist = []string{"example.com/owner"}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	nsmetrics.NamespacesHandler(r.NamespaceMetrics).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/namespaces", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+
+	var got map[string]nsmetrics.NamespaceState
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body.String(), err)
+	}
+	state, ok := got["frontend"]
+	if !ok || state.Labels["team"] != "frontend" || state.Annotations["example.com/owner"] != "alice" {
+		t.Errorf("unexpected namespace state: %s", rec.Body.String())
+	}
+}
+
+func TestReconcileOnlyStoresSelectedNamespaces(t *testing.T) {
+	ctx := context.Background()
+	selected := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "frontend", Labels: map[string]string{"team": "frontend", "monitored": "true"}},
+	}
+	other := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "scratch", Labels: map[string]string{"team": "scratch"}},
+	}
+	r := newTestReconciler(t, selected, other)
+	selector, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{MatchLabels: map[string]string{"monitored": "true"}})
+	if err != nil {
+		t.Fatalf("selector: %v", err)
+	}
+	r.NamespaceSelector = selector
+	// Stored before the selector was configured.
+	r.NamespaceMetrics.Set(other.Name, other.Labels)
+
+	for _, ns := range []*corev1.Namespace{selected, other} {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}); err != nil {
+			t.Fatalf("reconcile %s: %v", ns.Name, err)
+		}
+	}
+
+	if labels, ok := r.NamespaceMetrics.Get(selected.Name); !ok || labels["team"] != "frontend" {
+		t.Errorf("expected %q to be stored, got %v (ok=%v)", selected.Name, labels, ok)
+	}
+	if labels, ok := r.NamespaceMetrics.Get(other.Name); ok {
+		t.Errorf("expected %q to be removed, got %v", other.Name, labels)
+	}
+
+	p := r.namespacePredicate()
+	if p.Create(event.CreateEvent{Object: other}) {
+		t.Error("create of a non-matching namespace must be filtered out")
+	}
+	if !p.Create(event.CreateEvent{Object: selected}) {
+		t.Error("create of a matching namespace must be reconciled")
+	}
+	if !p.Update(event.UpdateEvent{ObjectOld: selected, ObjectNew: other}) {
+		t.Error("update of a namespace that stopped matching must be reconciled")
+	}
+}
+
+func TestReconcileSkipsExcludedNamespaces(t *testing.T) {
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-system", Labels: map[string]string{"team": "platform"}},
+	}
+	r := newTestReconciler(t, ns)
+	r.ExcludeNamespaces = []string{"kube-system", "kube-public"}
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if labels, ok := r.NamespaceMetrics.Get(ns.Name); ok {
+		t.Errorf("expected excluded %q not to be stored, got %v", ns.Name, labels)
+	}
+	if r.namespacePredicate().Create(event.CreateEvent{Object: ns}) {
+		t.Error("create of an excluded namespace must be filtered out")
+	}
+}
+
+func TestResyncReconcilesPeriodically(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "frontend", Labels: map[string]string{"team": "frontend"}},
+	}
+	r := newTestReconciler(t, ns)
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	r.Clock = fakeClock
+	r.SyncPeriod = time.Minute
+	// Drifted state: a stale label and a namespace deleted while no event was delivered.
+	r.NamespaceMetrics.Set("frontend", map[string]string{"team": "stale"})
+	r.NamespaceMetrics.Set("gone", map[string]string{"team": "gone"})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = r.resyncLoop(ctx)
+	}()
+	waitFor(t, fakeClock.HasWaiters)
+
+	fakeClock.Step(30 * time.Second)
+	if labels, _ := r.NamespaceMetrics.Get("frontend"); labels["team"] != "stale" {
+		t.Fatalf("resync fired before the sync period: %v", labels)
+	}
+
+	fakeClock.Step(30 * time.Second)
+	waitFor(t, func() bool {
+		labels, _ := r.NamespaceMetrics.Get("frontend")
+		return labels["team"] == "frontend"
+	})
+	if _, ok := r.NamespaceMetrics.Get("gone"); ok {
+		t.Error("expected the deleted namespace to be removed by the resync")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestReloadRebuildsNamespaceMetrics(t *testing.T) {
+	ctx := context.Background()
+	frontend := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "frontend",
+		Labels:      map[string]string{"team": "frontend"},
+		Annotations: map[string]string{"example.com/owner": "alice", "example.com/cost-center": "cc-1"},
+	}}
+	system := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name: "kube-system", Labels: map[string]string{"team": "platform"},
+	}}
+	r := newTestReconciler(t, frontend, system)
+	r.AnnotationAllowlist = []string{"example.com/owner"}
+	for _, ns := range []string{frontend.Name, system.Name} {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: ns}}); err != nil {
+			t.Fatalf("reconcile %s: %v", ns, err)
+		}
+	}
+
+	if err := r.Reload(ctx, NamespaceRules{
+		AnnotationAllowlist: []string{"example.com/cost-center"},
+		ExcludeNamespaces:   []string{"kube-system"},
+	}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	want := map[string]nsmetrics.NamespaceState{
+		"frontend": {
+			Labels:      map[string]string{"team": "frontend"},
+			Annotations: map[string]string{"example.com/cost-center": "cc-1"},
+		},
+	}
+	if got := r.NamespaceMetrics.Namespaces(); !reflect.DeepEqual(got, want) {
+		t.Errorf("NamespaceMetrics after reload = %v, want %v", got, want)
+	}
+	// Later reconciles use the new rules too.
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: system.Name}}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if _, ok := r.NamespaceMetrics.Get(system.Name); ok {
+		t.Error("excluded namespace stored after the reload")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReconcileClearsLabelsRemovedFromNamespace(t *testing.T) {
+	ctx := context.Background()
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "frontend", Labels: map[string]string{"team": "frontend"}},
+	}
+	r := newTestReconciler(t, ns)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if labels, _ := r.NamespaceMetrics.Get(ns.Name); labels["team"] != "frontend" {
+		t.Fatalf("expected team=frontend, got %v", labels)
+	}
+
+	// Only the automatic name label is left.
+	ns.Labels = map[string]string{corev1.LabelMetadataName: ns.Name}
+	if err := r.Update(ctx, ns); err != nil {
+		t.Fatalf("update namespace: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile after update: %v", err)
+	}
+	labels, ok := r.NamespaceMetrics.Get(ns.Name)
+	if !ok || len(labels) != 0 {
+		t.Errorf("expected an empty label set for %q, got %v (ok=%v)", ns.Name, labels, ok)
+	}
+}
+
+func TestReconcileKeepsUnchangedLabels(t *testing.T) {
+	ctx := context.Background()
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "frontend", Labels: map[string]string{"team": "frontend", "tier": "web"}},
+	}
+	r := newTestReconciler(t, ns)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	first, _ := r.NamespaceMetrics.Get(ns.Name)
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("second reconcile: %v", err)
+	}
+	if second, _ := r.NamespaceMetrics.Get(ns.Name); reflect.ValueOf(second).Pointer() != reflect.ValueOf(first).Pointer() {
+		t.Error("reconciling an unchanged namespace replaced its label set")
+	}
+
+	ns.Labels = map[string]string{"team": "platform", "tier": "web"}
+	if err := r.Update(ctx, ns); err != nil {
+		t.Fatalf("update namespace: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile after update: %v", err)
+	}
+	if labels, _ := r.NamespaceMetrics.Get(ns.Name); labels["team"] != "platform" || labels["tier"] != "web" {
+		t.Errorf("labels after update = %v", labels)
+	}
+	if first["team"] != "frontend" {
+		t.Errorf("previously returned label set was modified: %v", first)
+	}
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	nsmetrics "github.com/Uburro/kubelet-meta-proxy/internal/metrics"
+)
+
+// NamespaceRules are the options of NamespaceLabelReconciler selecting what is stored.
+type NamespaceRules struct {
+	AnnotationAllowlist []string
+	NamespaceSelector   labels.Selector
+	ExcludeNamespaces   []string
+}
+
+// Reload replaces the rules of the reconciler and rebuilds NamespaceMetrics from every existing namespace,
+// so a changed configuration applies without waiting for the namespaces to change.
+// NamespaceMetrics is replaced at once, scrapes never see it empty.
+func (r *NamespaceLabelReconciler) Reload(ctx context.Context, rules NamespaceRules) error {
+	r.rulesMu.Lock()
+	defer r.rulesMu.Unlock()
+	r.AnnotationAllowlist = rules.AnnotationAllowlist
+	r.NamespaceSelector = rules.NamespaceSelector
+	r.ExcludeNamespaces = rules.ExcludeNamespaces
+
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces); err != nil {
+		return err
+	}
+	state := make(map[string]nsmetrics.NamespaceState, len(namespaces.Items))
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		if !r.selected(ns) {
+			continue
+		}
+		s := nsmetrics.NamespaceState{Labels: maps.Clone(ns.GetLabels())}
+		if s.Labels == nil {
+			s.Labels = map[string]string{}
+		}
+		delete(s.Labels, corev1.LabelMetadataName)
+		if len(r.AnnotationAllowlist) > 0 {
+			s.Annotations = r.selectAnnotations(ns.GetAnnotations())
+		}
+		if r.StoreCreationTime && !ns.CreationTimestamp.IsZero() {
+			s.Created = ns.CreationTimestamp.Unix()
+		}
+		state[ns.Name] = s
+	}
+	r.NamespaceMetrics.Replace(state)
+	log.FromContext(ctx).WithName("NamespaceLabelReconciler").Info("NamespaceMetrics rebuilt", "namespaces", len(state))
+	return nil
+}
+
+// Reload replaces the excluded namespaces of the reconciler and stores every existing pod again,
+// so pods of newly excluded namespaces are removed and those of no longer excluded ones are stored.
+func (r *PodLabelReconciler) Reload(ctx context.Context, excludeNamespaces []string) error {
+	r.rulesMu.Lock()
+	defer r.rulesMu.Unlock()
+	r.ExcludeNamespaces = excludeNamespaces
+
+	pods := &metav1.PartialObjectMetadataList{}
+	pods.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("PodList"))
+	if err := r.List(ctx, pods); err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		if err := r.store(ctx, &pods.Items[i]); err != nil {
+			return err
+		}
+	}
+	log.FromContext(ctx).WithName("PodLabelReconciler").Info("PodMetrics rebuilt", "pods", r.PodMetrics.Len())
+	return nil
+}
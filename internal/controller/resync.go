@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// resyncLoop re-reconciles every namespace each SyncPeriod until ctx is done,
+// bringing NamespaceMetrics back in sync if a namespace event was missed.
+func (r *NamespaceLabelReconciler) resyncLoop(ctx context.Context) error {
+	clk := r.Clock
+	if clk == nil {
+		clk = clock.RealClock{}
+	}
+	ticker := clk.NewTicker(r.SyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			if err := r.resync(ctx); err != nil {
+				log.FromContext(ctx).WithName("NamespaceLabelReconciler").Error(err, "periodic resync failed")
+			}
+		}
+	}
+}
+
+// resync reconciles every existing namespace and removes the stored ones that no longer exist.
+func (r *NamespaceLabelReconciler) resync(ctx context.Context) error {
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces); err != nil {
+		return err
+	}
+
+	existing := make(map[string]struct{}, len(namespaces.Items))
+	for _, ns := range namespaces.Items {
+		existing[ns.Name] = struct{}{}
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(&ns)}); err != nil {
+			return err
+		}
+	}
+	for name := range r.NamespaceMetrics.Namespaces() {
+		if _, ok := existing[name]; !ok {
+			r.NamespaceMetrics.Delete(name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// NodeTarget is a kubelet scraped by an aggregating proxy.
+type NodeTarget struct {
+	// Name is the node name. It is the value of the node label and, with the kube-apiserver,
+	// the node the request is proxied to.
+	Name string `yaml:"name"`
+	// Address is the host of the kubelet when it is scraped directly. Defaults to Name.
+	Address string `yaml:"address"`
+	// Port of the kubelet or the kube-apiserver. Defaults to NodePort.
+	Port string `yaml:"port"`
+}
+
+// defaultAggregatedNodeLabel labels metrics with their node when NodeLabelName is not set.
+const defaultAggregatedNodeLabel = "node"
+
+// fetchNodesMetricFamilies fetches metrics from every node of opts.Nodes concurrently
+// and merges them, labeling every metric with its node.
+// Nodes that fail are logged and skipped, an error is returned only when all of them fail.
+func fetchNodesMetricFamilies(ctx context.Context, opts *ServerRunnableOpts) (map[string]*dto.MetricFamily, error) {
+	logger := log.FromContext(ctx).WithName("metrics.fetchNodesMetricFamilies")
+
+	labelName := opts.NodeLabelName
+	if labelName == "" {
+		labelName = defaultAggregatedNodeLabel
+	}
+
+	results := make([]map[string]*dto.MetricFamily, len(opts.Nodes))
+	errs := make([]error, len(opts.Nodes))
+	var wg sync.WaitGroup
+	for i, node := range opts.Nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = fetchNodeMetricFamilies(ctx, nodeOpts(opts, node))
+		}()
+	}
+	wg.Wait()
+	if allFailed(errs) {
+		return nil, fmt.Errorf("all %d nodes failed: %w", len(errs), errors.Join(errs...))
+	}
+
+	merged := make(map[string]*dto.MetricFamily)
+	for i, node := range opts.Nodes {
+		if errs[i] != nil {
+			logger.Error(errs[i], "skipping node that failed to respond", "node", node.Name)
+			opts.selfMetrics.observeNodeError(node.Name, opts.NodePath)
+			continue
+		}
+		for name, mf := range results[i] {
+			for _, metric := range mf.Metric {
+				if !hasLabel(metric.Label, labelName) {
+					metric.Label = append(metric.Label, &dto.LabelPair{
+						Name:  proto.String(labelName),
+						Value: proto.String(node.Name),
+					})
+				}
+			}
+
+			if !mergeMetricFamily(merged, mf) {
+				logger.Info("skipping metric family with a conflicting type",
+					"node", node.Name, "family", name, "type", mf.GetType(), "expected", merged[name].GetType())
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+// mergeMetricFamily adds mf to merged, appending its metrics to the family of the same name when there is one,
+// so every family is encoded with a single HELP and TYPE. The HELP of the family merged first is kept unless
+// it is empty. A family whose type conflicts with the one merged first is left out and false is returned.
+func mergeMetricFamily(merged map[string]*dto.MetricFamily, mf *dto.MetricFamily) bool {
+	existing, ok := merged[mf.GetName()]
+	if !ok {
+		merged[mf.GetName()] = mf
+		return true
+	}
+	if existing.GetType() != mf.GetType() {
+		return false
+	}
+	if existing.GetHelp() == "" && mf.Help != nil {
+		existing.Help = mf.Help
+	}
+	existing.Metric = append(existing.Metric, mf.Metric...)
+	return true
+}
+
+// nodeOpts returns a copy of opts targeting node.
+func nodeOpts(opts *ServerRunnableOpts, node NodeTarget) *ServerRunnableOpts {
+	o := *opts
+	o.Nodes = nil
+	o.nodeAddress = nil
+	o.NodeNameOrIP = node.Name
+	if o.KubeApiserver == "" && node.Address != "" {
+		o.NodeNameOrIP = node.Address
+	}
+	if node.Port != "" {
+		o.NodePort = node.Port
+	}
+	if opts.kubeletPath != "" {
+		o.NodePath = nodePathPrefix(o.KubeApiserver, node.Name) + opts.kubeletPath
+	}
+	return &o
+}
+
+func allFailed(errs []error) bool {
+	for _, err := range errs {
+		if err == nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// bearerAuth requires the request to carry "Authorization: Bearer <token>" matching
+// the contents of tokenFile. The file is read on every request so rotated tokens
+// are picked up without a restart. An empty tokenFile disables authentication.
+func bearerAuth(tokenFile string, next http.Handler) http.Handler {
+	if tokenFile == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected, err := os.ReadFile(tokenFile)
+		if err != nil {
+			log.FromContext(r.Context()).WithName("metrics.bearerAuth").Error(err, "failed to read auth token file")
+			http.Error(w, "failed to read auth token", http.StatusInternalServerError)
+			return
+		}
+		expected = bytes.TrimSpace(expected)
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || len(expected) == 0 ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kubelet-meta-proxy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+// DefaultCircuitBreakerCooldown is how long a tripped circuit stays open when
+// ServerRunnableOpts.CircuitBreakerCooldown is not set.
+const DefaultCircuitBreakerCooldown = 30 * time.Second
+
+// errCircuitOpen is returned without contacting the kubelet while its circuit is open.
+var errCircuitOpen = errors.New("kubelet circuit breaker is open")
+
+// breakerState is the state of the circuit of one kubelet URL. Its value is exported as a metric.
+type breakerState int
+
+const (
+	// breakerClosed lets every fetch through.
+	breakerClosed breakerState = iota
+	// breakerOpen rejects every fetch until the cooldown has passed.
+	breakerOpen
+	// breakerHalfOpen lets a single probe through to find out whether the kubelet recovered.
+	breakerHalfOpen
+)
+
+// fetchOutcome is what a fetch tells the circuit breaker about the health of a kubelet.
+type fetchOutcome int
+
+const (
+	// fetchSucceeded means the kubelet served its metrics.
+	fetchSucceeded fetchOutcome = iota
+	// fetchFailed means the kubelet is unreachable or unhealthy.
+	fetchFailed
+	// fetchUnknown means the fetch says nothing about the kubelet, e.g. it was canceled by the scraper
+	// or the response could not be used.
+	fetchUnknown
+)
+
+// circuitBreaker fails fetches fast once a kubelet URL failed threshold times in a row,
+// so a kubelet that is down does not make every scrape wait for the full timeout.
+// After the cooldown a single probe is let through: it closes the circuit when it succeeds
+// and opens it again when it fails. A probe with an unknown outcome lets the next one through.
+// A nil circuitBreaker lets everything through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     clock.PassiveClock
+	// onChange is called with the new state of a URL whenever it changes.
+	onChange func(url string, state breakerState)
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// probing reports whether the probe of a half-open circuit is running.
+	probing bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, onChange func(string, breakerState)) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     clock.RealClock{},
+		onChange:  onChange,
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+// allow reports whether url may be fetched and returns a func that must be called with the
+// outcome of the fetch. It returns errCircuitOpen while the circuit is open or a probe is running.
+func (b *circuitBreaker) allow(url string) (func(outcome fetchOutcome), error) {
+	if b == nil {
+		return func(fetchOutcome) {}, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[url]
+	if !ok {
+		c = &circuit{}
+		b.circuits[url] = c
+	}
+	switch c.state {
+	case breakerHalfOpen:
+		if c.probing {
+			return nil, errCircuitOpen
+		}
+	case breakerOpen:
+		if b.clock.Since(c.openedAt) < b.cooldown {
+			return nil, errCircuitOpen
+		}
+		b.setState(url, c, breakerHalfOpen)
+	}
+	probe := c.state == breakerHalfOpen
+	if probe {
+		c.probing = true
+	}
+	return func(outcome fetchOutcome) { b.record(url, c, outcome, probe) }, nil
+}
+
+// record updates the circuit with the outcome of a fetch. probe reports whether the fetch was
+// the probe of a half-open circuit, whose slot is released whatever the outcome.
+func (b *circuitBreaker) record(url string, c *circuit, outcome fetchOutcome, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		c.probing = false
+	}
+	switch outcome {
+	case fetchUnknown:
+		return
+	case fetchSucceeded:
+		c.failures = 0
+		b.setState(url, c, breakerClosed)
+		return
+	}
+
+	c.failures++
+	if c.state == breakerHalfOpen || c.failures >= b.threshold {
+		c.openedAt = b.clock.Now()
+		b.setState(url, c, breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(url string, c *circuit, state breakerState) {
+	if c.state == state {
+		return
+	}
+	c.state = state
+	if b.onChange != nil {
+		b.onChange(url, state)
+	}
+}
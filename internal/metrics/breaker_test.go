@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const url = "https://node:10250/metrics"
+	var states []breakerState
+	b := newCircuitBreaker(2, time.Minute, func(_ string, s breakerState) { states = append(states, s) })
+	clock := clocktesting.NewFakePassiveClock(time.Now())
+	b.clock = clock
+
+	fetch := func(outcome fetchOutcome) error {
+		t.Helper()
+		done, err := b.allow(url)
+		if err != nil {
+			return err
+		}
+		done(outcome)
+		return nil
+	}
+
+	// Closed: failures below the threshold are let through.
+	if err := fetch(fetchFailed); err != nil {
+		t.Fatalf("first failure rejected: %v", err)
+	}
+	if err := fetch(fetchFailed); err != nil {
+		t.Fatalf("second failure rejected: %v", err)
+	}
+
+	// Open: fetches are rejected until the cooldown has passed.
+	if err := fetch(fetchSucceeded); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("fetch with an open circuit = %v, want errCircuitOpen", err)
+	}
+	clock.SetTime(clock.Now().Add(59 * time.Second))
+	if err := fetch(fetchSucceeded); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("fetch before the cooldown passed = %v, want errCircuitOpen", err)
+	}
+
+	// Half-open: a single probe is let through, a failed probe opens the circuit again.
+	clock.SetTime(clock.Now().Add(time.Second))
+	done, err := b.allow(url)
+	if err != nil {
+		t.Fatalf("probe rejected after the cooldown: %v", err)
+	}
+	if _, err := b.allow(url); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("second fetch during the probe = %v, want errCircuitOpen", err)
+	}
+	done(fetchFailed)
+	if err := fetch(fetchSucceeded); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("fetch after a failed probe = %v, want errCircuitOpen", err)
+	}
+
+	// A successful probe closes the circuit.
+	clock.SetTime(clock.Now().Add(time.Minute))
+	if err := fetch(fetchSucceeded); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	if err := fetch(fetchFailed); err != nil {
+		t.Fatalf("fetch after the circuit closed rejected: %v", err)
+	}
+
+	want := []breakerState{breakerOpen, breakerHalfOpen, breakerOpen, breakerHalfOpen, breakerClosed}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+}
+
+func TestCircuitBreakerUnknownProbeOutcome(t *testing.T) {
+	const url = "https://node:10250/metrics"
+	b := newCircuitBreaker(1, time.Minute, nil)
+	clock := clocktesting.NewFakePassiveClock(time.Now())
+	b.clock = clock
+
+	done, err := b.allow(url)
+	if err != nil {
+		t.Fatalf("allow: %v", err)
+	}
+	done(fetchFailed)
+	clock.SetTime(clock.Now().Add(time.Minute))
+
+	// A canceled probe does not close the circuit, but lets the next probe through.
+	probe, err := b.allow(url)
+	if err != nil {
+		t.Fatalf("probe rejected after the cooldown: %v", err)
+	}
+	probe(kubeletOutcome(canceledContext(), context.Canceled))
+	if state := b.circuits[url].state; state == breakerClosed {
+		t.Fatal("canceled probe closed the circuit")
+	}
+	probe, err = b.allow(url)
+	if err != nil {
+		t.Fatalf("probe after a canceled probe rejected: %v", err)
+	}
+	if _, err := b.allow(url); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("second fetch during the probe = %v, want errCircuitOpen", err)
+	}
+	probe(fetchFailed)
+	if _, err := b.allow(url); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("fetch after a failed probe = %v, want errCircuitOpen", err)
+	}
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestNilCircuitBreakerAllowsEverything(t *testing.T) {
+	var b *circuitBreaker
+	done, err := b.allow("https://node:10250/metrics")
+	if err != nil {
+		t.Fatalf("allow: %v", err)
+	}
+	done(fetchFailed)
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// fetchCache caches parsed kubelet responses per kubelet URL.
+// Every endpoint reads them with its own TTL, so a fresh response fetched for one endpoint
+// is reused by the others while they accept its age.
+// Concurrent callers for the same key wait for a single upstream fetch.
+// Every response is kept up to cacheTTLJitter longer than the TTL, chosen at random per fetch,
+// so the entries of proxies sharing a TTL do not expire together and fetch from the kubelets at once.
+type fetchCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	mu        sync.Mutex
+	data      map[string]*dto.MetricFamily
+	fetchedAt time.Time
+	// jitter is the fraction of the TTL added to the age the data expires at.
+	jitter float64
+}
+
+// cacheTTLJitter is the largest fraction of the TTL added to the age of an entry before it expires.
+const cacheTTLJitter = 0.1
+
+func newFetchCache() *fetchCache {
+	return &fetchCache{entries: make(map[string]*cacheEntry)}
+}
+
+// getOrFetch returns a copy of the cached metric families for key, calling fetch when they are
+// missing or older than ttl. Callers own the returned families and may modify them.
+// Failed fetches are not cached.
+func (c *fetchCache) getOrFetch(
+	key string, ttl time.Duration, fetch func() (map[string]*dto.MetricFamily, error),
+) (map[string]*dto.MetricFamily, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cacheEntry{}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.expired(ttl) {
+		data, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		entry.data = data
+		entry.fetchedAt = time.Now()
+		entry.jitter = rand.Float64() * cacheTTLJitter
+	}
+	return cloneMetricFamilies(entry.data), nil
+}
+
+// expired reports whether the entry holds no data or data older than ttl plus its jitter.
+func (e *cacheEntry) expired(ttl time.Duration) bool {
+	return e.data == nil || time.Since(e.fetchedAt) >= ttl+time.Duration(float64(ttl)*e.jitter)
+}
+
+func cloneMetricFamilies(mfs map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	cp := make(map[string]*dto.MetricFamily, len(mfs))
+	for name, mf := range mfs {
+		cp[name] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return cp
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFetchCacheCoalescesExpiredFetches(t *testing.T) {
+	const key = "https://node:10250/metrics/cadvisor"
+	const ttl = 10 * time.Millisecond
+	c := newFetchCache()
+	var calls atomic.Int64
+	fetch := func() (map[string]*dto.MetricFamily, error) {
+		calls.Add(1)
+		// Keep the fetch in flight while the other callers arrive.
+		time.Sleep(50 * time.Millisecond)
+		return map[string]*dto.MetricFamily{}, nil
+	}
+	if _, err := c.getOrFetch(key, ttl, fetch); err != nil {
+		t.Fatalf("initial fetch: %v", err)
+	}
+	time.Sleep(ttl + time.Duration(float64(ttl)*cacheTTLJitter))
+	calls.Store(0)
+
+	const n = 20
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.getOrFetch(key, ttl, fetch); err != nil {
+				t.Errorf("fetch: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream fetches for %d concurrent callers = %d, want 1", n, got)
+	}
+}
+
+func TestCacheEntryTTLJitter(t *testing.T) {
+	const ttl = time.Minute
+	for range 100 {
+		c := newFetchCache()
+		if _, err := c.getOrFetch("key", ttl, func() (map[string]*dto.MetricFamily, error) {
+			return map[string]*dto.MetricFamily{}, nil
+		}); err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+		entry := c.entries["key"]
+		if entry.jitter < 0 || entry.jitter >= cacheTTLJitter {
+			t.Fatalf("jitter = %v, want within [0, %v)", entry.jitter, cacheTTLJitter)
+		}
+
+		entry.fetchedAt = time.Now().Add(-ttl + time.Second)
+		if entry.expired(ttl) {
+			t.Fatal("entry expired before its TTL")
+		}
+		entry.fetchedAt = time.Now().Add(-ttl - time.Duration(float64(ttl)*cacheTTLJitter))
+		if !entry.expired(ttl) {
+			t.Fatal("entry not expired after its TTL plus the largest jitter")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"k8s.io/client-go/rest"
+)
+
+// kubeletClient lazily builds the HTTP client used for kubelet requests and reuses it
+// across scrapes, keeping idle keep-alive connections to the kubelet warm.
+type kubeletClient struct {
+	mu     sync.Mutex
+	client *http.Client
+}
+
+// get returns the shared client, building it on the first call. A failed build is not kept,
+// so a CA file mounted late or a fixed setting is picked up by the next call.
+func (kc *kubeletClient) get(cfg *rest.Config, opts *ServerRunnableOpts, insecureSkipVerify bool) (*http.Client, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if kc.client == nil {
+		client, err := newKubeletHTTPClient(cfg, opts, insecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		kc.client = client
+	}
+	return kc.client, nil
+}
+
+// insecureSkipVerify reports whether the kubelet serving certificate is not verified, as set in opts
+// or in its RestConfig. RestConfig may be nil when opts.Transport sends the requests.
+func insecureSkipVerify(opts *ServerRunnableOpts) bool {
+	return opts.InsecureSkipVerify || (opts.RestConfig != nil && opts.RestConfig.Insecure)
+}
+
+// newKubeletHTTPClient creates an HTTP client from the rest.Config credentials, or from opts.Transport when set.
+// A CA bundle from opts.KubeletCAFile takes precedence over insecureSkipVerify.
+func newKubeletHTTPClient(cfg *rest.Config, opts *ServerRunnableOpts, insecureSkipVerify bool) (*http.Client, error) {
+	if opts.Transport != nil {
+		return &http.Client{Transport: opts.Transport}, nil
+	}
+
+	tlsConfig, err := rest.TLSConfigFor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS config from rest.Config: %w", err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	switch {
+	case opts.KubeletCAFile != "":
+		pool, err := loadCertPool(opts.KubeletCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+		tlsConfig.InsecureSkipVerify = false
+	case insecureSkipVerify:
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	// Build a dedicated transport instead of mutating the one cached by client-go,
+	// then wrap it with the rest.Config authentication.
+	// The cloned transport routes requests through the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables, an explicit upstream proxy replaces them.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if opts.UpstreamProxyURL != "" {
+		proxyURL, err := url.Parse(opts.UpstreamProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if socket := opts.UnixSocketPath; socket != "" {
+		// Every connection goes to the socket whatever the host of the request, so no proxy applies.
+		var dialer net.Dialer
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		transport.Proxy = nil
+	}
+
+	rt, err := rest.HTTPWrappersForConfig(cfg, transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transport from rest.Config: %w", err)
+	}
+
+	return &http.Client{Transport: rt}, nil
+}
+
+// loadCertPool reads a PEM encoded CA bundle.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read kubelet CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in kubelet CA file %q", caFile)
+	}
+	return pool, nil
+}
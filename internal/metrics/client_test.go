@@ -0,0 +1,224 @@
+package metrics
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse CA certificate: %v", err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// serverCert issues a serving certificate for 127.0.0.1 signed by the CA.
+func (ca *testCA) serverCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate server key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kubelet"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create server certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) writeFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(path, ca.pem, 0o600); err != nil {
+		t.Fatalf("write CA file: %v", err)
+	}
+	return path
+}
+
+func TestKubeletCAFile(t *testing.T) {
+	kubeletCA := newTestCA(t, "kubelet-ca")
+	otherCA := newTestCA(t, "other-ca")
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{kubeletCA.serverCert(t)}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("split host port: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		ca       *testCA
+		insecure bool
+		wantOK   bool
+	}{
+		{name: "signed by the provided CA", ca: kubeletCA, wantOK: true},
+		{name: "signed by a different CA", ca: otherCA, wantOK: false},
+		{name: "CA takes precedence over insecure", ca: otherCA, insecure: true, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), ServerRunnableOpts{
+				RestConfig:         &rest.Config{},
+				NodeNameOrIP:       host,
+				NodePort:           port,
+				KubeletCAFile:      tt.ca.writeFile(t),
+				InsecureSkipVerify: tt.insecure,
+			})
+			rec := serve(t, sr, "/metrics/cadvisor")
+			if gotOK := rec.Code == http.StatusOK; gotOK != tt.wantOK {
+				t.Errorf("status = %d, want ok=%v, body: %s", rec.Code, tt.wantOK, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestKubeletCAFileMountedLate(t *testing.T) {
+	kubeletCA := newTestCA(t, "kubelet-ca")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{kubeletCA.serverCert(t)}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("split host port: %v", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), ServerRunnableOpts{
+		RestConfig:    &rest.Config{},
+		NodeNameOrIP:  host,
+		NodePort:      port,
+		KubeletCAFile: caFile,
+	})
+
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code == http.StatusOK {
+		t.Fatal("scrape succeeded without the CA file")
+	}
+	if err := os.WriteFile(caFile, kubeletCA.pem, 0o600); err != nil {
+		t.Fatalf("write CA file: %v", err)
+	}
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Errorf("status once the CA file is mounted = %d, body: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// writeServerCert writes a serving certificate signed by the CA and its key as PEM files.
+func (ca *testCA) writeServerCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	cert := ca.serverCert(t)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("marshal server key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "tls.crt")
+	keyFile = filepath.Join(dir, "tls.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("write cert file: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("write key file: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestKubeletUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen on socket: %v", err)
+	}
+	var gotPath string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	}))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	// The node address and the kube-apiserver are ignored in favor of the socket.
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), ServerRunnableOpts{
+		RestConfig:     &rest.Config{},
+		Scheme:         "http",
+		NodeNameOrIP:   "10.0.0.1",
+		KubeApiserver:  "apiserver.example",
+		UnixSocketPath: socket,
+	})
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if gotPath != "/metrics/cadvisor" {
+		t.Errorf("kubelet path = %q, want /metrics/cadvisor", gotPath)
+	}
+	if !strings.Contains(rec.Body.String(), "container_memory_working_set_bytes") {
+		t.Errorf("expected the kubelet metrics to be served:\n%s", rec.Body.String())
+	}
+}
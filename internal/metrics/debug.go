@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// NamespacesHandler serves the labels and annotations stored in nm as JSON, keyed by namespace name.
+// It shows exactly what is injected into the metrics of every namespace.
+func NamespacesHandler(nm *NamespaceMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(nm.Namespaces()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// rawHandler serves GET /metrics/raw?path=<local path>, the kubelet metrics of one of the served endpoints
+// passed on as the kubelet wrote them, without enrichment, filtering nor caching, to compare the enriched
+// output with. The Accept header of the request is forwarded, so the kubelet picks the format.
+// The path defaults to /metrics/cadvisor. With Nodes, the node query parameter names the node fetched from.
+func (sr *ServerRunnable) rawHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = "/metrics/cadvisor"
+		}
+		opts, ok := sr.endpoints[path]
+		if !ok {
+			http.Error(w, fmt.Sprintf("%q is not a served endpoint", path), http.StatusNotFound)
+			return
+		}
+		if len(opts.Nodes) > 0 {
+			name := r.URL.Query().Get("node")
+			i := slices.IndexFunc(opts.Nodes, func(node NodeTarget) bool { return node.Name == name })
+			if i < 0 {
+				http.Error(w, fmt.Sprintf("%q is not one of the nodes", name), http.StatusNotFound)
+				return
+			}
+			opts = nodeOpts(opts, opts.Nodes[i])
+		}
+
+		resp, err := fetchRawLimited(r.Context(), opts, r.Header.Get("Accept"))
+		if err != nil {
+			writeError(w, opts, classifyFetchError(err, opts), fmt.Sprintf("failed to fetch metrics: %v", err))
+			return
+		}
+		defer resp.Body.Close()
+		for _, name := range []string{"Content-Type", "Content-Encoding"} {
+			if value := resp.Header.Get(name); value != "" {
+				w.Header().Set(name, value)
+			}
+		}
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.FromContext(r.Context()).Error(err, "failed to write raw metrics", "path", path)
+		}
+	})
+}
+
+// fetchRawLimited calls fetchRaw within the scrape limit and the circuit breaker of opts, like the scrapes.
+// The scrape limit is held until the body is closed.
+func fetchRawLimited(ctx context.Context, opts *ServerRunnableOpts, accept string) (*http.Response, error) {
+	release, err := opts.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done, err := opts.breaker.allow(kubeletURL(opts))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp, err := fetchRaw(ctx, opts.RestConfig, opts, insecureSkipVerify(opts), accept)
+	done(kubeletOutcome(ctx, err))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: sync.OnceFunc(release)}
+	return resp, nil
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// Codes of the failed scrapes in JSON error responses.
+const (
+	ErrorCodeCacheNotSynced   = "cache_not_synced"
+	ErrorCodeTooManyScrapes   = "too_many_scrapes"
+	ErrorCodeCircuitOpen      = "circuit_open"
+	ErrorCodeTimeout          = "timeout"
+	ErrorCodeUpstreamStatus   = "upstream_status"
+	ErrorCodeUpstreamRejected = "upstream_rejected"
+	ErrorCodeParseFailed      = "parse_failed"
+	ErrorCodeFetchFailed      = "fetch_failed"
+	ErrorCodeBadRequest       = "bad_request"
+	ErrorCodePathNotAllowed   = "path_not_allowed"
+)
+
+// errorResponse is the body of a failed scrape with ServerRunnableOpts.JSONErrors.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// scrapeError describes a failed scrape: its status, its code and a message that does not
+// leak the internal error, e.g. kubelet addresses or response bodies.
+type scrapeError struct {
+	status  int
+	code    string
+	message string
+	// retryAfter is sent as the Retry-After header when set.
+	retryAfter time.Duration
+}
+
+// cacheSyncRetryAfter is the Retry-After of the responses answered before the namespace cache is synced.
+const cacheSyncRetryAfter = 5 * time.Second
+
+// classifyFetchError maps a failed kubelet fetch to the response answering it:
+// 504 for a timeout, 502 for a kubelet answering with a non-200 status, rejecting the proxy credentials
+// with 401 or 403 in particular, and 500 otherwise, e.g. for a response that can not be parsed.
+// Scrapes rejected by the scrape limit are told to retry after the queue timeout of opts,
+// those rejected by the circuit breaker after its cooldown.
+func classifyFetchError(err error, opts *ServerRunnableOpts) scrapeError {
+	var se *statusError
+	var parseErr expfmt.ParseError
+	switch {
+	case errors.Is(err, errTooManyScrapes):
+		return scrapeError{http.StatusTooManyRequests, ErrorCodeTooManyScrapes, "too many concurrent scrapes",
+			opts.ScrapeQueueTimeout}
+	case errors.Is(err, errCircuitOpen):
+		return scrapeError{http.StatusServiceUnavailable, ErrorCodeCircuitOpen, "kubelet circuit breaker is open",
+			opts.breaker.cooldown}
+	case errors.Is(err, context.DeadlineExceeded):
+		return scrapeError{status: http.StatusGatewayTimeout, code: ErrorCodeTimeout,
+			message: "kubelet did not respond in time"}
+	case errors.As(err, &se) && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden):
+		return scrapeError{status: http.StatusBadGateway, code: ErrorCodeUpstreamRejected,
+			message: fmt.Sprintf("kubelet rejected the request with status %d", se.code)}
+	case errors.As(err, &se):
+		return scrapeError{status: http.StatusBadGateway, code: ErrorCodeUpstreamStatus,
+			message: fmt.Sprintf("kubelet answered with status %d", se.code)}
+	case errors.As(err, &parseErr):
+		return scrapeError{status: http.StatusInternalServerError, code: ErrorCodeParseFailed,
+			message: "failed to parse the kubelet metrics"}
+	default:
+		return scrapeError{status: http.StatusInternalServerError, code: ErrorCodeFetchFailed,
+			message: "failed to fetch metrics"}
+	}
+}
+
+// writeError answers a failed scrape. With opts.JSONErrors the body is an errorResponse holding the code
+// and the sanitized message of e, otherwise detail is written as plain text.
+func writeError(w http.ResponseWriter, opts *ServerRunnableOpts, e scrapeError, detail string) {
+	if e.retryAfter > 0 {
+		setRetryAfter(w, e.retryAfter)
+	}
+	if !opts.JSONErrors {
+		http.Error(w, detail, e.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: e.message, Code: e.code})
+}
+
+// setRetryAfter sets the Retry-After header of w to d in whole seconds, rounded up and at least 1.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := max(int(math.Ceil(d.Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
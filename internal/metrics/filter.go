@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// PresetResourceBasic keeps the CPU, memory and network metrics of containers, for scrapers with little to spare.
+const PresetResourceBasic = "resource-basic"
+
+// MetricPresets are the curated lists of metric names ServerRunnableOpts.Preset can select, by preset name.
+var MetricPresets = map[string][]string{
+	PresetResourceBasic: {
+		"container_cpu_usage_seconds_total",
+		"container_cpu_cfs_periods_total",
+		"container_cpu_cfs_throttled_periods_total",
+		"container_memory_working_set_bytes",
+		"container_memory_rss",
+		"container_memory_usage_bytes",
+		"container_network_receive_bytes_total",
+		"container_network_transmit_bytes_total",
+		"container_network_receive_packets_dropped_total",
+		"container_network_transmit_packets_dropped_total",
+		"container_spec_cpu_quota",
+		"container_spec_memory_limit_bytes",
+	},
+}
+
+// metricNameFilter selects metric families by name.
+// Patterns are anchored on both ends, like Prometheus relabeling regexes.
+type metricNameFilter struct {
+	keep []*regexp.Regexp
+	drop []*regexp.Regexp
+	// preset holds the names of the selected preset, used when keep is empty.
+	preset []string
+}
+
+func newMetricNameFilter(opts *ServerRunnableOpts) (*metricNameFilter, error) {
+	keep, drop := opts.MetricNameKeep, opts.MetricNameDrop
+	if len(keep) == 0 && len(drop) == 0 && opts.Preset == "" {
+		return nil, nil
+	}
+
+	f := &metricNameFilter{}
+	if opts.Preset != "" {
+		names, ok := MetricPresets[opts.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric preset %q: must be one of %v", opts.Preset, sortedKeys(MetricPresets))
+		}
+		f.preset = names
+	}
+	var err error
+	if f.keep, err = compileAnchored(keep); err != nil {
+		return nil, fmt.Errorf("metric name keep filter: %w", err)
+	}
+	if f.drop, err = compileAnchored(drop); err != nil {
+		return nil, fmt.Errorf("metric name drop filter: %w", err)
+	}
+	return f, nil
+}
+
+func compileAnchored(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// allowed reports whether a family named name is exported.
+// A name matching a keep pattern is always exported; with keep patterns set, nothing else is.
+// Without keep patterns, only the names of the preset are exported, if any, and names matching
+// a drop pattern are removed.
+func (f *metricNameFilter) allowed(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.keep) > 0 {
+		return matchesAny(f.keep, name)
+	}
+	if f.preset != nil && !slices.Contains(f.preset, name) {
+		return false
+	}
+	return !matchesAny(f.drop, name)
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMetricFamilies removes the families of mfs not allowed by the opts.Preset,
+// opts.MetricNameKeep and opts.MetricNameDrop filters. The filter compiled by newServerRunnable
+// is used when there is one.
+func filterMetricFamilies(mfs map[string]*dto.MetricFamily, opts *ServerRunnableOpts) error {
+	f := opts.nameFilter
+	if f == nil {
+		var err error
+		if f, err = newMetricNameFilter(opts); err != nil || f == nil {
+			return err
+		}
+	}
+	for name := range mfs {
+		if !f.allowed(name) {
+			delete(mfs, name)
+		}
+	}
+	return nil
+}
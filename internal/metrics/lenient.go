@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// parseLenient parses data like the strict parser and, when it is malformed, falls back to
+// parsing every metric family on its own. Families that fail to parse are logged, counted
+// and left out instead of failing the whole scrape.
+func parseLenient(ctx context.Context, data []byte, opts *ServerRunnableOpts) (map[string]*dto.MetricFamily, error) {
+	var parser expfmt.TextParser
+	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	var parseErr expfmt.ParseError
+	if err == nil || !errors.As(err, &parseErr) {
+		return metricFamilies, err
+	}
+
+	logger := log.FromContext(ctx).WithName("metrics.parseLenient")
+	metricFamilies = make(map[string]*dto.MetricFamily)
+	for _, block := range familyBlocks(data) {
+		var parser expfmt.TextParser
+		mfs, err := parser.TextToMetricFamilies(bytes.NewReader(block))
+		if err != nil {
+			logger.Error(err, "skipping malformed metric family", "path", opts.NodePath)
+			opts.selfMetrics.observeParseError(opts.NodePath)
+			continue
+		}
+		for name, mf := range mfs {
+			if existing, ok := metricFamilies[name]; ok && existing.GetType() == mf.GetType() {
+				existing.Metric = append(existing.Metric, mf.Metric...)
+				continue
+			}
+			metricFamilies[name] = mf
+		}
+	}
+	return metricFamilies, nil
+}
+
+// familyBlocks splits text format data into blocks starting at every HELP or TYPE line
+// of a metric family different from the one of the current block.
+// Samples without metadata stay in the block they follow.
+func familyBlocks(data []byte) [][]byte {
+	var blocks [][]byte
+	current, start := "", 0
+	for offset := 0; offset < len(data); {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += offset + 1
+		}
+
+		if name, ok := metadataName(data[offset:end]); ok && name != current {
+			if offset > start {
+				blocks = append(blocks, data[start:offset])
+			}
+			current, start = name, offset
+		}
+		offset = end
+	}
+	if start < len(data) {
+		blocks = append(blocks, data[start:])
+	}
+	return blocks
+}
+
+// metadataName returns the metric family name of a "# HELP" or "# TYPE" line.
+func metadataName(line []byte) (string, bool) {
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 || fields[0] != "#" || (fields[1] != "HELP" && fields[1] != "TYPE") {
+		return "", false
+	}
+	return fields[2], true
+}
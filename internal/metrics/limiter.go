@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errTooManyScrapes is returned when no kubelet fetch slot frees up within the queue timeout.
+var errTooManyScrapes = errors.New("too many concurrent scrapes")
+
+// scrapeLimiter bounds the number of kubelet fetches running at the same time.
+// A nil scrapeLimiter does not limit anything.
+type scrapeLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newScrapeLimiter(n int, timeout time.Duration) *scrapeLimiter {
+	return &scrapeLimiter{
+		slots:   make(chan struct{}, n),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a free slot for up to the queue timeout, or until ctx is done
+// when no timeout is set. The returned release func must be called once the fetch is finished.
+func (l *scrapeLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-timeout:
+		return nil, errTooManyScrapes
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -1,169 +1,1131 @@
 package metrics
 
 import (
+	"cmp"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 	"google.golang.org/protobuf/proto"
 	"k8s.io/client-go/rest"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/relabel"
 )
 
-// NamespaceMetrics stores namespace names and their labels.
+// DefaultNamespaceLabelKey is the metric label that identifies the namespace of a series.
+const DefaultNamespaceLabelKey = "namespace"
+
+// DefaultScheme is the scheme of the kubelet URL when ServerRunnableOpts.Scheme is not set.
+const DefaultScheme = "https"
+
+// DefaultMaxResponseBytes is the largest kubelet response read when ServerRunnableOpts.MaxResponseBytes is not set.
+const DefaultMaxResponseBytes int64 = 64 << 20
+
+// NamespaceCreatedLabel holds the creation time of the namespace of a series in unix seconds.
+const NamespaceCreatedLabel = "namespace_created"
+
+// InstanceLabelName holds ServerRunnableOpts.Instance, the proxy replica that served a series.
+const InstanceLabelName = "kmp_instance"
+
+// NamespaceMetrics stores namespace names and their labels, selected annotations and creation times.
+// Labels and annotations are kept in separate maps so their keys never collide.
+// It is safe for concurrent use by the reconciler and the HTTP handlers.
 type NamespaceMetrics struct {
-	Namespaces map[string]map[string]string
+	mu          sync.RWMutex
+	namespaces  map[string]map[string]string
+	annotations map[string]map[string]string
+	// created holds the creation time of a namespace as its NamespaceCreatedLabel label,
+	// ready to be injected without allocating on every scrape.
+	created map[string]map[string]string
 }
 
 // NewNamespaceMetrics creates a new NamespaceMetrics instance.
 func NewNamespaceMetrics() *NamespaceMetrics {
 	return &NamespaceMetrics{
-		Namespaces: make(map[string]map[string]string),
+		namespaces:  make(map[string]map[string]string),
+		annotations: make(map[string]map[string]string),
+		created:     make(map[string]map[string]string),
+	}
+}
+
+// Set stores a copy of the labels for the given namespace.
+func (nm *NamespaceMetrics) Set(ns string, labels map[string]string) {
+	nm.set(namespaceLabels, ns, labels)
+}
+
+// Get returns the labels stored for the given namespace.
+// The returned map must not be modified by the caller.
+func (nm *NamespaceMetrics) Get(ns string) (map[string]string, bool) {
+	return nm.get(namespaceLabels, ns)
+}
+
+// SetAnnotations stores a copy of the annotations for the given namespace.
+func (nm *NamespaceMetrics) SetAnnotations(ns string, annotations map[string]string) {
+	nm.set(namespaceAnnotations, ns, annotations)
+}
+
+// GetAnnotations returns the annotations stored for the given namespace.
+// The returned map must not be modified by the caller.
+func (nm *NamespaceMetrics) GetAnnotations(ns string) (map[string]string, bool) {
+	return nm.get(namespaceAnnotations, ns)
+}
+
+// SetCreated stores the creation time of the given namespace.
+func (nm *NamespaceMetrics) SetCreated(ns string, created time.Time) {
+	labels := map[string]string{NamespaceCreatedLabel: strconv.FormatInt(created.Unix(), 10)}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.created[ns] = labels
+}
+
+// GetCreated returns the creation time stored for the given namespace.
+func (nm *NamespaceMetrics) GetCreated(ns string) (time.Time, bool) {
+	labels, ok := nm.get(namespaceCreated, ns)
+	if !ok {
+		return time.Time{}, false
 	}
+	sec, err := strconv.ParseInt(labels[NamespaceCreatedLabel], 10, 64)
+	return time.Unix(sec, 0), err == nil
+}
+
+// Delete removes the labels, annotations and creation time stored for the given namespace.
+func (nm *NamespaceMetrics) Delete(ns string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	delete(nm.namespaces, ns)
+	delete(nm.annotations, ns)
+	delete(nm.created, ns)
+}
+
+// Len returns the number of namespaces with anything stored. It is 0 for a nil NamespaceMetrics.
+func (nm *NamespaceMetrics) Len() int {
+	if nm == nil {
+		return 0
+	}
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+
+	n := len(nm.namespaces)
+	for ns := range nm.annotations {
+		if _, ok := nm.namespaces[ns]; !ok {
+			n++
+		}
+	}
+	for ns := range nm.created {
+		_, hasLabels := nm.namespaces[ns]
+		_, hasAnnotations := nm.annotations[ns]
+		if !hasLabels && !hasAnnotations {
+			n++
+		}
+	}
+	return n
+}
+
+// NamespaceState is the labels, annotations and creation time stored for one namespace.
+type NamespaceState struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Created is the creation time in unix seconds, zero when it is not stored.
+	Created int64 `json:"created,omitempty"`
+}
+
+// Namespaces returns a copy of everything stored, keyed by namespace name.
+func (nm *NamespaceMetrics) Namespaces() map[string]NamespaceState {
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+
+	state := make(map[string]NamespaceState, len(nm.namespaces))
+	for ns, labels := range nm.namespaces {
+		s := state[ns]
+		s.Labels = maps.Clone(labels)
+		state[ns] = s
+	}
+	for ns, annotations := range nm.annotations {
+		s := state[ns]
+		s.Annotations = maps.Clone(annotations)
+		state[ns] = s
+	}
+	for ns, labels := range nm.created {
+		s := state[ns]
+		s.Created, _ = strconv.ParseInt(labels[NamespaceCreatedLabel], 10, 64)
+		state[ns] = s
+	}
+	return state
+}
+
+// Replace replaces everything stored with state, keyed by namespace name, at once.
+// It is used to rebuild the stored labels when the rules selecting them change.
+func (nm *NamespaceMetrics) Replace(state map[string]NamespaceState) {
+	namespaces := make(map[string]map[string]string, len(state))
+	annotations := make(map[string]map[string]string)
+	created := make(map[string]map[string]string)
+	for ns, s := range state {
+		if s.Labels != nil {
+			namespaces[ns] = maps.Clone(s.Labels)
+		}
+		if s.Annotations != nil {
+			annotations[ns] = maps.Clone(s.Annotations)
+		}
+		if s.Created != 0 {
+			created[ns] = map[string]string{NamespaceCreatedLabel: strconv.FormatInt(s.Created, 10)}
+		}
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.namespaces = namespaces
+	nm.annotations = annotations
+	nm.created = created
+}
+
+// namespaceMap selects one of the maps of a NamespaceMetrics. It is called with nm.mu held,
+// since Replace swaps the maps.
+type namespaceMap func(nm *NamespaceMetrics) map[string]map[string]string
+
+func namespaceLabels(nm *NamespaceMetrics) map[string]map[string]string      { return nm.namespaces }
+func namespaceAnnotations(nm *NamespaceMetrics) map[string]map[string]string { return nm.annotations }
+func namespaceCreated(nm *NamespaceMetrics) map[string]map[string]string     { return nm.created }
+
+func (nm *NamespaceMetrics) set(m namespaceMap, ns string, values map[string]string) {
+	cp := make(map[string]string, len(values))
+	for k, v := range values {
+		cp[k] = v
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	m(nm)[ns] = cp
+}
+
+func (nm *NamespaceMetrics) get(m namespaceMap, ns string) (map[string]string, bool) {
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+	values, ok := m(nm)[ns]
+	return values, ok
+}
+
+// LabelDiff is the change between the labels stored for a namespace and its current labels.
+type LabelDiff struct {
+	// Stored reports whether the namespace was stored when the diff was computed.
+	Stored bool
+	// Changed holds the labels that were added or whose value changed.
+	Changed map[string]string
+	// Removed lists the stored labels that no longer exist.
+	Removed []string
+}
+
+// Empty reports whether applying the diff would change nothing.
+func (d LabelDiff) Empty() bool {
+	return d.Stored && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+// DiffLabels compares labels, without the ignored keys, to the labels stored for ns.
+// It does not allocate when nothing changed, so unchanged namespaces are cheap to reconcile.
+func (nm *NamespaceMetrics) DiffLabels(ns string, labels map[string]string, ignore ...string) LabelDiff {
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+
+	stored, ok := nm.namespaces[ns]
+	diff := LabelDiff{Stored: ok}
+	for k, v := range labels {
+		if slices.Contains(ignore, k) {
+			continue
+		}
+		if old, ok := stored[k]; !ok || old != v {
+			if diff.Changed == nil {
+				diff.Changed = make(map[string]string)
+			}
+			diff.Changed[k] = v
+		}
+	}
+	for k := range stored {
+		if _, ok := labels[k]; !ok || slices.Contains(ignore, k) {
+			diff.Removed = append(diff.Removed, k)
+		}
+	}
+	return diff
+}
+
+// ApplyLabelDiff applies diff to the labels stored for ns.
+// Maps returned by Get are never modified: the stored map is copied before the diff is applied.
+func (nm *NamespaceMetrics) ApplyLabelDiff(ns string, diff LabelDiff) {
+	if diff.Empty() {
+		return
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	stored := nm.namespaces[ns]
+	labels := make(map[string]string, len(stored)+len(diff.Changed))
+	for k, v := range stored {
+		labels[k] = v
+	}
+	for k, v := range diff.Changed {
+		labels[k] = v
+	}
+	for _, k := range diff.Removed {
+		delete(labels, k)
+	}
+	nm.namespaces[ns] = labels
 }
 
 // Handler handles HTTP requests for Prometheus metrics.
+// Metrics are encoded in the OpenMetrics or delimited protobuf format when the Accept header asks for it.
+// It answers 503 until opts.Readiness reports the namespace cache as synced.
+// Failed fetches are answered with 504 on timeout, 502 when the kubelet answered with another status than 200
+// and 500 otherwise, with a JSON body when opts.JSONErrors is set.
+// Enriched metrics are streamed to the response without buffering the whole payload
+// and gzip-compressed when the client accepts it.
 func Handler(nm *NamespaceMetrics, opts *ServerRunnableOpts) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		logger := log.FromContext(ctx).WithName("metrics.Handler")
 		logger.V(1).Info("serving metrics", "path", r.URL.Path)
-		data, err := FetchAndProcessMetrics(ctx, nm, opts)
+		if opts.Readiness != nil && !opts.Readiness.CacheSynced() {
+			// Without namespace labels the output would silently lack enrichment.
+			writeError(w, opts, scrapeError{http.StatusServiceUnavailable, ErrorCodeCacheNotSynced,
+				"namespace cache not synced", cacheSyncRetryAfter}, "namespace cache not synced")
+			return
+		}
+
+		fetchOpts := opts
+		if timeout, ok := scrapeTimeout(r); ok {
+			// The scraper gives up after its timeout, there is no point fetching any longer.
+			o := *opts
+			o.FetchTimeout = timeout
+			fetchOpts = &o
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		metricFamilies, err := fetchMetricFamilies(ctx, fetchOpts)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to fetch/process metrics: %v", err),
-				http.StatusInternalServerError)
+			writeError(w, opts, classifyFetchError(err, opts), fmt.Sprintf("failed to fetch/process metrics: %v", err))
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-		w.Write(data)
+		format := negotiateFormat(r)
+		var out io.Writer = w
+		w.Header().Set("Content-Type", contentType(format, opts))
+		w.Header().Add("Vary", "Accept, Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer func() {
+				if err := gz.Close(); err != nil {
+					logger.Error(err, "failed to close gzip writer")
+				}
+			}()
+			out = gz
+		}
+
+		if err := enrichAndEncode(ctx, out, format, metricFamilies, nm, opts); err != nil {
+			if ctx.Err() != nil {
+				logger.V(1).Info("scrape aborted", "reason", ctx.Err().Error())
+				return
+			}
+			// Headers are already sent, the best we can do is to log the failure.
+			logger.Error(err, "failed to write enriched metrics")
+			return
+		}
+		opts.selfMetrics.observeSuccess(opts.localPath)
 	})
 }
 
+// scrapeTimeoutHeader is sent by Prometheus with the timeout of the scrape in seconds.
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// scrapeTimeoutMargin is kept from the scrape timeout to enrich and send the response.
+const scrapeTimeoutMargin = 500 * time.Millisecond
+
+// scrapeTimeout returns the fetch timeout derived from the scrape timeout header of r.
+// The margin is not subtracted from timeouts too short to spare it.
+func scrapeTimeout(r *http.Request) (time.Duration, bool) {
+	v := r.Header.Get(scrapeTimeoutHeader)
+	if v == "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return 0, false
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > 2*scrapeTimeoutMargin {
+		timeout -= scrapeTimeoutMargin
+	}
+	return timeout, true
+}
+
+// negotiateFormat picks the exposition format from the Accept header of r.
+// OpenMetrics, in the version asked for, and the delimited protobuf format are used when the client
+// asks for them, the text format otherwise.
+func negotiateFormat(r *http.Request) expfmt.Format {
+	// Metric names are not escaped, the escaping term added by the negotiation is left out.
+	negotiated, _, _ := strings.Cut(string(expfmt.NegotiateIncludingOpenMetrics(r.Header)), "; escaping=")
+	switch format := expfmt.Format(negotiated); format.FormatType() {
+	case expfmt.TypeOpenMetrics, expfmt.TypeProtoDelim, expfmt.TypeTextPlain:
+		return format
+	default:
+		return expfmt.NewFormat(expfmt.TypeTextPlain)
+	}
+}
+
+// contentType returns the Content-Type header for responses in format,
+// or opts.TextContentType for the text format when it is set.
+func contentType(format expfmt.Format, opts *ServerRunnableOpts) string {
+	if format.FormatType() == expfmt.TypeTextPlain && opts.TextContentType != "" {
+		return opts.TextContentType
+	}
+	return string(format)
+}
+
+// acceptsGzip reports whether the client accepts a gzip-encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(encoding), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
 // FetchAndProcessMetrics fetches metrics from kubelet and returns enhanced metrics.
+// Kubelet responses are reused for opts.CacheTTL when caching is enabled.
 func FetchAndProcessMetrics(
 	ctx context.Context,
 	nm *NamespaceMetrics,
 	opts *ServerRunnableOpts,
 ) ([]byte, error) {
-	logger := log.FromContext(ctx).WithName("metrics.FetchAndProcessMetrics")
+	metricFamilies, err := fetchMetricFamilies(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	enriched, err := EnrichMetricFamilies(ctx, metricFamilies, nm, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enrich metrics: %w", err)
+	}
+
+	return []byte(enriched), nil
+}
+
+// fetchMetricFamilies fetches metrics from kubelet and parses them into metric families.
+// Metrics of every node in opts.Nodes are fetched and merged when it is set.
+func fetchMetricFamilies(ctx context.Context, opts *ServerRunnableOpts) (map[string]*dto.MetricFamily, error) {
+	if len(opts.Nodes) > 0 {
+		return fetchNodesMetricFamilies(ctx, opts)
+	}
+	return fetchNodeMetricFamilies(ctx, opts)
+}
+
+// fetchNodeMetricFamilies fetches metrics from the kubelet of a single node.
+func fetchNodeMetricFamilies(ctx context.Context, opts *ServerRunnableOpts) (map[string]*dto.MetricFamily, error) {
+	logger := log.FromContext(ctx).WithName("metrics.fetchMetricFamilies")
 	logger.V(1).Info("fetching metrics")
-	var raw []byte
+	var metricFamilies map[string]*dto.MetricFamily
 	var err error
 
-	raw, err = fetchMetrics(
-		// TODO: Fix insecureSkipVerify
-		ctx, opts.RestConfig, opts, opts.RestConfig.Insecure,
-	)
+	fetch := func() (map[string]*dto.MetricFamily, error) {
+		release, err := opts.limiter.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		done, err := opts.breaker.allow(kubeletURL(opts))
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		mfs, err := fetchMetrics(
+			ctx, opts.RestConfig, opts, insecureSkipVerify(opts),
+		)
+		opts.selfMetrics.observeFetch(opts.NodePath, start, err)
+		done(kubeletOutcome(ctx, err))
+		return mfs, err
+	}
+	if opts.cache != nil && opts.cacheTTL > 0 {
+		metricFamilies, err = opts.cache.getOrFetch(kubeletURL(opts), opts.cacheTTL, fetch)
+	} else {
+		metricFamilies, err = fetch()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("fetch error: %w", err)
 	}
 
-	var parser expfmt.TextParser
-	metricFamilies, err := parser.TextToMetricFamilies(strings.NewReader(string(raw)))
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse metrics: %w", err)
+	if err := filterMetricFamilies(metricFamilies, opts); err != nil {
+		return nil, err
 	}
 
-	logger.V(1).Info("enriching metrics")
+	if opts.Readiness != nil {
+		opts.Readiness.SetScraped()
+	}
+	return metricFamilies, nil
+}
 
-	enriched, err := EnrichMetricFamilies(metricFamilies, nm)
+// fetchDirectFromKubelet call to nodeIP:nodePort/nodePath and parses the response while it is read.
+// Transient failures (network errors and 5xx responses) are retried with exponential backoff
+// up to opts.FetchMaxAttempts times.
+func fetchMetrics(
+	ctx context.Context, cfg *rest.Config, otps *ServerRunnableOpts, insecureSkipVerify bool,
+) (map[string]*dto.MetricFamily, error) {
+	logger := log.FromContext(ctx)
+	httpClient, url, err := kubeletTarget(ctx, cfg, otps, insecureSkipVerify)
 	if err != nil {
-		return nil, fmt.Errorf("failed to enrich metrics: %w", err)
+		return nil, err
 	}
+	logger.V(1).Info("fetching metrics from", "url", url)
 
-	return []byte(enriched), nil
+	maxAttempts := max(otps.FetchMaxAttempts, 1)
+	delay := otps.FetchRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		data, err := fetchOnce(ctx, httpClient, url, otps)
+		if err == nil || attempt >= maxAttempts || !retryable(err) || ctx.Err() != nil {
+			return data, err
+		}
+
+		logger.V(1).Info("retrying kubelet fetch", "attempt", attempt, "delay", delay, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, timeoutError(ctx, otps, fmt.Errorf("retry aborted: %w", err))
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
 }
 
-// fetchDirectFromKubelet call to nodeIP:nodePort/nodePath.
-func fetchMetrics(
+// kubeletTarget returns the client and the URL the kubelet metrics of opts are fetched with,
+// resolving the node address first when needed.
+func kubeletTarget(
 	ctx context.Context, cfg *rest.Config, otps *ServerRunnableOpts, insecureSkipVerify bool,
-) ([]byte, error) {
-	logger := log.FromContext(ctx)
-	nodeIP := otps.NodeNameOrIP
-	if otps.KubeApiserver != "" {
-		nodeIP = otps.KubeApiserver
+) (*http.Client, string, error) {
+	target := otps
+	if otps.nodeAddress != nil && otps.KubeApiserver == "" {
+		address, err := otps.nodeAddress.resolve(ctx)
+		if err != nil {
+			return nil, "", fmt.Errorf("resolve node address: %w", err)
+		}
+		resolved := *otps
+		resolved.NodeNameOrIP = address
+		target = &resolved
 	}
 
-	url := fmt.Sprintf("https://%s:%s%s", nodeIP, otps.NodePort, otps.NodePath)
-	logger.V(1).Info("fetching metrics from", "url", url)
+	var httpClient *http.Client
+	var err error
+	if otps.client != nil {
+		httpClient, err = otps.client.get(cfg, otps, insecureSkipVerify)
+	} else {
+		httpClient, err = newKubeletHTTPClient(cfg, otps, insecureSkipVerify)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return httpClient, kubeletURL(target), nil
+}
 
-	transport, err := rest.TransportFor(cfg)
+// fetchRaw performs a single kubelet request like fetchMetrics, but returns the response unparsed,
+// so its body can be passed on as the kubelet wrote it. accept is sent as the Accept header when set.
+// The caller must close the body, which also ends the opts.FetchTimeout bound.
+func fetchRaw(
+	ctx context.Context, cfg *rest.Config, otps *ServerRunnableOpts, insecureSkipVerify bool, accept string,
+) (*http.Response, error) {
+	httpClient, url, err := kubeletTarget(ctx, cfg, otps, insecureSkipVerify)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create transport from rest.Config: %w", err)
+		return nil, err
+	}
+	cancel := context.CancelFunc(func() {})
+	if otps.FetchTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, otps.FetchTimeout)
 	}
 
-	if insecureSkipVerify {
-		if httpTransport, ok := transport.(*http.Transport); ok {
-			httpTransport.TLSClientConfig.InsecureSkipVerify = true
-		}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("new request: %w", err)
 	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	for name, value := range otps.UpstreamHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, timeoutError(ctx, otps, fmt.Errorf("do request: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return nil, &statusError{code: resp.StatusCode, body: string(b)}
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
 
-	httpClient := &http.Client{Transport: transport}
+// cancelOnClose cancels the context of a response when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// fetchOnce performs a single kubelet request bounded by opts.FetchTimeout.
+func fetchOnce(
+	ctx context.Context, httpClient *http.Client, url string, otps *ServerRunnableOpts,
+) (map[string]*dto.MetricFamily, error) {
+	if otps.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, otps.FetchTimeout)
+		defer cancel()
+	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("new request: %w", err)
 	}
+	// Setting Accept-Encoding disables the transparent decompression of http.Transport,
+	// the body is decompressed below.
+	req.Header.Set("Accept-Encoding", "gzip")
+	// Headers set here take precedence over the credentials the rest transport would add.
+	for name, value := range otps.UpstreamHeaders {
+		req.Header.Set(name, value)
+	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
+		return nil, timeoutError(ctx, otps, fmt.Errorf("do request: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("bad status code: %d, body: %s", resp.StatusCode, string(b))
+		return nil, &statusError{code: resp.StatusCode, body: string(b)}
+	}
+
+	body := io.Reader(resp.Body)
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, timeoutError(ctx, otps, fmt.Errorf("read gzip response: %w", err))
+		}
+		defer gz.Close()
+		body = gz
 	}
 
-	return io.ReadAll(resp.Body)
+	// The limit applies to the decompressed payload.
+	maxBytes := otps.MaxResponseBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxResponseBytes
+	}
+	limited := http.MaxBytesReader(nil, io.NopCloser(body), maxBytes)
+	if otps.LenientParsing {
+		data, err := io.ReadAll(limited)
+		if err != nil {
+			return nil, readError(ctx, otps, maxBytes, err)
+		}
+		return parseLenient(ctx, data, otps)
+	}
+
+	var parser expfmt.TextParser
+	metricFamilies, err := parser.TextToMetricFamilies(limited)
+	if err != nil {
+		return nil, readError(ctx, otps, maxBytes, err)
+	}
+	return metricFamilies, nil
+}
+
+// readError describes an error reading or parsing the kubelet response.
+func readError(ctx context.Context, otps *ServerRunnableOpts, maxBytes int64, err error) error {
+	var parseErr expfmt.ParseError
+	if errors.As(err, &parseErr) {
+		return fmt.Errorf("failed to parse metrics: %w", err)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("kubelet response exceeds the limit of %d bytes: %w", maxBytes, err)
+	}
+	return timeoutError(ctx, otps, fmt.Errorf("read response: %w", err))
+}
+
+// statusError is returned when the kubelet responds with a non-200 status code.
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad status code: %d, body: %s", e.code, e.body)
+}
+
+// retryable reports whether a failed fetch may succeed when retried.
+// Client errors (4xx) are never retried.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= http.StatusInternalServerError
+	}
+	var parseErr expfmt.ParseError
+	var tooLarge *http.MaxBytesError
+	return !errors.As(err, &parseErr) && !errors.As(err, &tooLarge)
 }
 
-// EnrichMetricFamilies enriches metrics with extra labels.
-func EnrichMetricFamilies(metricFamilies map[string]*dto.MetricFamily, nm *NamespaceMetrics) (string, error) {
-	for _, mf := range metricFamilies {
+// kubeletOutcome reports whether err means the kubelet is unreachable or unhealthy,
+// or tells nothing about it, like a fetch given up by the scraper or a response it could not use.
+func kubeletOutcome(ctx context.Context, err error) fetchOutcome {
+	switch {
+	case err == nil:
+		return fetchSucceeded
+	case errors.Is(ctx.Err(), context.Canceled) || !retryable(err):
+		return fetchUnknown
+	default:
+		return fetchFailed
+	}
+}
+
+// timeoutError replaces err with a descriptive context.DeadlineExceeded error when the fetch timed out.
+func timeoutError(ctx context.Context, opts *ServerRunnableOpts, err error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	if opts.FetchTimeout > 0 {
+		return fmt.Errorf("kubelet did not respond within %s: %w", opts.FetchTimeout, context.DeadlineExceeded)
+	}
+	return fmt.Errorf("kubelet did not respond in time: %w", context.DeadlineExceeded)
+}
+
+// kubeletURL builds the URL metrics are fetched from, either the kubelet itself or the kube-apiserver proxy.
+// IPv6 literals are wrapped in brackets. The host of a kubelet reached on its Unix socket is localhost.
+func kubeletURL(opts *ServerRunnableOpts) string {
+	host := opts.NodeNameOrIP
+	if opts.KubeApiserver != "" {
+		host = opts.KubeApiserver
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	scheme := opts.Scheme
+	if scheme == "" {
+		scheme = DefaultScheme
+	}
+
+	if opts.UnixSocketPath != "" {
+		return fmt.Sprintf("%s://localhost%s", scheme, opts.NodePath)
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, opts.NodePort), opts.NodePath)
+}
+
+// EnrichMetricFamilies enriches metrics with extra labels and returns them encoded in the text format.
+// Use EnrichAndEncode to avoid buffering the whole output.
+func EnrichMetricFamilies(
+	ctx context.Context,
+	metricFamilies map[string]*dto.MetricFamily,
+	nm *NamespaceMetrics,
+	opts *ServerRunnableOpts,
+) (string, error) {
+	var sb strings.Builder
+	if err := EnrichAndEncode(ctx, &sb, metricFamilies, nm, opts); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// EnrichAndEncode enriches metrics with extra labels and encodes every family directly to w.
+// The namespace of a metric is read from the opts.NamespaceLabelKey label, "namespace" by default.
+// Labels listed in opts.DropLabels are removed from the kubelet metrics and opts.RenameLabels are renamed
+// before any label is injected.
+// Only namespace labels listed in opts.LabelAllowlist are attached when the allowlist is set,
+// labels listed in opts.LabelDenylist are never attached. Namespace annotations listed in
+// opts.AnnotationAllowlist are attached as well, namespace labels win on a name clash.
+// With opts.NamespaceCreationTime, the creation time of the namespace is attached as namespace_created.
+// Labels listed in opts.PodLabelAllowlist of the pod in the "pod" label are attached next, from opts.PodMetrics,
+// followed by the owner_kind and owner_name of the workload owning the pod when opts.PodOwnerLabels is set.
+// At most opts.MaxInjectedLabels namespace labels, annotations and pod labels are attached to a single metric.
+// With opts.NormalizeLabelValues, their values are trimmed and lowercased, their names are left alone.
+// Injected label names are prefixed with opts.LabelPrefix and sanitized into valid Prometheus label names.
+// When opts.NodeLabelName is set, every metric without that label gets it with opts.NodeNameOrIP as value.
+// The namespace, pod, static and node labels are applied in opts.LabelPrecedence order, the first source
+// attaching a label name wins.
+// When opts.Instance is set, every metric without the kmp_instance label gets it with opts.Instance as value.
+// opts.RelabelConfigs are applied last; families whose metrics were all dropped are omitted.
+// ctx is checked between metric families, the ctx error is returned as soon as it is done.
+func EnrichAndEncode(
+	ctx context.Context,
+	w io.Writer,
+	metricFamilies map[string]*dto.MetricFamily,
+	nm *NamespaceMetrics,
+	opts *ServerRunnableOpts,
+) error {
+	return enrichAndEncode(ctx, w, expfmt.NewFormat(expfmt.TypeTextPlain), metricFamilies, nm, opts)
+}
+
+// enrichAndEncode works like EnrichAndEncode and encodes the output in format.
+func enrichAndEncode(
+	ctx context.Context,
+	w io.Writer,
+	format expfmt.Format,
+	metricFamilies map[string]*dto.MetricFamily,
+	nm *NamespaceMetrics,
+	opts *ServerRunnableOpts,
+) error {
+	start := time.Now()
+	stats, err := enrichInPlace(ctx, metricFamilies, nm, opts)
+	if err != nil {
+		return err
+	}
+
+	names := sortedKeys(metricFamilies)
+
+	encoder := expfmt.NewEncoder(w, format)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		mf := metricFamilies[name]
+		if err := encoder.Encode(mf); err != nil {
+			return fmt.Errorf("failed to encode metric family %q: %w", mf.GetName(), err)
+		}
+	}
+	// Closing writes the trailing "# EOF" of the OpenMetrics format.
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("failed to finish encoding: %w", err)
+		}
+	}
+
+	opts.selfMetrics.observeEnrich(opts.NodePath, start, stats)
+	return nil
+}
+
+// enrichStats counts what enrichInPlace did to the metrics, for the self-metrics.
+type enrichStats struct {
+	// labelsAdded counts the labels added, labelsDropped the namespace labels left out by the cap
+	// and labelsInvalid the labels left out because of an invalid value.
+	labelsAdded, labelsDropped, labelsInvalid int
+	// enriched counts the metrics kept with at least one namespace or pod label, passthrough the other
+	// metrics kept and dropped the metrics removed by OnlyEnriched or the relabel configs.
+	enriched, passthrough, dropped int
+}
+
+// enrichInPlace applies the enrichment described on EnrichAndEncode to metricFamilies.
+// It returns what was enriched, or the ctx error when ctx is done before every family is enriched.
+func enrichInPlace(
+	ctx context.Context,
+	metricFamilies map[string]*dto.MetricFamily,
+	nm *NamespaceMetrics,
+	opts *ServerRunnableOpts,
+) (stats enrichStats, err error) {
+	nsLabelKey := opts.NamespaceLabelKey
+	if nsLabelKey == "" {
+		nsLabelKey = DefaultNamespaceLabelKey
+	}
+	precedence := opts.labelPrecedence()
+	rules := opts.currentRules()
+
+	for name, mf := range metricFamilies {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		kept := mf.Metric[:0]
 		for _, metric := range mf.Metric {
-			var nsValue string
+			var nsValue, podValue string
 
 			for _, lbl := range metric.Label {
-				if lbl.GetName() == "namespace" {
+				switch lbl.GetName() {
+				case nsLabelKey:
 					nsValue = lbl.GetValue()
-					break
+				case DefaultPodLabelKey:
+					podValue = lbl.GetValue()
 				}
 			}
+			if len(opts.DropLabels) > 0 {
+				metric.Label = slices.DeleteFunc(metric.Label, func(lbl *dto.LabelPair) bool {
+					return slices.Contains(opts.DropLabels, lbl.GetName())
+				})
+			}
+			renameLabels(metric, rules.RenameLabels)
 
-			if nsValue != "" {
-				if extraLabels, ok := nm.Namespaces[nsValue]; ok {
-					for k, v := range extraLabels {
-						if hasLabel(metric.Label, k) {
-							continue
-						}
-						newLabel := &dto.LabelPair{
-							Name:  proto.String(k),
-							Value: proto.String(v),
-						}
-						metric.Label = append(metric.Label, newLabel)
+			enrich := nsValue != "" && !rules.namespaceExcluded(nsValue)
+			var nsLabels map[string]string
+			var matched bool
+			if enrich {
+				nsLabels, matched = nm.Get(nsValue)
+			}
+			if opts.OnlyEnriched && !matched {
+				stats.dropped++
+				continue
+			}
+
+			limit := math.MaxInt
+			if opts.MaxInjectedLabels > 0 {
+				limit = opts.MaxInjectedLabels
+			}
+			var injected int
+			inject := func(extra map[string]string, allowed func(string) bool) {
+				added, dropped, invalid := injectLabels(
+					metric, extra, allowed, opts.LabelPrefix, limit, opts.NormalizeLabelValues,
+				)
+				limit -= added
+				injected += added
+				stats.labelsAdded += added
+				stats.labelsDropped += dropped
+				stats.labelsInvalid += invalid
+			}
+			// Sources applied first win, as labels already present are never overwritten.
+			for _, source := range precedence {
+				switch {
+				case source == LabelSourceNamespace && enrich:
+					if matched {
+						inject(nsLabels, rules.labelAllowed)
+					}
+					if annotations, ok := nm.GetAnnotations(nsValue); ok {
+						inject(annotations, rules.annotationAllowed)
+					}
+					if created, ok := nm.get(namespaceCreated, nsValue); ok && opts.NamespaceCreationTime {
+						inject(created, allLabelsAllowed)
+					}
+				case source == LabelSourcePod && enrich:
+					if podLabels, ok := opts.PodMetrics.Get(nsValue, podValue); ok {
+						inject(podLabels, opts.podLabelAllowed)
+					}
+					if owner, ok := opts.PodMetrics.ownerLabels(nsValue, podValue); ok && opts.PodOwnerLabels {
+						inject(owner, allLabelsAllowed)
+					}
+				case source == LabelSourceStatic:
+					stats.labelsAdded += addStaticLabels(metric, opts.StaticLabels)
+				case source == LabelSourceNode:
+					if opts.NodeLabelName != "" && !hasLabel(metric.Label, opts.NodeLabelName) {
+						metric.Label = append(metric.Label, &dto.LabelPair{
+							Name:  proto.String(opts.NodeLabelName),
+							Value: proto.String(opts.NodeNameOrIP),
+						})
+						stats.labelsAdded++
 					}
 				}
 			}
+			if opts.Instance != "" && !hasLabel(metric.Label, InstanceLabelName) {
+				metric.Label = append(metric.Label, &dto.LabelPair{
+					Name:  proto.String(InstanceLabelName),
+					Value: proto.String(opts.Instance),
+				})
+				stats.labelsAdded++
+			}
+
+			if opts.StripTimestamps {
+				metric.TimestampMs = nil
+			}
+
+			if !relabel.Relabel(name, metric, opts.RelabelConfigs) {
+				stats.dropped++
+				continue
+			}
+			dedupeLabels(metric)
+			normalizeChildren(mf.GetType(), metric)
+			kept = append(kept, metric)
+			if injected > 0 {
+				stats.enriched++
+			} else {
+				stats.passthrough++
+			}
+		}
+		mf.Metric = kept
+		if len(mf.Metric) == 0 {
+			delete(metricFamilies, name)
 		}
 	}
+	return stats, nil
+}
 
-	var sb strings.Builder
-	encoder := expfmt.NewEncoder(&sb, expfmt.NewFormat(expfmt.TypeTextPlain))
-	for _, mf := range metricFamilies {
-		if err := encoder.Encode(mf); err != nil {
-			return "", fmt.Errorf("failed to encode metric family %q: %w", mf.GetName(), err)
+// injectLabels appends up to limit allowed extra labels to the metric in key order, skipping names it already has.
+// Values that are not validLabelValue are skipped, as some scrapers reject them.
+// With normalize, values are trimmed and lowercased before they are attached.
+// It returns the number of labels added, the number of allowed labels dropped because of the limit
+// and the number of labels skipped because of their value.
+func injectLabels(
+	metric *dto.Metric, extra map[string]string, allowed func(string) bool, prefix string, limit int, normalize bool,
+) (added, dropped, invalid int) {
+	for _, k := range sortedKeys(extra) {
+		if !allowed(k) {
+			continue
+		}
+		name := SanitizeLabelName(prefix + k)
+		if hasLabel(metric.Label, name) {
+			continue
+		}
+		value := extra[k]
+		if !validLabelValue(value) {
+			invalid++
+			continue
+		}
+		if added >= limit {
+			dropped++
+			continue
+		}
+		if normalize {
+			value = strings.ToLower(strings.TrimSpace(value))
+		}
+		newLabel := &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(value),
 		}
+		metric.Label = append(metric.Label, newLabel)
+		added++
 	}
+	return added, dropped, invalid
+}
 
-	return sb.String(), nil
+// validLabelValue reports whether v is valid UTF-8 without control characters other than newlines,
+// which the encoders escape. Other control characters, such as NUL, are written as is and break parsers.
+func validLabelValue(v string) bool {
+	if !utf8.ValidString(v) {
+		return false
+	}
+	for _, r := range v {
+		if r != '\n' && unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// renameLabels renames the labels of metric according to renames, old name to new name.
+// A label is left alone when the metric already has a label with the new name.
+func renameLabels(metric *dto.Metric, renames map[string]string) {
+	if len(renames) == 0 {
+		return
+	}
+	for _, lbl := range metric.Label {
+		newName, ok := renames[lbl.GetName()]
+		if !ok || hasLabel(metric.Label, newName) {
+			continue
+		}
+		lbl.Name = proto.String(newName)
+	}
+}
+
+// dedupeLabels collapses labels of metric sharing a name, which Prometheus rejects.
+// The last value wins and is kept at the position of the first label.
+// Metrics carry few labels, comparing pairs avoids allocating on every metric.
+func dedupeLabels(metric *dto.Metric) {
+	labels := metric.Label
+	for i := 1; i < len(labels); i++ {
+		for j := 0; j < i; j++ {
+			if labels[j].GetName() == labels[i].GetName() {
+				labels[j].Value = labels[i].Value
+				labels = slices.Delete(labels, i, i+1)
+				i--
+				break
+			}
+		}
+	}
+	metric.Label = labels
+}
+
+// normalizeChildren keeps the le and quantile labels of histogram and summary series intact.
+// The encoders write them after the labels of the metric, so a label of that name injected by
+// enrichment would duplicate them and is removed. Buckets and quantiles are sorted in ascending order,
+// as some parsers expect, in case the kubelet response listed them otherwise.
+func normalizeChildren(typ dto.MetricType, metric *dto.Metric) {
+	switch typ {
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		metric.Label = slices.DeleteFunc(metric.Label, func(lbl *dto.LabelPair) bool {
+			return lbl.GetName() == model.BucketLabel
+		})
+		if h := metric.GetHistogram(); h != nil {
+			slices.SortStableFunc(h.Bucket, func(a, b *dto.Bucket) int {
+				return cmp.Compare(a.GetUpperBound(), b.GetUpperBound())
+			})
+		}
+	case dto.MetricType_SUMMARY:
+		metric.Label = slices.DeleteFunc(metric.Label, func(lbl *dto.LabelPair) bool {
+			return lbl.GetName() == model.QuantileLabel
+		})
+		if s := metric.GetSummary(); s != nil {
+			slices.SortStableFunc(s.Quantile, func(a, b *dto.Quantile) int {
+				return cmp.Compare(a.GetQuantile(), b.GetQuantile())
+			})
+		}
+	}
+}
+
+// addStaticLabels adds the labels to metric in key order, skipping those it already has.
+// It returns the number of labels added.
+func addStaticLabels(metric *dto.Metric, labels map[string]string) int {
+	if len(labels) == 0 {
+		return 0
+	}
+	added := 0
+	for _, name := range sortedKeys(labels) {
+		if hasLabel(metric.Label, name) {
+			continue
+		}
+		metric.Label = append(metric.Label, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(labels[name]),
+		})
+		added++
+	}
+	return added
+}
+
+// podLabelAllowed reports whether the pod label key may be attached to metrics.
+func (o *ServerRunnableOpts) podLabelAllowed(key string) bool {
+	return slices.Contains(o.PodLabelAllowlist, key)
+}
+
+func allLabelsAllowed(string) bool { return true }
+
+// SanitizeLabelName converts a Kubernetes label key into a valid Prometheus label name
+// matching [a-zA-Z_][a-zA-Z0-9_]*. Every run of invalid characters is replaced with a
+// single underscore and a leading digit is prefixed with an underscore.
+func SanitizeLabelName(name string) string {
+	var sb strings.Builder
+	sb.Grow(len(name) + 1)
+	inInvalidRun := false
+	for i, r := range name {
+		switch {
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+		default:
+			if !inInvalidRun {
+				sb.WriteByte('_')
+			}
+			inInvalidRun = true
+			continue
+		}
+		inInvalidRun = false
+		sb.WriteRune(r)
+	}
+	return sb.String()
 }
 
 func hasLabel(labels []*dto.LabelPair, name string) bool {
@@ -174,3 +1136,12 @@ func hasLabel(labels []*dto.LabelPair, name string) bool {
 	}
 	return false
 }
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
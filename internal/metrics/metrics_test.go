@@ -0,0 +1,1216 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/relabel"
+)
+
+const testKubeletMetrics = `# HELP container_cpu_usage_seconds_total Cumulative cpu time consumed.
+# TYPE container_cpu_usage_seconds_total counter
+container_cpu_usage_seconds_total{container="app",namespace="frontend",pod="app-1"} 12.5
+container_cpu_usage_seconds_total{container="app",namespace="backend",pod="app-2"} 3
+# HELP container_memory_working_set_bytes Current working set.
+# TYPE container_memory_working_set_bytes gauge
+container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1"} 1024
+# HELP kubelet_running_pods Number of running pods.
+# TYPE kubelet_running_pods gauge
+kubelet_running_pods 2
+`
+
+func parseTestMetrics(t *testing.T, text string) map[string]*dto.MetricFamily {
+	t.Helper()
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("parse metrics: %v", err)
+	}
+	return mfs
+}
+
+func TestMergeMetricFamilies(t *testing.T) {
+	merged := map[string]*dto.MetricFamily{}
+	for _, text := range []string{
+		"# TYPE kubelet_running_pods gauge\nkubelet_running_pods{node=\"worker-1\"} 2\n",
+		"# HELP kubelet_running_pods Number of running pods.\n# TYPE kubelet_running_pods gauge\n" +
+			"kubelet_running_pods{node=\"worker-2\"} 3\n",
+	} {
+		for _, mf := range parseTestMetrics(t, text) {
+			if !mergeMetricFamily(merged, mf) {
+				t.Fatalf("merging %s failed", mf.GetName())
+			}
+		}
+	}
+	conflicting := parseTestMetrics(t, "# TYPE kubelet_running_pods counter\nkubelet_running_pods 1\n")
+	if mergeMetricFamily(merged, conflicting["kubelet_running_pods"]) {
+		t.Error("family with a conflicting type was merged")
+	}
+
+	out, err := EnrichMetricFamilies(context.Background(), merged, NewNamespaceMetrics(), &ServerRunnableOpts{})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	want := `# HELP kubelet_running_pods Number of running pods.
+# TYPE kubelet_running_pods gauge
+kubelet_running_pods{node="worker-1"} 2
+kubelet_running_pods{node="worker-2"} 3
+`
+	if out != want {
+		t.Errorf("merged output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestEnrichMetricFamiliesDeterministicOutput(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend", "tier": "web"})
+
+	first, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, &ServerRunnableOpts{})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		next, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, &ServerRunnableOpts{})
+		if err != nil {
+			t.Fatalf("enrich: %v", err)
+		}
+		if next != first {
+			t.Fatalf("output differs between runs:\n%s\n---\n%s", first, next)
+		}
+	}
+}
+
+func TestEnrichMetricFamiliesLabelFilters(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend", "tier": "web", "owner": "alice"})
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		denylist  []string
+		want      []string
+		wantNot   []string
+	}{
+		{
+			name: "empty allowlist attaches all labels",
+			want: []string{`team="frontend"`, `tier="web"`, `owner="alice"`},
+		},
+		{
+			name:      "allowlist restricts labels",
+			allowlist: []string{"team"},
+			want:      []string{`team="frontend"`},
+			wantNot:   []string{`tier="web"`, `owner="alice"`},
+		},
+		{
+			name:     "denylist drops labels",
+			denylist: []string{"owner"},
+			want:     []string{`team="frontend"`, `tier="web"`},
+			wantNot:  []string{`owner="alice"`},
+		},
+		{
+			name:      "denylist applies to allowlist survivors",
+			allowlist: []string{"team", "tier"},
+			denylist:  []string{"tier"},
+			want:      []string{`team="frontend"`},
+			wantNot:   []string{`tier="web"`, `owner="alice"`},
+		},
+		{
+			name:      "key in both lists is dropped",
+			allowlist: []string{"team"},
+			denylist:  []string{"team"},
+			wantNot:   []string{`team="frontend"`, `tier="web"`, `owner="alice"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm,
+				&ServerRunnableOpts{LabelAllowlist: tt.allowlist, LabelDenylist: tt.denylist})
+			if err != nil {
+				t.Fatalf("enrich: %v", err)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("expected output to contain %s:\n%s", s, out)
+				}
+			}
+			for _, s := range tt.wantNot {
+				if strings.Contains(out, s) {
+					t.Errorf("expected output not to contain %s:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
+
+func TestEnrichMetricFamiliesLabelPrefix(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend", "pod": "from-namespace"})
+
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm,
+		&ServerRunnableOpts{LabelPrefix: "ns_"})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	for _, s := range []string{`ns_team="frontend"`, `ns_pod="from-namespace"`, `pod="app-1"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected output to contain %s:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, `,team="frontend"`) {
+		t.Errorf("expected unprefixed team label to be absent:\n%s", out)
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "app.kubernetes.io/name", want: "app_kubernetes_io_name"},
+		{in: "123abc", want: "_123abc"},
+		{in: "team", want: "team"},
+		{in: "cost_center_2", want: "cost_center_2"},
+		{in: "example.com/-owner", want: "example_com_owner"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := SanitizeLabelName(tt.in); got != tt.want {
+				t.Errorf("SanitizeLabelName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnrichMetricFamiliesAnnotations(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	nm.SetAnnotations("frontend", map[string]string{
+		"example.com/cost-center": "cc-42",
+		"example.com/notes":       "free text",
+	})
+
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm,
+		&ServerRunnableOpts{AnnotationAllowlist: []string{"example.com/cost-center"}})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	for _, s := range []string{`team="frontend"`, `example_com_cost_center="cc-42"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected output to contain %s:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "example_com_notes") {
+		t.Errorf("expected non-allowlisted annotation to be dropped:\n%s", out)
+	}
+}
+
+func TestEnrichMetricFamiliesNamespaceLabelKey(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+
+	const input = `# TYPE kube_pod_info gauge
+kube_pod_info{pod="app-1",pod_namespace="frontend"} 1
+`
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, input), nm,
+		&ServerRunnableOpts{NamespaceLabelKey: "pod_namespace"})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if !strings.Contains(out, `team="frontend"`) {
+		t.Errorf("expected output to contain team label:\n%s", out)
+	}
+}
+
+// largeCadvisorPayload builds a cadvisor-like payload of roughly the given size.
+func TestEnrichMetricFamiliesNodeLabel(t *testing.T) {
+	opts := &ServerRunnableOpts{NodeNameOrIP: "worker-1", NodeLabelName: "node"}
+	mfs := parseTestMetrics(t, testKubeletMetrics+`# TYPE kubelet_node_name gauge
+kubelet_node_name{node="worker-2"} 1
+`)
+	out, err := EnrichMetricFamilies(context.Background(), mfs, NewNamespaceMetrics(), opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	for _, want := range []string{
+		`kubelet_running_pods{node="worker-1"} 2`,
+		`container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",node="worker-1"} 1024`,
+		// An existing node label is left alone.
+		`kubelet_node_name{node="worker-2"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %s:\n%s", want, out)
+		}
+	}
+
+	out, err = EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), NewNamespaceMetrics(),
+		&ServerRunnableOpts{NodeNameOrIP: "worker-1"})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if strings.Contains(out, "worker-1") {
+		t.Errorf("node label added with an empty NodeLabelName:\n%s", out)
+	}
+}
+
+func TestEnrichMetricFamiliesMaxInjectedLabels(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"})
+	nm.SetAnnotations("frontend", map[string]string{"example.com/owner": "alice"})
+
+	opts := &ServerRunnableOpts{
+		MaxInjectedLabels:   2,
+		AnnotationAllowlist: []string{"example.com/owner"},
+		selfMetrics:         newProxyMetrics(nil),
+	}
+	mfs := parseTestMetrics(t, testKubeletMetrics)
+	out, err := EnrichMetricFamilies(context.Background(), mfs, nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	want := `container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",a="1",b="2"} 1024`
+	if !strings.Contains(out, want) {
+		t.Errorf("expected only the first two labels in key order:\n%s", out)
+	}
+	// Two frontend series, each losing c, d and the annotation.
+	if got := testutil.ToFloat64(opts.selfMetrics.labelsDropped.WithLabelValues("")); got != 6 {
+		t.Errorf("dropped labels = %v, want 6", got)
+	}
+}
+
+func TestEnrichMetricFamiliesNormalizeLabelValues(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"Team": " FrontEnd ", "tier": "Web"})
+	nm.Set("backend", map[string]string{"Team": "frontend"})
+
+	opts := &ServerRunnableOpts{NormalizeLabelValues: true}
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	for _, want := range []string{
+		`container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",Team="frontend",tier="web"} 1024`,
+		`container_cpu_usage_seconds_total{container="app",namespace="backend",pod="app-2",Team="frontend"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %s:\n%s", want, out)
+		}
+	}
+
+	opts.NormalizeLabelValues = false
+	out, err = EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if want := `Team=" FrontEnd ",tier="Web"`; !strings.Contains(out, want) {
+		t.Errorf("values changed without NormalizeLabelValues, want %s:\n%s", want, out)
+	}
+}
+
+func TestEnrichMetricFamiliesSkipsInvalidLabelValues(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "front\x00end", "tier": "web"})
+
+	opts := &ServerRunnableOpts{selfMetrics: newProxyMetrics(nil)}
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	want := `container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",tier="web"} 1024`
+	if !strings.Contains(out, want) {
+		t.Errorf("expected the label with a NUL byte to be skipped:\n%s", out)
+	}
+	parseTestMetrics(t, out)
+	// Two frontend series.
+	if got := testutil.ToFloat64(opts.selfMetrics.invalidValues.WithLabelValues("")); got != 2 {
+		t.Errorf("invalid label values = %v, want 2", got)
+	}
+}
+
+func TestEnrichMetricFamiliesDropLabels(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"pod": "from-namespace", "team": "frontend"})
+
+	opts := &ServerRunnableOpts{DropLabels: []string{"pod", "namespace"}}
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	// The namespace is read before dropping and the injected pod label survives.
+	want := `container_memory_working_set_bytes{container="app",pod="from-namespace",team="frontend"} 1024`
+	if !strings.Contains(out, want) {
+		t.Errorf("expected %s in output:\n%s", want, out)
+	}
+	if strings.Contains(out, `pod="app-`) || strings.Contains(out, `namespace="`) {
+		t.Errorf("dropped labels are still present:\n%s", out)
+	}
+}
+
+func TestEnrichMetricFamiliesRenameLabels(t *testing.T) {
+	mfs := parseTestMetrics(t, testKubeletMetrics+`# TYPE container_start_time_seconds gauge
+container_start_time_seconds{container="app",container_name="legacy",namespace="frontend"} 1
+`)
+	opts := &ServerRunnableOpts{RenameLabels: map[string]string{"container": "container_name"}}
+	out, err := EnrichMetricFamilies(context.Background(), mfs, NewNamespaceMetrics(), opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	for _, want := range []string{
+		`container_memory_working_set_bytes{container_name="app",namespace="frontend",pod="app-1"} 1024`,
+		// The rename is skipped when the new name is taken.
+		`container_start_time_seconds{container="app",container_name="legacy",namespace="frontend"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestEnrichMetricFamiliesExcludeNamespaces(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	nm.Set("backend", map[string]string{"team": "backend"})
+	nm.SetAnnotations("backend", map[string]string{"example.com/owner": "bob"})
+
+	opts := &ServerRunnableOpts{
+		ExcludeNamespaces:   []string{"backend"},
+		AnnotationAllowlist: []string{"example.com/owner"},
+	}
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	for _, want := range []string{
+		`container_cpu_usage_seconds_total{container="app",namespace="backend",pod="app-2"} 3`,
+		`container_cpu_usage_seconds_total{container="app",namespace="frontend",pod="app-1",team="frontend"} 12.5`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in output:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `team="backend"`) || strings.Contains(out, "bob") {
+		t.Errorf("labels of an excluded namespace were injected:\n%s", out)
+	}
+}
+
+func TestEnrichMetricFamiliesOnlyEnriched(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+
+	for _, onlyEnriched := range []bool{false, true} {
+		out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm,
+			&ServerRunnableOpts{OnlyEnriched: onlyEnriched})
+		if err != nil {
+			t.Fatalf("enrich: %v", err)
+		}
+
+		want := `container_cpu_usage_seconds_total{container="app",namespace="frontend",pod="app-1",team="frontend"} 12.5`
+		if !strings.Contains(out, want) {
+			t.Errorf("onlyEnriched=%v: expected %s in output:\n%s", onlyEnriched, want, out)
+		}
+		// backend is not stored and kubelet_running_pods has no namespace.
+		for _, unmatched := range []string{`namespace="backend"`, "kubelet_running_pods"} {
+			if got := strings.Contains(out, unmatched); got == onlyEnriched {
+				t.Errorf("onlyEnriched=%v: output contains %s = %v:\n%s", onlyEnriched, unmatched, got, out)
+			}
+		}
+	}
+}
+
+func TestEnrichMetricFamiliesInstanceLabel(t *testing.T) {
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), NewNamespaceMetrics(),
+		&ServerRunnableOpts{Instance: "kubelet-meta-proxy-7d9f"})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	for _, want := range []string{
+		`kubelet_running_pods{kmp_instance="kubelet-meta-proxy-7d9f"} 2`,
+		`container_cpu_usage_seconds_total{container="app",namespace="backend",pod="app-2",kmp_instance="kubelet-meta-proxy-7d9f"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %s:\n%s", want, out)
+		}
+	}
+
+	out, err = EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), NewNamespaceMetrics(),
+		&ServerRunnableOpts{})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if strings.Contains(out, InstanceLabelName) {
+		t.Errorf("instance label added with an empty Instance:\n%s", out)
+	}
+}
+
+func TestEnrichMetricFamiliesStaticLabels(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+
+	mfs := parseTestMetrics(t, testKubeletMetrics+`# TYPE federated_up gauge
+federated_up{cluster="prod-us"} 1
+`)
+	opts := &ServerRunnableOpts{StaticLabels: map[string]string{"cluster": "prod-eu", "region": "eu-west-1"}}
+	out, err := EnrichMetricFamilies(context.Background(), mfs, nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	for _, want := range []string{
+		`container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",team="frontend",cluster="prod-eu",region="eu-west-1"} 1024`,
+		`kubelet_running_pods{cluster="prod-eu",region="eu-west-1"} 2`,
+		// An existing label is left alone.
+		`federated_up{cluster="prod-us",region="eu-west-1"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestEnrichMetricFamiliesLabelPrecedence(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "from-namespace"})
+	pm := NewPodMetrics()
+	pm.Set("frontend", "app-1", map[string]string{"team": "from-pod"})
+
+	tests := []struct {
+		name       string
+		precedence []string
+		want       string
+	}{
+		{name: "default", want: `team="from-namespace",node="from-static"`},
+		{name: "pod first", precedence: []string{LabelSourcePod}, want: `team="from-pod",node="from-static"`},
+		{
+			name:       "static first",
+			precedence: []string{LabelSourceStatic, LabelSourceNamespace},
+			want:       `node="from-static",team="from-static"`,
+		},
+		{
+			name:       "node before static",
+			precedence: []string{LabelSourceNode, LabelSourcePod},
+			want:       `node="worker-1",team="from-pod"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &ServerRunnableOpts{
+				PodMetrics:        pm,
+				PodLabelAllowlist: []string{"team"},
+				StaticLabels:      map[string]string{"team": "from-static", "node": "from-static"},
+				NodeNameOrIP:      "worker-1",
+				NodeLabelName:     "node",
+				LabelPrecedence:   tt.precedence,
+			}
+			out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+			if err != nil {
+				t.Fatalf("enrich: %v", err)
+			}
+			want := `container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",` + tt.want + `} 1024`
+			if !strings.Contains(out, want) {
+				t.Errorf("expected %s in output:\n%s", want, out)
+			}
+		})
+	}
+
+	if err := (&ServerRunnableOpts{LabelPrecedence: []string{"cluster"}}).Validate(); err == nil {
+		t.Error("expected Validate to reject an unknown label source")
+	}
+	if err := (&ServerRunnableOpts{LabelPrecedence: []string{"pod", "pod"}}).Validate(); err == nil {
+		t.Error("expected Validate to reject a repeated label source")
+	}
+}
+
+func TestEnrichMetricFamiliesDedupesLabels(t *testing.T) {
+	mfs := parseTestMetrics(t, `# TYPE kubelet_running_pods gauge
+kubelet_running_pods{node="worker-1"} 2
+`)
+	metric := mfs["kubelet_running_pods"].Metric[0]
+	metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String("node"), Value: proto.String("worker-2")})
+
+	out, err := EnrichMetricFamilies(context.Background(), mfs, NewNamespaceMetrics(), &ServerRunnableOpts{})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if want := `kubelet_running_pods{node="worker-2"} 2`; !strings.Contains(out, want) {
+		t.Errorf("expected %s in output:\n%s", want, out)
+	}
+	if n := strings.Count(out, "node="); n != 1 {
+		t.Errorf("node label appears %d times:\n%s", n, out)
+	}
+}
+
+func TestEnrichMetricFamiliesTimestamps(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	const input = `# TYPE container_last_seen gauge
+container_last_seen{container="app",namespace="frontend"} 1.7e+09 1700000000000
+`
+
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, input), nm, &ServerRunnableOpts{})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if want := `container_last_seen{container="app",namespace="frontend",team="frontend"} 1.7e+09 1700000000000`; !strings.Contains(out, want) {
+		t.Errorf("expected the timestamp to be kept, want %s in:\n%s", want, out)
+	}
+
+	out, err = EnrichMetricFamilies(context.Background(), parseTestMetrics(t, input), nm, &ServerRunnableOpts{StripTimestamps: true})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if want := `container_last_seen{container="app",namespace="frontend",team="frontend"} 1.7e+09` + "\n"; !strings.Contains(out, want) {
+		t.Errorf("expected the timestamp to be stripped, want %q in:\n%s", want, out)
+	}
+}
+
+func TestFilterMetricFamilies(t *testing.T) {
+	tests := []struct {
+		name string
+		keep []string
+		drop []string
+		want []string
+	}{
+		{
+			name: "no filters keep everything",
+			want: []string{"container_cpu_usage_seconds_total", "container_memory_working_set_bytes", "kubelet_running_pods"},
+		},
+		{
+			name: "keep only",
+			keep: []string{"container_cpu_.*", "container_memory_.*"},
+			want: []string{"container_cpu_usage_seconds_total", "container_memory_working_set_bytes"},
+		},
+		{
+			name: "keep is anchored",
+			keep: []string{"cpu"},
+			want: []string{},
+		},
+		{
+			name: "drop only",
+			drop: []string{"kubelet_.*"},
+			want: []string{"container_cpu_usage_seconds_total", "container_memory_working_set_bytes"},
+		},
+		{
+			name: "keep takes precedence over drop",
+			keep: []string{"container_.*"},
+			drop: []string{"container_memory_.*", "kubelet_.*"},
+			want: []string{"container_cpu_usage_seconds_total", "container_memory_working_set_bytes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mfs := parseTestMetrics(t, testKubeletMetrics)
+			opts := &ServerRunnableOpts{MetricNameKeep: tt.keep, MetricNameDrop: tt.drop}
+			if err := filterMetricFamilies(mfs, opts); err != nil {
+				t.Fatalf("filter: %v", err)
+			}
+
+			got := sortedKeys(mfs)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("families = %v, want %v", got, tt.want)
+			}
+
+			out, err := EnrichMetricFamilies(context.Background(), mfs, NewNamespaceMetrics(), opts)
+			if err != nil {
+				t.Fatalf("enrich: %v", err)
+			}
+			if strings.Contains(out, "kubelet_running_pods") != slices.Contains(tt.want, "kubelet_running_pods") {
+				t.Errorf("unexpected kubelet_running_pods presence in output:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestFilterMetricFamiliesPreset(t *testing.T) {
+	tests := []struct {
+		name string
+		keep []string
+		drop []string
+		want []string
+	}{
+		{
+			name: "preset keeps its families only",
+			want: []string{"container_cpu_usage_seconds_total", "container_memory_working_set_bytes"},
+		},
+		{
+			name: "drop removes families from the preset",
+			drop: []string{"container_memory_.*"},
+			want: []string{"container_cpu_usage_seconds_total"},
+		},
+		{
+			name: "keep replaces the preset",
+			keep: []string{"kubelet_.*"},
+			want: []string{"kubelet_running_pods"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mfs := parseTestMetrics(t, testKubeletMetrics)
+			opts := &ServerRunnableOpts{Preset: PresetResourceBasic, MetricNameKeep: tt.keep, MetricNameDrop: tt.drop}
+			if err := filterMetricFamilies(mfs, opts); err != nil {
+				t.Fatalf("filter: %v", err)
+			}
+			if got := sortedKeys(mfs); !slices.Equal(got, tt.want) {
+				t.Fatalf("families = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := (&ServerRunnableOpts{Preset: "unknown"}).Validate(); err == nil {
+		t.Fatal("expected Validate to reject an unknown preset")
+	}
+}
+
+func TestFilterMetricFamiliesInvalidRegex(t *testing.T) {
+	opts := &ServerRunnableOpts{MetricNameDrop: []string{"container_("}}
+	if err := filterMetricFamilies(parseTestMetrics(t, testKubeletMetrics), opts); err == nil {
+		t.Fatal("expected an error for an invalid regex")
+	}
+	if err := opts.Validate(); err == nil {
+		t.Fatal("expected Validate to reject an invalid regex")
+	}
+}
+
+func TestEnrichMetricFamiliesRelabel(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+
+	opts := &ServerRunnableOpts{RelabelConfigs: []relabel.RelabelConfig{
+		{SourceLabels: []string{"team"}, Regex: relabel.MustNewRegexp("frontend"), Action: relabel.Keep},
+		{
+			SourceLabels: []string{"pod"},
+			Regex:        relabel.MustNewRegexp("(.+)-[0-9]+"),
+			TargetLabel:  "workload",
+			Replacement:  "$1",
+			Action:       relabel.Replace,
+		},
+	}}
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	if strings.Contains(out, `namespace="backend"`) {
+		t.Errorf("backend series survived the keep rule:\n%s", out)
+	}
+	if strings.Contains(out, "kubelet_running_pods") {
+		t.Errorf("family without kept metrics was not omitted:\n%s", out)
+	}
+	if !strings.Contains(out, `workload="app"`) {
+		t.Errorf("replace rule did not add the workload label:\n%s", out)
+	}
+}
+
+func TestEnrichMetricFamiliesCountsMetricResults(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+
+	opts := &ServerRunnableOpts{
+		RelabelConfigs: []relabel.RelabelConfig{
+			{SourceLabels: []string{"pod"}, Regex: relabel.MustNewRegexp("app-2"), Action: relabel.Drop},
+		},
+		selfMetrics: newProxyMetrics(nil),
+	}
+	if _, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts); err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	// Two frontend series, kubelet_running_pods without a namespace and the backend series dropped by the rule.
+	for result, want := range map[string]float64{"enriched": 2, "passthrough": 1, "dropped": 1} {
+		if got := testutil.ToFloat64(opts.selfMetrics.metrics.WithLabelValues("", result)); got != want {
+			t.Errorf("kmp_metrics_total{result=%q} = %v, want %v", result, got, want)
+		}
+	}
+}
+
+const testHistogramMetrics = `# HELP apiserver_request_duration_seconds Request latency.
+# TYPE apiserver_request_duration_seconds histogram
+apiserver_request_duration_seconds_bucket{namespace="frontend",verb="GET",le="1"} 5
+apiserver_request_duration_seconds_bucket{namespace="frontend",verb="GET",le="0.1"} 2
+apiserver_request_duration_seconds_bucket{namespace="frontend",verb="GET",le="+Inf"} 6
+apiserver_request_duration_seconds_sum{namespace="frontend",verb="GET"} 4.5
+apiserver_request_duration_seconds_count{namespace="frontend",verb="GET"} 6
+# HELP rpc_duration_seconds RPC latency.
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{namespace="frontend",quantile="0.99"} 0.3
+rpc_duration_seconds{namespace="frontend",quantile="0.5"} 0.1
+rpc_duration_seconds_sum{namespace="frontend"} 12
+rpc_duration_seconds_count{namespace="frontend"} 40
+`
+
+func TestEnrichMetricFamiliesHistogramsAndSummaries(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	// Namespace labels clashing with the bucket and quantile labels must not corrupt them.
+	nm.Set("frontend", map[string]string{"team": "frontend", "le": "oops", "quantile": "oops"})
+
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testHistogramMetrics), nm, &ServerRunnableOpts{})
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	want := `# HELP apiserver_request_duration_seconds Request latency.
+# TYPE apiserver_request_duration_seconds histogram
+apiserver_request_duration_seconds_bucket{namespace="frontend",verb="GET",quantile="oops",team="frontend",le="0.1"} 2
+apiserver_request_duration_seconds_bucket{namespace="frontend",verb="GET",quantile="oops",team="frontend",le="1"} 5
+apiserver_request_duration_seconds_bucket{namespace="frontend",verb="GET",quantile="oops",team="frontend",le="+Inf"} 6
+apiserver_request_duration_seconds_sum{namespace="frontend",verb="GET",quantile="oops",team="frontend"} 4.5
+apiserver_request_duration_seconds_count{namespace="frontend",verb="GET",quantile="oops",team="frontend"} 6
+# HELP rpc_duration_seconds RPC latency.
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{namespace="frontend",le="oops",team="frontend",quantile="0.5"} 0.1
+rpc_duration_seconds{namespace="frontend",le="oops",team="frontend",quantile="0.99"} 0.3
+rpc_duration_seconds_sum{namespace="frontend",le="oops",team="frontend"} 12
+rpc_duration_seconds_count{namespace="frontend",le="oops",team="frontend"} 40
+`
+	if out != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", out, want)
+	}
+
+	// The output parses back into the same buckets and quantiles.
+	families := parseTestMetrics(t, out)
+	histogram := families["apiserver_request_duration_seconds"].Metric[0].GetHistogram()
+	if got := len(histogram.Bucket); got != 3 || histogram.GetSampleCount() != 6 {
+		t.Errorf("histogram = %v", histogram)
+	}
+	summary := families["rpc_duration_seconds"].Metric[0].GetSummary()
+	if got := len(summary.Quantile); got != 2 || summary.Quantile[1].GetValue() != 0.3 {
+		t.Errorf("summary = %v", summary)
+	}
+}
+
+func TestEnrichMetricFamiliesNamespaceCreationTime(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.SetCreated("frontend", time.Unix(1_700_000_000, 0))
+
+	for _, enabled := range []bool{false, true} {
+		opts := &ServerRunnableOpts{NamespaceCreationTime: enabled, LabelPrefix: "ns_"}
+		out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+		if err != nil {
+			t.Fatalf("enrich: %v", err)
+		}
+		want := `container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",` +
+			`ns_namespace_created="1700000000"} 1024`
+		if got := strings.Contains(out, want); got != enabled {
+			t.Errorf("NamespaceCreationTime=%v: label attached = %v:\n%s", enabled, got, out)
+		}
+	}
+}
+
+func TestEnrichMetricFamiliesWithPodLabels(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	pm := NewPodMetrics()
+	pm.Set("frontend", "app-1", map[string]string{"app": "web", "team": "payments", "pod-template-hash": "5d8f"})
+	// A pod of the same name in another namespace must not match.
+	pm.Set("other", "app-2", map[string]string{"app": "other"})
+
+	opts := &ServerRunnableOpts{PodMetrics: pm, PodLabelAllowlist: []string{"app", "team"}}
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	// Namespace labels win on a name clash, pod labels outside the allowlist are not attached.
+	want := `# HELP container_cpu_usage_seconds_total Cumulative cpu time consumed.
+# TYPE container_cpu_usage_seconds_total counter
+container_cpu_usage_seconds_total{container="app",namespace="frontend",pod="app-1",team="frontend",app="web"} 12.5
+container_cpu_usage_seconds_total{container="app",namespace="backend",pod="app-2"} 3
+# HELP container_memory_working_set_bytes Current working set.
+# TYPE container_memory_working_set_bytes gauge
+container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",team="frontend",app="web"} 1024
+# HELP kubelet_running_pods Number of running pods.
+# TYPE kubelet_running_pods gauge
+kubelet_running_pods 2
+`
+	if out != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", out, want)
+	}
+
+	// Without the allowlist pod labels are disabled.
+	opts = &ServerRunnableOpts{PodMetrics: pm}
+	out, err = EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), nm, opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if strings.Contains(out, `app="web"`) {
+		t.Errorf("pod labels attached without an allowlist:\n%s", out)
+	}
+}
+
+func TestEnrichMetricFamiliesWithPodOwner(t *testing.T) {
+	pm := NewPodMetrics()
+	pm.SetOwner("frontend", "app-1", PodOwner{Kind: "Deployment", Name: "app"})
+
+	opts := &ServerRunnableOpts{PodMetrics: pm, PodOwnerLabels: true}
+	out, err := EnrichMetricFamilies(context.Background(), parseTestMetrics(t, testKubeletMetrics), NewNamespaceMetrics(), opts)
+	if err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+	if want := `container_memory_working_set_bytes{container="app",namespace="frontend",pod="app-1",` +
+		`owner_kind="Deployment",owner_name="app"} 1024`; !strings.Contains(out, want) {
+		t.Errorf("output lacks %s:\n%s", want, out)
+	}
+	// A pod without a stored owner gets neither label.
+	if want := `container_cpu_usage_seconds_total{container="app",namespace="backend",pod="app-2"} 3`; !strings.Contains(out, want) {
+		t.Errorf("output lacks %s:\n%s", want, out)
+	}
+}
+
+// testExemplarMetrics returns a counter and a histogram carrying exemplars, which only the protobuf format can hold.
+func testExemplarMetrics() []*dto.MetricFamily {
+	ts := timestamppb.New(time.Unix(1_700_000_000, 0))
+	namespace := []*dto.LabelPair{{Name: proto.String("namespace"), Value: proto.String("frontend")}}
+	return []*dto.MetricFamily{
+		{
+			Name: proto.String("http_requests_total"),
+			Help: proto.String("Requests served."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label: namespace,
+				Counter: &dto.Counter{
+					Value: proto.Float64(3),
+					Exemplar: &dto.Exemplar{
+						Label:     []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("4bf92f3577b34da6")}},
+						Value:     proto.Float64(1),
+						Timestamp: ts,
+					},
+				},
+			}},
+		},
+		{
+			Name: proto.String("request_duration_seconds"),
+			Help: proto.String("Request latency."),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Label: namespace,
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(1.5),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2), Exemplar: &dto.Exemplar{
+							Label:     []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("00f067aa0ba902b7")}},
+							Value:     proto.Float64(0.25),
+							Timestamp: ts,
+						}},
+						{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(3)},
+					},
+				},
+			}},
+		},
+	}
+}
+
+func TestEnrichMetricFamiliesKeepsExemplars(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend", "trace_id": "namespace"})
+	families := map[string]*dto.MetricFamily{}
+	for _, mf := range testExemplarMetrics() {
+		families[mf.GetName()] = mf
+	}
+	opts := &ServerRunnableOpts{
+		StripTimestamps: true,
+		RelabelConfigs: []relabel.RelabelConfig{{
+			SourceLabels: []string{"team"},
+			Regex:        relabel.MustNewRegexp("(.*)"),
+			TargetLabel:  "owner",
+			Replacement:  "$1",
+			Action:       relabel.Replace,
+		}},
+	}
+
+	var buf strings.Builder
+	if err := enrichAndEncode(context.Background(), &buf, expfmt.NewFormat(expfmt.TypeOpenMetrics), families, nm, opts); err != nil {
+		t.Fatalf("enrich: %v", err)
+	}
+
+	// Exemplar labels are not series labels: namespace labels and relabeling leave them alone.
+	want := `# HELP http_requests Requests served.
+# TYPE http_requests counter
+http_requests_total{namespace="frontend",team="frontend",trace_id="namespace",owner="frontend"} 3.0 # {trace_id="4bf92f3577b34da6"} 1.0 1.7e+09
+# HELP request_duration_seconds Request latency.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{namespace="frontend",team="frontend",trace_id="namespace",owner="frontend",le="0.5"} 2 # {trace_id="00f067aa0ba902b7"} 0.25 1.7e+09
+request_duration_seconds_bucket{namespace="frontend",team="frontend",trace_id="namespace",owner="frontend",le="+Inf"} 3
+request_duration_seconds_sum{namespace="frontend",team="frontend",trace_id="namespace",owner="frontend"} 1.5
+request_duration_seconds_count{namespace="frontend",team="frontend",trace_id="namespace",owner="frontend"} 3
+# EOF
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// cancelAfter is a context that is canceled once Err was called n times, to cancel in the middle of enrichment.
+type cancelAfter struct {
+	context.Context
+	n     int
+	calls int
+}
+
+func (c *cancelAfter) Err() error {
+	c.calls++
+	if c.calls > c.n {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestEnrichAndEncodeStopsWhenCanceled(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+
+	ctx := &cancelAfter{Context: context.Background(), n: 1}
+	var sb strings.Builder
+	err := EnrichAndEncode(ctx, &sb, parseTestMetrics(t, testKubeletMetrics), nm, &ServerRunnableOpts{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if ctx.calls != 2 {
+		t.Errorf("ctx.Err called %d times, want enrichment to stop at the second family", ctx.calls)
+	}
+	if sb.Len() != 0 {
+		t.Errorf("canceled enrichment wrote output:\n%s", sb.String())
+	}
+
+	// Cancellation while encoding stops before the remaining families.
+	families := parseTestMetrics(t, testKubeletMetrics)
+	ctx = &cancelAfter{Context: context.Background(), n: len(families) + 1}
+	sb.Reset()
+	err = EnrichAndEncode(ctx, &sb, families, nm, &ServerRunnableOpts{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if got := strings.Count(sb.String(), "# TYPE"); got != 1 {
+		t.Errorf("encoded %d families before the cancellation, want 1:\n%s", got, sb.String())
+	}
+}
+
+func largeCadvisorPayload(size int) string {
+	var sb strings.Builder
+	sb.WriteString("# HELP container_memory_working_set_bytes Current working set.\n")
+	sb.WriteString("# TYPE container_memory_working_set_bytes gauge\n")
+	for i := 0; sb.Len() < size; i++ {
+		fmt.Fprintf(&sb,
+			"container_memory_working_set_bytes{container=\"app\",namespace=\"ns-%d\",pod=\"app-%d\"} %d\n",
+			i%50, i, i)
+	}
+	return sb.String()
+}
+
+func benchmarkEnrich(b *testing.B, encode func(map[string]*dto.MetricFamily, *NamespaceMetrics) error) {
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader(largeCadvisorPayload(5 << 20)))
+	if err != nil {
+		b.Fatalf("parse metrics: %v", err)
+	}
+	nm := NewNamespaceMetrics()
+	for i := 0; i < 50; i++ {
+		nm.Set(fmt.Sprintf("ns-%d", i), map[string]string{"team": "frontend"})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := encode(mfs, nm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEnrichMetricFamilies5MB(b *testing.B) {
+	benchmarkEnrich(b, func(mfs map[string]*dto.MetricFamily, nm *NamespaceMetrics) error {
+		out, err := EnrichMetricFamilies(context.Background(), mfs, nm, &ServerRunnableOpts{})
+		_, _ = io.WriteString(io.Discard, out)
+		return err
+	})
+}
+
+func BenchmarkEnrichAndEncode5MB(b *testing.B) {
+	benchmarkEnrich(b, func(mfs map[string]*dto.MetricFamily, nm *NamespaceMetrics) error {
+		return EnrichAndEncode(context.Background(), io.Discard, mfs, nm, &ServerRunnableOpts{})
+	})
+}
+
+func TestNamespaceMetricsLabelDiff(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	diff := nm.DiffLabels("frontend", map[string]string{"team": "frontend", "tier": "web", "name": "frontend"}, "name")
+	if diff.Stored || diff.Empty() {
+		t.Fatalf("diff of a new namespace = %+v", diff)
+	}
+	nm.ApplyLabelDiff("frontend", diff)
+	before, _ := nm.Get("frontend")
+	if want := map[string]string{"team": "frontend", "tier": "web"}; !maps.Equal(before, want) {
+		t.Fatalf("labels = %v, want %v", before, want)
+	}
+
+	if diff := nm.DiffLabels("frontend", map[string]string{"team": "frontend", "tier": "web", "name": "x"}, "name"); !diff.Empty() {
+		t.Errorf("diff of unchanged labels = %+v", diff)
+	}
+
+	diff = nm.DiffLabels("frontend", map[string]string{"team": "platform"})
+	if want := map[string]string{"team": "platform"}; !maps.Equal(diff.Changed, want) || !slices.Equal(diff.Removed, []string{"tier"}) {
+		t.Fatalf("diff = %+v", diff)
+	}
+	nm.ApplyLabelDiff("frontend", diff)
+	if after, _ := nm.Get("frontend"); !maps.Equal(after, map[string]string{"team": "platform"}) {
+		t.Errorf("labels after diff = %v", after)
+	}
+	if before["team"] != "frontend" || before["tier"] != "web" {
+		t.Errorf("map returned by Get was modified: %v", before)
+	}
+
+	// An empty label set is stored for a namespace seen for the first time.
+	nm.ApplyLabelDiff("backend", nm.DiffLabels("backend", nil))
+	if labels, ok := nm.Get("backend"); !ok || len(labels) != 0 {
+		t.Errorf("labels of backend = %v (ok=%v), want an empty set", labels, ok)
+	}
+}
+
+// TestNamespaceMetricsConcurrentReplace is meant to run with -race.
+func TestNamespaceMetricsConcurrentReplace(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	state := map[string]NamespaceState{"frontend": {Labels: map[string]string{"team": "frontend"}, Created: 1}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			nm.Replace(state)
+		}
+	}()
+	for range 100 {
+		nm.Set("backend", map[string]string{"team": "backend"})
+		nm.Get("frontend")
+		nm.SetAnnotations("backend", map[string]string{"owner": "alice"})
+		nm.GetAnnotations("frontend")
+		nm.GetCreated("frontend")
+	}
+	<-done
+
+	if labels, ok := nm.Get("frontend"); !ok || labels["team"] != "frontend" {
+		t.Errorf("labels of frontend = %v (ok=%v)", labels, ok)
+	}
+}
+
+// benchmarkReconcileLabels stores the labels of 10k namespaces and then updates them
+// again unchanged, except for one namespace in a hundred, as periodic resyncs do.
+func benchmarkReconcileLabels(b *testing.B, update func(nm *NamespaceMetrics, ns string, labels map[string]string)) {
+	const namespaces = 10000
+	names := make([]string, namespaces)
+	labels := make([]map[string]string, namespaces)
+	nm := NewNamespaceMetrics()
+	for i := range names {
+		names[i] = fmt.Sprintf("ns-%d", i)
+		labels[i] = map[string]string{"team": "frontend", "tier": "web", "cost-center": "cc-1", "owner": "alice"}
+		nm.Set(names[i], labels[i])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < namespaces; j += 100 {
+			labels[j]["owner"] = fmt.Sprintf("owner-%d", i)
+		}
+		for j, ns := range names {
+			update(nm, ns, labels[j])
+		}
+	}
+}
+
+func BenchmarkReconcileLabelsSet(b *testing.B) {
+	benchmarkReconcileLabels(b, func(nm *NamespaceMetrics, ns string, labels map[string]string) {
+		nm.Set(ns, labels)
+	})
+}
+
+func BenchmarkReconcileLabelsDiff(b *testing.B) {
+	benchmarkReconcileLabels(b, func(nm *NamespaceMetrics, ns string, labels map[string]string) {
+		nm.ApplyLabelDiff(ns, nm.DiffLabels(ns, labels))
+	})
+}
+
+func TestKubeletURL(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ServerRunnableOpts
+		want string
+	}{
+		{
+			name: "ipv4",
+			opts: ServerRunnableOpts{NodeNameOrIP: "10.0.0.1", NodePort: "10250", NodePath: "/metrics"},
+			want: "https://10.0.0.1:10250/metrics",
+		},
+		{
+			name: "ipv6",
+			opts: ServerRunnableOpts{NodeNameOrIP: "fe80::1", NodePort: "10250", NodePath: "/metrics"},
+			want: "https://[fe80::1]:10250/metrics",
+		},
+		{
+			name: "bracketed ipv6",
+			opts: ServerRunnableOpts{NodeNameOrIP: "[fd00::1]", NodePort: "10250", NodePath: "/metrics/cadvisor"},
+			want: "https://[fd00::1]:10250/metrics/cadvisor",
+		},
+		{
+			name: "hostname",
+			opts: ServerRunnableOpts{NodeNameOrIP: "node-1.example.com", NodePort: "10250", NodePath: "/metrics"},
+			want: "https://node-1.example.com:10250/metrics",
+		},
+		{
+			name: "ipv6 kube-apiserver",
+			opts: ServerRunnableOpts{
+				KubeApiserver: "2001:db8::1",
+				NodeNameOrIP:  "node-1",
+				NodePort:      "443",
+				NodePath:      "/api/v1/nodes/node-1/proxy/metrics",
+			},
+			want: "https://[2001:db8::1]:443/api/v1/nodes/node-1/proxy/metrics",
+		},
+		{
+			name: "http",
+			opts: ServerRunnableOpts{Scheme: "http", NodeNameOrIP: "10.0.0.1", NodePort: "10255", NodePath: "/metrics"},
+			want: "http://10.0.0.1:10255/metrics",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := kubeletURL(&tt.opts); got != tt.want {
+				t.Errorf("kubeletURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateScheme(t *testing.T) {
+	for _, scheme := range []string{"", "http", "https"} {
+		if err := (&ServerRunnableOpts{Scheme: scheme}).Validate(); err != nil {
+			t.Errorf("Validate rejected scheme %q: %v", scheme, err)
+		}
+	}
+	if err := (&ServerRunnableOpts{Scheme: "ftp"}).Validate(); err == nil {
+		t.Error("expected Validate to reject scheme ftp")
+	}
+}
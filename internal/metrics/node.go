@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// nodeAddressResolver looks up the InternalIP of a Node and caches it after the first success.
+type nodeAddressResolver struct {
+	reader   client.Reader
+	nodeName string
+
+	mu      sync.Mutex
+	address string
+}
+
+func newNodeAddressResolver(reader client.Reader, nodeName string) *nodeAddressResolver {
+	return &nodeAddressResolver{reader: reader, nodeName: nodeName}
+}
+
+// resolve returns the InternalIP of the node. Failed lookups are retried on the next call.
+func (r *nodeAddressResolver) resolve(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.address != "" {
+		return r.address, nil
+	}
+
+	var node corev1.Node
+	if err := r.reader.Get(ctx, client.ObjectKey{Name: r.nodeName}, &node); err != nil {
+		return "", fmt.Errorf("get node %q: %w", r.nodeName, err)
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP && addr.Address != "" {
+			r.address = addr.Address
+			return r.address, nil
+		}
+	}
+	return "", fmt.Errorf("node %q has no InternalIP address", r.nodeName)
+}
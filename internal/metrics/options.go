@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// Option configures a ServerRunnable created with NewServerRunnableWithOptions.
+type Option func(*serverOptions)
+
+type serverOptions struct {
+	port string
+	opts ServerRunnableOpts
+}
+
+// NewServerRunnableWithOptions creates a ServerRunnable fetching from the kubelet with restConfig.
+// Without options it listens on port 8080 and scrapes the kubelet on localhost:10250.
+// It returns an error for the invalid ports that NewServerRunnable rejects.
+func NewServerRunnableWithOptions(
+	restConfig *rest.Config, nm *NamespaceMetrics, opts ...Option,
+) (*ServerRunnable, error) {
+	o := serverOptions{
+		port: "8080",
+		opts: ServerRunnableOpts{
+			NodeNameOrIP:      "localhost",
+			NodePort:          "10250",
+			NamespaceLabelKey: DefaultNamespaceLabelKey,
+			FetchMaxAttempts:  1,
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.opts.RestConfig = restConfig
+	return newServerRunnable(o.port, nm, o.opts)
+}
+
+// WithServerRunnableOpts replaces all options with opts. Options given after it still apply.
+func WithServerRunnableOpts(opts ServerRunnableOpts) Option {
+	return func(o *serverOptions) {
+		o.opts = opts
+	}
+}
+
+// WithPort sets the port the proxy listens on.
+func WithPort(port string) Option {
+	return func(o *serverOptions) {
+		o.port = port
+	}
+}
+
+// WithBindAddress sets the host:port the proxy listens on, taking precedence over WithPort.
+func WithBindAddress(addr string) Option {
+	return func(o *serverOptions) {
+		o.opts.BindAddress = addr
+	}
+}
+
+// WithNode sets the name or IP and the port of the scraped kubelet.
+// With WithKubeApiserver, port is the port of the kube-apiserver.
+func WithNode(nameOrIP, port string) Option {
+	return func(o *serverOptions) {
+		o.opts.NodeNameOrIP = nameOrIP
+		o.opts.NodePort = port
+	}
+}
+
+// WithKubeApiserver fetches the kubelet metrics through the node proxy of the kube-apiserver at address.
+func WithKubeApiserver(address string) Option {
+	return func(o *serverOptions) {
+		o.opts.KubeApiserver = address
+	}
+}
+
+// WithInsecureSkipVerify disables verification of the kubelet serving certificate.
+func WithInsecureSkipVerify() Option {
+	return func(o *serverOptions) {
+		o.opts.InsecureSkipVerify = true
+	}
+}
+
+// WithTransport sends the kubelet requests with rt instead of the transport built from the rest config.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *serverOptions) {
+		o.opts.Transport = rt
+	}
+}
+
+// WithCacheTTL reuses kubelet responses for ttl.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(o *serverOptions) {
+		o.opts.CacheTTL = ttl
+	}
+}
+
+// WithFetchTimeout bounds a single kubelet fetch.
+func WithFetchTimeout(timeout time.Duration) Option {
+	return func(o *serverOptions) {
+		o.opts.FetchTimeout = timeout
+	}
+}
+
+// WithRetries retries failed kubelet fetches up to maxAttempts times, starting with baseDelay.
+func WithRetries(maxAttempts int, baseDelay time.Duration) Option {
+	return func(o *serverOptions) {
+		o.opts.FetchMaxAttempts = maxAttempts
+		o.opts.FetchRetryBaseDelay = baseDelay
+	}
+}
+
+// WithReadiness shares readiness with the namespace reconciler.
+func WithReadiness(readiness *Readiness) Option {
+	return func(o *serverOptions) {
+		o.opts.Readiness = readiness
+	}
+}
+
+// WithPodMetrics attaches the labels listed in allowlist of the pods stored in pm by the pod reconciler.
+func WithPodMetrics(pm *PodMetrics, allowlist []string) Option {
+	return func(o *serverOptions) {
+		o.opts.PodMetrics = pm
+		o.opts.PodLabelAllowlist = allowlist
+	}
+}
@@ -0,0 +1,235 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	otlpmetricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/version"
+)
+
+// Defaults of the OTLP export.
+const (
+	DefaultOTLPInterval    = 30 * time.Second
+	DefaultOTLPKubeletPath = "metrics/cadvisor"
+)
+
+// otlpServiceName is the service.name resource attribute of the exported metrics.
+const otlpServiceName = "kubelet-meta-proxy"
+
+// OTLPRunnable periodically fetches and enriches kubelet metrics like a scrape of the ServerRunnable
+// and exports them to an OTLP/gRPC endpoint, e.g. an OpenTelemetry collector.
+type OTLPRunnable struct {
+	namespaceMetrics *NamespaceMetrics
+	opts             *ServerRunnableOpts
+	interval         time.Duration
+}
+
+// NewOTLPRunnable creates an OTLPRunnable for the OTLP options of sr.
+// It shares the kubelet client, response cache and scrape limit of sr.
+func NewOTLPRunnable(sr *ServerRunnable) *OTLPRunnable {
+	kubeletPath := sr.opts.OTLPKubeletPath
+	if kubeletPath == "" {
+		kubeletPath = DefaultOTLPKubeletPath
+	}
+	opts := sr.endpointOpts("/otlp", kubeletPath)
+
+	interval := opts.OTLPInterval
+	if interval <= 0 {
+		interval = DefaultOTLPInterval
+	}
+	return &OTLPRunnable{namespaceMetrics: sr.namespaceMetrics, opts: opts, interval: interval}
+}
+
+// Start exports the enriched metrics every interval until ctx is done.
+// Failed exports are logged and retried on the next tick.
+func (ot *OTLPRunnable) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("metrics.OTLPRunnable")
+
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if ot.opts.OTLPInsecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(ot.opts.OTLPEndpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("create OTLP client for %q: %w", ot.opts.OTLPEndpoint, err)
+	}
+	defer conn.Close()
+	client := collectorpb.NewMetricsServiceClient(conn)
+
+	ticker := time.NewTicker(ot.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := ot.export(ctx, client); err != nil {
+				logger.Error(err, "failed to export metrics", "endpoint", ot.opts.OTLPEndpoint)
+			}
+		}
+	}
+}
+
+// export fetches, enriches and exports the metrics once.
+func (ot *OTLPRunnable) export(ctx context.Context, client collectorpb.MetricsServiceClient) error {
+	families, err := collectEnriched(ctx, ot.namespaceMetrics, ot.opts)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Export(ctx, &collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*otlpmetricspb.ResourceMetrics{toOTLP(families, time.Now())},
+	})
+	if err != nil {
+		return err
+	}
+	if rejected := resp.GetPartialSuccess().GetRejectedDataPoints(); rejected > 0 {
+		return fmt.Errorf("%d data points rejected: %s", rejected, resp.GetPartialSuccess().GetErrorMessage())
+	}
+
+	ot.opts.selfMetrics.observeSuccess(ot.opts.localPath)
+	return nil
+}
+
+// toOTLP converts families to OTLP metrics. Labels, including the injected namespace labels,
+// become data point attributes. Counters become cumulative monotonic sums, untyped metrics gauges,
+// and histograms cumulative explicit-bucket histograms. Samples without a timestamp are stamped with now.
+func toOTLP(families []*dto.MetricFamily, now time.Time) *otlpmetricspb.ResourceMetrics {
+	metrics := make([]*otlpmetricspb.Metric, 0, len(families))
+	for _, mf := range families {
+		if m := otlpMetric(mf, now); m != nil {
+			metrics = append(metrics, m)
+		}
+	}
+
+	return &otlpmetricspb.ResourceMetrics{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			stringAttribute("service.name", otlpServiceName),
+			stringAttribute("service.version", version.Version),
+		}},
+		ScopeMetrics: []*otlpmetricspb.ScopeMetrics{{
+			Scope:   &commonpb.InstrumentationScope{Name: "github.com/Uburro/kubelet-meta-proxy", Version: version.Version},
+			Metrics: metrics,
+		}},
+	}
+}
+
+// otlpMetric converts a single family, returning nil for types OTLP can not represent.
+func otlpMetric(mf *dto.MetricFamily, now time.Time) *otlpmetricspb.Metric {
+	m := &otlpmetricspb.Metric{Name: mf.GetName(), Description: mf.GetHelp(), Unit: mf.GetUnit()}
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		points := make([]*otlpmetricspb.NumberDataPoint, 0, len(mf.Metric))
+		for _, metric := range mf.Metric {
+			points = append(points, numberDataPoint(metric, metric.GetCounter().GetValue(), now))
+		}
+		m.Data = &otlpmetricspb.Metric_Sum{Sum: &otlpmetricspb.Sum{
+			DataPoints:             points,
+			AggregationTemporality: otlpmetricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}}
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		points := make([]*otlpmetricspb.NumberDataPoint, 0, len(mf.Metric))
+		for _, metric := range mf.Metric {
+			value := metric.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_UNTYPED {
+				value = metric.GetUntyped().GetValue()
+			}
+			points = append(points, numberDataPoint(metric, value, now))
+		}
+		m.Data = &otlpmetricspb.Metric_Gauge{Gauge: &otlpmetricspb.Gauge{DataPoints: points}}
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		points := make([]*otlpmetricspb.HistogramDataPoint, 0, len(mf.Metric))
+		for _, metric := range mf.Metric {
+			points = append(points, histogramDataPoint(metric, now))
+		}
+		m.Data = &otlpmetricspb.Metric_Histogram{Histogram: &otlpmetricspb.Histogram{
+			DataPoints:             points,
+			AggregationTemporality: otlpmetricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		}}
+	case dto.MetricType_SUMMARY:
+		points := make([]*otlpmetricspb.SummaryDataPoint, 0, len(mf.Metric))
+		for _, metric := range mf.Metric {
+			summary := metric.GetSummary()
+			point := &otlpmetricspb.SummaryDataPoint{
+				Attributes:   attributes(metric.Label),
+				TimeUnixNano: timeUnixNano(metric, now),
+				Count:        summary.GetSampleCount(),
+				Sum:          summary.GetSampleSum(),
+			}
+			for _, q := range summary.Quantile {
+				point.QuantileValues = append(point.QuantileValues, &otlpmetricspb.SummaryDataPoint_ValueAtQuantile{
+					Quantile: q.GetQuantile(),
+					Value:    q.GetValue(),
+				})
+			}
+			points = append(points, point)
+		}
+		m.Data = &otlpmetricspb.Metric_Summary{Summary: &otlpmetricspb.Summary{DataPoints: points}}
+	default:
+		return nil
+	}
+	return m
+}
+
+func numberDataPoint(metric *dto.Metric, value float64, now time.Time) *otlpmetricspb.NumberDataPoint {
+	return &otlpmetricspb.NumberDataPoint{
+		Attributes:   attributes(metric.Label),
+		TimeUnixNano: timeUnixNano(metric, now),
+		Value:        &otlpmetricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+// histogramDataPoint converts the cumulative Prometheus buckets to OTLP per-bucket counts.
+// The +Inf bucket is implicit in OTLP and holds the samples above the last bound.
+func histogramDataPoint(metric *dto.Metric, now time.Time) *otlpmetricspb.HistogramDataPoint {
+	histogram := metric.GetHistogram()
+	point := &otlpmetricspb.HistogramDataPoint{
+		Attributes:   attributes(metric.Label),
+		TimeUnixNano: timeUnixNano(metric, now),
+		Count:        histogram.GetSampleCount(),
+		Sum:          histogram.SampleSum,
+	}
+	var cumulative uint64
+	for _, bucket := range histogram.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, bucket.GetCumulativeCount()-cumulative)
+		cumulative = bucket.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, histogram.GetSampleCount()-cumulative)
+	return point
+}
+
+func attributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, lbl := range labels {
+		attrs = append(attrs, stringAttribute(lbl.GetName(), lbl.GetValue()))
+	}
+	return attrs
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func timeUnixNano(metric *dto.Metric, now time.Time) uint64 {
+	if metric.TimestampMs != nil {
+		return uint64(time.UnixMilli(metric.GetTimestampMs()).UnixNano())
+	}
+	return uint64(now.UnixNano())
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	otlpmetricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeOTLPReceiver records the metrics exported to it.
+type fakeOTLPReceiver struct {
+	collectorpb.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	requests []*collectorpb.ExportMetricsServiceRequest
+}
+
+func (f *fakeOTLPReceiver) Export(_ context.Context, req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	return &collectorpb.ExportMetricsServiceResponse{}, nil
+}
+
+func (f *fakeOTLPReceiver) received() []*collectorpb.ExportMetricsServiceRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*collectorpb.ExportMetricsServiceRequest(nil), f.requests...)
+}
+
+func TestOTLPRunnableExportsEnrichedMetrics(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	receiver := &fakeOTLPReceiver{}
+	srv := grpc.NewServer()
+	collectorpb.RegisterMetricsServiceServer(srv, receiver)
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Stop()
+
+	opts, _ := newFakeKubelet(t, nil)
+	opts.OTLPEndpoint = ln.Addr().String()
+	opts.OTLPInsecure = true
+	opts.OTLPInterval = 10 * time.Millisecond
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	ot := NewOTLPRunnable(newTestServerRunnable(t, "0", nm, opts))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ot.Start(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(receiver.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no metrics were exported")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Start returned %v", err)
+	}
+
+	metrics := map[string]*otlpmetricspb.Metric{}
+	for _, rm := range receiver.received()[0].ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metrics[m.Name] = m
+			}
+		}
+	}
+
+	cpu := metrics["container_cpu_usage_seconds_total"].GetSum()
+	if cpu == nil || !cpu.IsMonotonic ||
+		cpu.AggregationTemporality != otlpmetricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+		t.Fatalf("counter not exported as a cumulative monotonic sum: %v", metrics["container_cpu_usage_seconds_total"])
+	}
+	memory := metrics["container_memory_working_set_bytes"].GetGauge()
+	if memory == nil || len(memory.DataPoints) != 1 {
+		t.Fatalf("gauge not exported: %v", metrics["container_memory_working_set_bytes"])
+	}
+	point := memory.DataPoints[0]
+	if point.GetAsDouble() != 1024 {
+		t.Errorf("gauge value = %v, want 1024", point.GetAsDouble())
+	}
+	if got := attributeValue(point.Attributes, "team"); got != "frontend" {
+		t.Errorf("team attribute = %q, want frontend: %v", got, point.Attributes)
+	}
+}
+
+func TestToOTLPHistogram(t *testing.T) {
+	families := parseTestMetrics(t, `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 2
+request_duration_seconds_bucket{le="1"} 5
+request_duration_seconds_bucket{le="+Inf"} 6
+request_duration_seconds_sum 4.5
+request_duration_seconds_count 6
+`)
+
+	rm := toOTLP([]*dto.MetricFamily{families["request_duration_seconds"]}, time.Unix(100, 0))
+	histogram := rm.ScopeMetrics[0].Metrics[0].GetHistogram()
+	if histogram == nil || len(histogram.DataPoints) != 1 {
+		t.Fatalf("histogram not exported: %v", rm)
+	}
+	point := histogram.DataPoints[0]
+	if got, want := point.ExplicitBounds, []float64{0.1, 1}; !slices.Equal(got, want) {
+		t.Errorf("bounds = %v, want %v", got, want)
+	}
+	if got, want := point.BucketCounts, []uint64{2, 3, 1}; !slices.Equal(got, want) {
+		t.Errorf("bucket counts = %v, want %v", got, want)
+	}
+	if point.Count != 6 || point.GetSum() != 4.5 {
+		t.Errorf("count = %d, sum = %v, want 6 and 4.5", point.Count, point.GetSum())
+	}
+	if point.TimeUnixNano != uint64(time.Unix(100, 0).UnixNano()) {
+		t.Errorf("time = %d, want the export time", point.TimeUnixNano)
+	}
+}
+
+func attributeValue(attrs []*commonpb.KeyValue, key string) string {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.Value.GetStringValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// DefaultPodLabelKey is the metric label that identifies the pod of a series.
+const DefaultPodLabelKey = "pod"
+
+// Labels holding the workload that owns the pod of a series.
+const (
+	OwnerKindLabel = "owner_kind"
+	OwnerNameLabel = "owner_name"
+)
+
+// PodOwner is the workload owning a pod, e.g. the Deployment of its ReplicaSet.
+type PodOwner struct {
+	Kind string
+	Name string
+}
+
+// PodMetrics stores the labels and owners of pods, keyed by namespace and pod name.
+// Labels and owners are kept in separate maps, like the labels and annotations of NamespaceMetrics.
+// It is safe for concurrent use by the reconciler and the HTTP handlers.
+type PodMetrics struct {
+	mu   sync.RWMutex
+	pods map[string]map[string]string
+	// owners holds the owner of a pod as its OwnerKindLabel and OwnerNameLabel labels,
+	// ready to be injected without allocating on every scrape.
+	owners map[string]map[string]string
+}
+
+// NewPodMetrics creates a new PodMetrics instance.
+func NewPodMetrics() *PodMetrics {
+	return &PodMetrics{
+		pods:   make(map[string]map[string]string),
+		owners: make(map[string]map[string]string),
+	}
+}
+
+// Set stores a copy of the labels for the given pod.
+func (pm *PodMetrics) Set(namespace, pod string, labels map[string]string) {
+	cp := make(map[string]string, len(labels))
+	for k, v := range labels {
+		cp[k] = v
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.pods[podKey(namespace, pod)] = cp
+}
+
+// Get returns the labels stored for the given pod. Nothing is stored in a nil PodMetrics.
+// The returned map must not be modified by the caller.
+func (pm *PodMetrics) Get(namespace, pod string) (map[string]string, bool) {
+	if pm == nil {
+		return nil, false
+	}
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	labels, ok := pm.pods[podKey(namespace, pod)]
+	return labels, ok
+}
+
+// SetOwner stores the owner of the given pod.
+func (pm *PodMetrics) SetOwner(namespace, pod string, owner PodOwner) {
+	labels := map[string]string{OwnerKindLabel: owner.Kind, OwnerNameLabel: owner.Name}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.owners[podKey(namespace, pod)] = labels
+}
+
+// GetOwner returns the owner stored for the given pod.
+func (pm *PodMetrics) GetOwner(namespace, pod string) (PodOwner, bool) {
+	labels, ok := pm.ownerLabels(namespace, pod)
+	return PodOwner{Kind: labels[OwnerKindLabel], Name: labels[OwnerNameLabel]}, ok
+}
+
+// ownerLabels returns the owner stored for the given pod as labels. Nothing is stored in a nil PodMetrics.
+func (pm *PodMetrics) ownerLabels(namespace, pod string) (map[string]string, bool) {
+	if pm == nil {
+		return nil, false
+	}
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	labels, ok := pm.owners[podKey(namespace, pod)]
+	return labels, ok
+}
+
+// DeleteOwner removes the owner stored for the given pod, keeping its labels.
+func (pm *PodMetrics) DeleteOwner(namespace, pod string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	delete(pm.owners, podKey(namespace, pod))
+}
+
+// Delete removes the labels and the owner stored for the given pod.
+func (pm *PodMetrics) Delete(namespace, pod string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	delete(pm.pods, podKey(namespace, pod))
+	delete(pm.owners, podKey(namespace, pod))
+}
+
+// Len returns the number of pods with stored labels or owners. It is 0 for a nil PodMetrics.
+func (pm *PodMetrics) Len() int {
+	if pm == nil {
+		return 0
+	}
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	n := len(pm.pods)
+	for key := range pm.owners {
+		if _, ok := pm.pods[key]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// podKey is namespace/pod, like the string form of a types.NamespacedName.
+func podKey(namespace, pod string) string {
+	return namespace + "/" + pod
+}
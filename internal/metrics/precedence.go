@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Sources of the labels attached to metrics, ordered by ServerRunnableOpts.LabelPrecedence.
+const (
+	// LabelSourceNamespace is the namespace labels, annotations and creation time, in that order.
+	LabelSourceNamespace = "namespace"
+	// LabelSourcePod is the pod labels followed by the owner of the pod.
+	LabelSourcePod = "pod"
+	// LabelSourceStatic is ServerRunnableOpts.StaticLabels.
+	LabelSourceStatic = "static"
+	// LabelSourceNode is the node label named by ServerRunnableOpts.NodeLabelName.
+	LabelSourceNode = "node"
+)
+
+// DefaultLabelPrecedence is the order label sources are applied in when LabelPrecedence is empty.
+var DefaultLabelPrecedence = []string{LabelSourceNamespace, LabelSourcePod, LabelSourceStatic, LabelSourceNode}
+
+// labelPrecedence returns the order label sources are applied in: those listed in LabelPrecedence
+// followed by the others in their DefaultLabelPrecedence order.
+func (o *ServerRunnableOpts) labelPrecedence() []string {
+	if len(o.LabelPrecedence) == 0 {
+		return DefaultLabelPrecedence
+	}
+	order := slices.Clone(o.LabelPrecedence)
+	for _, source := range DefaultLabelPrecedence {
+		if !slices.Contains(order, source) {
+			order = append(order, source)
+		}
+	}
+	return order
+}
+
+// validateLabelPrecedence reports unknown and repeated label sources.
+func validateLabelPrecedence(precedence []string) error {
+	for i, source := range precedence {
+		if !slices.Contains(DefaultLabelPrecedence, source) {
+			return fmt.Errorf("invalid label source %q: must be one of %v", source, DefaultLabelPrecedence)
+		}
+		if slices.Contains(precedence[:i], source) {
+			return fmt.Errorf("label source %q is listed more than once", source)
+		}
+	}
+	return nil
+}
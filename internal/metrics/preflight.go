@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultPreflightTimeout bounds Preflight when FetchTimeout is not set.
+const DefaultPreflightTimeout = 30 * time.Second
+
+// Preflight fetches the kubelet metrics path once and returns an error when it can not be scraped,
+// e.g. because of a wrong node address, port or TLS settings. It is meant to be called before the
+// manager starts, so a misconfiguration fails the startup instead of every scrape.
+// With Nodes it only fails when no node can be scraped, like an aggregated scrape.
+// The fetch is not retried, cached nor counted by the circuit breaker.
+func (sr *ServerRunnable) Preflight(ctx context.Context) error {
+	opts := sr.endpointOpts("/metrics", "metrics")
+	opts.FetchMaxAttempts = 1
+	if opts.FetchTimeout <= 0 {
+		opts.FetchTimeout = DefaultPreflightTimeout
+	}
+
+	targets := []*ServerRunnableOpts{opts}
+	if len(opts.Nodes) > 0 {
+		targets = targets[:0]
+		for _, node := range opts.Nodes {
+			targets = append(targets, nodeOpts(opts, node))
+		}
+	}
+	var errs []error
+	for _, target := range targets {
+		_, err := fetchMetrics(ctx, target.RestConfig, target, insecureSkipVerify(target))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", kubeletURL(target), err))
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("kubelet preflight failed: %w", errors.Join(errs...))
+}
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// NamespacePreview describes what enrichment does to the series of one namespace.
+type NamespacePreview struct {
+	// Series is the number of series of the namespace.
+	Series int `json:"series"`
+	// DroppedSeries is the number of series removed by relabeling.
+	DroppedSeries int `json:"droppedSeries,omitempty"`
+	// Excluded reports whether the namespace is listed in ExcludeNamespaces.
+	Excluded bool `json:"excluded,omitempty"`
+	// Injected maps every label added to at least one series to its value.
+	Injected map[string]string `json:"injected,omitempty"`
+	// Filtered lists the namespace labels and annotations left out by the allow and deny lists.
+	Filtered []string `json:"filtered,omitempty"`
+	// Dropped lists the series labels removed by DropLabels or relabeling.
+	Dropped []string `json:"dropped,omitempty"`
+	// Renamed maps the series labels renamed by RenameLabels to their new name.
+	Renamed map[string]string `json:"renamed,omitempty"`
+}
+
+// Preview reports, per namespace, what enriching metricFamilies with opts would do, without modifying them.
+// Every series is enriched on a copy and compared with the original. Series without a namespace label are left out.
+// The ctx error is returned when ctx is done before every series is previewed.
+func Preview(
+	ctx context.Context,
+	metricFamilies map[string]*dto.MetricFamily,
+	nm *NamespaceMetrics,
+	opts *ServerRunnableOpts,
+) (map[string]*NamespacePreview, error) {
+	nsLabelKey := opts.NamespaceLabelKey
+	if nsLabelKey == "" {
+		nsLabelKey = DefaultNamespaceLabelKey
+	}
+	// Enrichment of the copies must not be counted as served scrapes.
+	o := *opts
+	o.selfMetrics = nil
+	// Every series is previewed with the same rules, even if they are replaced meanwhile.
+	rules := opts.currentRules()
+	o.rules = &atomic.Pointer[EnrichmentRules]{}
+	o.rules.Store(&rules)
+
+	previews := make(map[string]*NamespacePreview)
+	for _, name := range sortedKeys(metricFamilies) {
+		mf := metricFamilies[name]
+		for _, metric := range mf.Metric {
+			ns := labelValue(metric.Label, nsLabelKey)
+			if ns == "" {
+				continue
+			}
+			p, ok := previews[ns]
+			if !ok {
+				p = newNamespacePreview(ns, nm, &rules)
+				previews[ns] = p
+			}
+			p.Series++
+
+			enriched := map[string]*dto.MetricFamily{name: {
+				Name:   mf.Name,
+				Type:   mf.Type,
+				Metric: []*dto.Metric{proto.Clone(metric).(*dto.Metric)},
+			}}
+			if _, err := enrichInPlace(ctx, enriched, nm, &o); err != nil {
+				return nil, err
+			}
+			if len(enriched) == 0 {
+				p.DroppedSeries++
+				continue
+			}
+			p.compare(metric.Label, enriched[name].Metric[0].Label, rules.RenameLabels)
+		}
+	}
+	for _, p := range previews {
+		slices.Sort(p.Dropped)
+	}
+	return previews, nil
+}
+
+// newNamespacePreview creates the preview of ns with the stored keys the allow and deny lists leave out.
+func newNamespacePreview(ns string, nm *NamespaceMetrics, rules *EnrichmentRules) *NamespacePreview {
+	p := &NamespacePreview{Excluded: rules.namespaceExcluded(ns)}
+	if p.Excluded {
+		return p
+	}
+	if labels, ok := nm.Get(ns); ok {
+		for _, k := range sortedKeys(labels) {
+			if !rules.labelAllowed(k) {
+				p.Filtered = append(p.Filtered, k)
+			}
+		}
+	}
+	if annotations, ok := nm.GetAnnotations(ns); ok {
+		for _, k := range sortedKeys(annotations) {
+			if !rules.annotationAllowed(k) {
+				p.Filtered = append(p.Filtered, k)
+			}
+		}
+	}
+	return p
+}
+
+// compare records the labels added, removed and renamed between the original and the enriched series.
+func (p *NamespacePreview) compare(original, enriched []*dto.LabelPair, renames map[string]string) {
+	for _, lbl := range enriched {
+		if !hasLabel(original, lbl.GetName()) {
+			if p.Injected == nil {
+				p.Injected = make(map[string]string)
+			}
+			p.Injected[lbl.GetName()] = lbl.GetValue()
+		}
+	}
+	for _, lbl := range original {
+		name := lbl.GetName()
+		if hasLabel(enriched, name) {
+			continue
+		}
+		if to, ok := renames[name]; ok && hasLabel(enriched, to) {
+			if p.Renamed == nil {
+				p.Renamed = make(map[string]string)
+			}
+			p.Renamed[name] = to
+			// The new name is not an injected label.
+			if labelValue(original, to) == "" {
+				delete(p.Injected, to)
+			}
+			continue
+		}
+		if !slices.Contains(p.Dropped, name) {
+			p.Dropped = append(p.Dropped, name)
+		}
+	}
+}
+
+func labelValue(labels []*dto.LabelPair, name string) string {
+	for _, lbl := range labels {
+		if lbl.GetName() == name {
+			return lbl.GetValue()
+		}
+	}
+	return ""
+}
+
+// previewHandler serves GET /debug/preview?path=<local path>, the Preview of a scrape of one of the
+// served endpoints as JSON. The path defaults to /metrics/cadvisor.
+func (sr *ServerRunnable) previewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = "/metrics/cadvisor"
+		}
+		opts, ok := sr.endpoints[path]
+		if !ok {
+			http.Error(w, fmt.Sprintf("%q is not a served endpoint", path), http.StatusNotFound)
+			return
+		}
+
+		metricFamilies, err := fetchMetricFamilies(r.Context(), opts)
+		if err != nil {
+			detail := fmt.Sprintf("failed to fetch metrics: %v", err)
+			// The scrape limit and the circuit breaker tell when to try again.
+			if e := classifyFetchError(err, opts); e.retryAfter > 0 {
+				writeError(w, opts, e, detail)
+				return
+			}
+			http.Error(w, detail, http.StatusBadGateway)
+			return
+		}
+		previews, err := Preview(r.Context(), metricFamilies, sr.namespaceMetrics, opts)
+		if err != nil {
+			// Only a canceled request fails here, there is nothing to retry after.
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(previews); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPreviewReflectsAllowlist(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend", "tier": "web", "owner": "alice"})
+	families := parseTestMetrics(t, testKubeletMetrics)
+	opts := &ServerRunnableOpts{
+		LabelAllowlist:    []string{"team"},
+		DropLabels:        []string{"pod"},
+		RenameLabels:      map[string]string{"container": "container_name"},
+		ExcludeNamespaces: []string{"backend"},
+	}
+
+	previews, err := Preview(context.Background(), families, nm, opts)
+	if err != nil {
+		t.Fatalf("preview: %v", err)
+	}
+	frontend, ok := previews["frontend"]
+	if !ok {
+		t.Fatalf("no preview for frontend: %v", previews)
+	}
+	if frontend.Series != 2 {
+		t.Errorf("series = %d, want 2", frontend.Series)
+	}
+	if want := map[string]string{"team": "frontend"}; !maps.Equal(frontend.Injected, want) {
+		t.Errorf("injected = %v, want %v", frontend.Injected, want)
+	}
+	if want := []string{"owner", "tier"}; !slices.Equal(frontend.Filtered, want) {
+		t.Errorf("filtered = %v, want %v", frontend.Filtered, want)
+	}
+	if want := []string{"pod"}; !slices.Equal(frontend.Dropped, want) {
+		t.Errorf("dropped = %v, want %v", frontend.Dropped, want)
+	}
+	if want := map[string]string{"container": "container_name"}; !maps.Equal(frontend.Renamed, want) {
+		t.Errorf("renamed = %v, want %v", frontend.Renamed, want)
+	}
+	if backend := previews["backend"]; backend == nil || !backend.Excluded || len(backend.Injected) != 0 {
+		t.Errorf("backend preview = %+v, want excluded without injected labels", backend)
+	}
+
+	// The previewed families are left untouched.
+	metric := families["container_cpu_usage_seconds_total"].Metric[0]
+	if !hasLabel(metric.Label, "pod") || hasLabel(metric.Label, "team") || hasLabel(metric.Label, "container_name") {
+		t.Errorf("Preview modified the metric families: %v", metric.Label)
+	}
+}
+
+func TestServerRunnablePreviewEndpoint(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	opts.EnableDebugEndpoints = true
+	opts.LabelAllowlist = []string{"team"}
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend", "tier": "web"})
+	sr := newTestServerRunnable(t, "0", nm, opts)
+
+	rec := serve(t, sr, "/debug/preview?path=/metrics/cadvisor")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	var previews map[string]NamespacePreview
+	if err := json.Unmarshal(rec.Body.Bytes(), &previews); err != nil {
+		t.Fatalf("decode preview: %v", err)
+	}
+	if got := previews["frontend"]; got.Injected["team"] != "frontend" || !slices.Equal(got.Filtered, []string{"tier"}) {
+		t.Errorf("frontend preview = %+v", got)
+	}
+
+	if rec := serve(t, sr, "/debug/preview?path=/unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown path: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServerRunnablePreviewEndpointRetryAfter(t *testing.T) {
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	opts.EnableDebugEndpoints = true
+	opts.CircuitBreakerThreshold = 1
+	opts.CircuitBreakerCooldown = time.Minute
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := serve(t, sr, "/debug/preview?path=/metrics/cadvisor")
+	if rec.Code != http.StatusBadGateway || rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("kubelet failure: status = %d, Retry-After = %q, want 502 without it",
+			rec.Code, rec.Header().Get("Retry-After"))
+	}
+	rec = serve(t, sr, "/debug/preview?path=/metrics/cadvisor")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("open circuit: status = %d, want 503", rec.Code)
+	}
+	if got := retryAfter(t, rec); got != 60 {
+		t.Errorf("open circuit: Retry-After = %d, want the 60s cooldown", got)
+	}
+}
+
+func TestServerRunnablePreviewEndpointCanceled(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	opts.EnableDebugEndpoints = true
+	opts.CacheTTL = time.Minute
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	// Fill the cache, so the canceled request gets the metrics and fails while previewing them.
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Fatalf("scrape: status = %d", rec.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/debug/preview?path=/metrics/cadvisor", nil).WithContext(ctx)
+	sr.httpServer.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("canceled preview: status = %d, want 503", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("canceled preview: Retry-After = %q, want none", got)
+	}
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/version"
+)
+
+// proxyMetrics holds self-observability metrics about the proxy's own scrapes.
+// They are kept in a private registry so they never mix with the enriched kubelet output.
+// All methods are no-ops on a nil receiver.
+type proxyMetrics struct {
+	registry *prometheus.Registry
+
+	fetchDuration  *prometheus.HistogramVec
+	fetchErrors    *prometheus.CounterVec
+	enrichDuration *prometheus.HistogramVec
+	labelsAdded    *prometheus.CounterVec
+	labelsDropped  *prometheus.CounterVec
+	invalidValues  *prometheus.CounterVec
+	metrics        *prometheus.CounterVec
+	nodeErrors     *prometheus.CounterVec
+	lastSuccess    *prometheus.GaugeVec
+	buildInfo      prometheus.Gauge
+	parseErrors    *prometheus.CounterVec
+	breakerState   *prometheus.GaugeVec
+	// cachedNamespaces reads the namespace count at collection time, so it never misses an add or delete.
+	cachedNamespaces prometheus.GaugeFunc
+}
+
+// newProxyMetrics creates the proxy metrics. The cached namespaces are counted from nm, which may be nil.
+func newProxyMetrics(nm *NamespaceMetrics) *proxyMetrics {
+	pm := &proxyMetrics{
+		registry: prometheus.NewRegistry(),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kmp_kubelet_fetch_duration_seconds",
+			Help:    "Duration of kubelet metrics fetches.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"path"}),
+		fetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kmp_kubelet_fetch_errors_total",
+			Help: "Total number of failed kubelet metrics fetches.",
+		}, []string{"path"}),
+		enrichDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kmp_enrich_duration_seconds",
+			Help:    "Duration of enriching and encoding kubelet metrics.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"path"}),
+		labelsAdded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kmp_enriched_labels_added_total",
+			Help: "Total number of labels injected into kubelet metrics.",
+		}, []string{"path"}),
+		labelsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kmp_enriched_labels_dropped_total",
+			Help: "Total number of namespace labels not injected because of the per-metric label cap.",
+		}, []string{"path"}),
+		invalidValues: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kmp_invalid_label_values_total",
+			Help: "Total number of labels not injected because their value is invalid UTF-8 or has control characters.",
+		}, []string{"path"}),
+		metrics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kmp_metrics_total",
+			Help: "Total number of kubelet metrics enriched, passed through without namespace or pod labels, or dropped.",
+		}, []string{"path", "result"}),
+		nodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kmp_aggregated_node_errors_total",
+			Help: "Total number of nodes skipped in an aggregated scrape because their kubelet fetch failed.",
+		}, []string{"node", "path"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kmp_last_successful_scrape_timestamp_seconds",
+			Help: "Unix time of the last scrape served successfully, by local endpoint path.",
+		}, []string{"path"}),
+		parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kmp_parse_errors_total",
+			Help: "Total number of malformed metric families skipped with lenient parsing.",
+		}, []string{"path"}),
+		buildInfo: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kmp_build_info",
+			Help: "A metric with a constant '1' value labeled by the version, commit and Go version of the proxy.",
+			ConstLabels: prometheus.Labels{
+				"version":   version.Version,
+				"commit":    version.Commit,
+				"goversion": runtime.Version(),
+			},
+		}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kmp_circuit_breaker_state",
+			Help: "State of the kubelet circuit breaker by URL: 0 closed, 1 open, 2 half-open.",
+		}, []string{"url"}),
+		cachedNamespaces: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "kmp_cached_namespaces",
+			Help: "Number of namespaces whose labels or annotations are cached for enrichment.",
+		}, func() float64 { return float64(nm.Len()) }),
+	}
+	pm.buildInfo.Set(1)
+	pm.registry.MustRegister(pm.collectors()...)
+	return pm
+}
+
+func (pm *proxyMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		pm.fetchDuration, pm.fetchErrors, pm.enrichDuration, pm.labelsAdded, pm.labelsDropped, pm.invalidValues,
+		pm.metrics, pm.nodeErrors, pm.lastSuccess, pm.buildInfo, pm.parseErrors, pm.breakerState, pm.cachedNamespaces,
+	}
+}
+
+// registerWith additionally registers the metrics with reg, e.g. the controller-runtime registry.
+func (pm *proxyMetrics) registerWith(reg prometheus.Registerer) error {
+	for _, c := range pm.collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pm *proxyMetrics) observeFetch(path string, start time.Time, err error) {
+	if pm == nil {
+		return
+	}
+	pm.fetchDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+	if err != nil {
+		pm.fetchErrors.WithLabelValues(path).Inc()
+	}
+}
+
+func (pm *proxyMetrics) observeEnrich(path string, start time.Time, stats enrichStats) {
+	if pm == nil {
+		return
+	}
+	pm.enrichDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+	pm.labelsAdded.WithLabelValues(path).Add(float64(stats.labelsAdded))
+	pm.labelsDropped.WithLabelValues(path).Add(float64(stats.labelsDropped))
+	pm.invalidValues.WithLabelValues(path).Add(float64(stats.labelsInvalid))
+	pm.metrics.WithLabelValues(path, "enriched").Add(float64(stats.enriched))
+	pm.metrics.WithLabelValues(path, "passthrough").Add(float64(stats.passthrough))
+	pm.metrics.WithLabelValues(path, "dropped").Add(float64(stats.dropped))
+}
+
+func (pm *proxyMetrics) observeNodeError(node, path string) {
+	if pm == nil {
+		return
+	}
+	pm.nodeErrors.WithLabelValues(node, path).Inc()
+}
+
+func (pm *proxyMetrics) observeParseError(path string) {
+	if pm == nil {
+		return
+	}
+	pm.parseErrors.WithLabelValues(path).Inc()
+}
+
+func (pm *proxyMetrics) observeSuccess(localPath string) {
+	if pm == nil {
+		return
+	}
+	pm.lastSuccess.WithLabelValues(localPath).SetToCurrentTime()
+}
+
+func (pm *proxyMetrics) observeBreakerState(url string, state breakerState) {
+	if pm == nil {
+		return
+	}
+	pm.breakerState.WithLabelValues(url).Set(float64(state))
+}
+
+// handler serves the proxy's own metrics.
+func (pm *proxyMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(pm.registry, promhttp.HandlerOpts{})
+}
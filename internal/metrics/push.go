@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Defaults of the push mode.
+const (
+	DefaultPushInterval    = 30 * time.Second
+	DefaultPushJob         = "kubelet-meta-proxy"
+	DefaultPushKubeletPath = "metrics/cadvisor"
+)
+
+// PushRunnable periodically fetches and enriches kubelet metrics like a scrape of the ServerRunnable
+// and pushes them to a Prometheus Pushgateway, for deployments that can not be scraped.
+type PushRunnable struct {
+	namespaceMetrics *NamespaceMetrics
+	opts             *ServerRunnableOpts
+	interval         time.Duration
+}
+
+// NewPushRunnable creates a PushRunnable for the Pushgateway options of sr.
+// It shares the kubelet client, response cache and scrape limit of sr.
+func NewPushRunnable(sr *ServerRunnable) *PushRunnable {
+	kubeletPath := sr.opts.PushKubeletPath
+	if kubeletPath == "" {
+		kubeletPath = DefaultPushKubeletPath
+	}
+	opts := sr.endpointOpts("/push", kubeletPath)
+	// The Pushgateway rejects samples with timestamps.
+	opts.StripTimestamps = true
+	if opts.PushJob == "" {
+		opts.PushJob = DefaultPushJob
+	}
+
+	interval := opts.PushInterval
+	if interval <= 0 {
+		interval = DefaultPushInterval
+	}
+	return &PushRunnable{namespaceMetrics: sr.namespaceMetrics, opts: opts, interval: interval}
+}
+
+// Start pushes the enriched metrics every interval until ctx is done.
+// Failed pushes are logged and retried on the next tick.
+func (pr *PushRunnable) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("metrics.PushRunnable")
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := pr.push(ctx); err != nil {
+				logger.Error(err, "failed to push metrics", "url", pr.opts.PushGatewayURL)
+			}
+		}
+	}
+}
+
+// push fetches, enriches and pushes the metrics once, replacing the previous push of the group.
+func (pr *PushRunnable) push(ctx context.Context) error {
+	families, err := collectEnriched(ctx, pr.namespaceMetrics, pr.opts)
+	if err != nil {
+		return err
+	}
+	pusher := push.New(pr.opts.PushGatewayURL, pr.opts.PushJob).
+		Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return families, nil }))
+	for _, name := range sortedKeys(pr.opts.PushGroupingKey) {
+		pusher = pusher.Grouping(name, pr.opts.PushGroupingKey[name])
+	}
+	if err := pusher.PushContext(ctx); err != nil {
+		return err
+	}
+
+	pr.opts.selfMetrics.observeSuccess(pr.opts.localPath)
+	return nil
+}
+
+// collectEnriched fetches and enriches the metrics of opts once, like a scrape,
+// and returns the families sorted by name.
+func collectEnriched(ctx context.Context, nm *NamespaceMetrics, opts *ServerRunnableOpts) ([]*dto.MetricFamily, error) {
+	if opts.Readiness != nil && !opts.Readiness.CacheSynced() {
+		return nil, errors.New("namespace cache not synced")
+	}
+
+	metricFamilies, err := fetchMetricFamilies(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("fetch metrics: %w", err)
+	}
+	start := time.Now()
+	stats, err := enrichInPlace(ctx, metricFamilies, nm, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.selfMetrics.observeEnrich(opts.NodePath, start, stats)
+
+	families := make([]*dto.MetricFamily, 0, len(metricFamilies))
+	for _, name := range sortedKeys(metricFamilies) {
+		families = append(families, metricFamilies[name])
+	}
+	return families, nil
+}
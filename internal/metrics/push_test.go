@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPushRunnablePushesEnrichedMetrics(t *testing.T) {
+	type pushed struct {
+		method, path string
+		families     map[string]*dto.MetricFamily
+	}
+	var mu sync.Mutex
+	var pushes []pushed
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families := map[string]*dto.MetricFamily{}
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			mf := &dto.MetricFamily{}
+			if err := decoder.Decode(mf); err == io.EOF {
+				break
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			families[mf.GetName()] = mf
+		}
+		mu.Lock()
+		pushes = append(pushes, pushed{method: r.Method, path: r.URL.Path, families: families})
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	opts, _ := newFakeKubelet(t, nil)
+	opts.PushGatewayURL = gateway.URL
+	opts.PushInterval = 10 * time.Millisecond
+	opts.PushJob = "kmp"
+	opts.PushGroupingKey = map[string]string{"instance": "worker-1"}
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	pr := NewPushRunnable(newTestServerRunnable(t, "0", nm, opts))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- pr.Start(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(pushes)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d pushes, want at least 2", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Start returned %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	got := pushes[0]
+	if got.method != http.MethodPut || got.path != "/metrics/job/kmp/instance/worker-1" {
+		t.Errorf("push = %s %s, want PUT /metrics/job/kmp/instance/worker-1", got.method, got.path)
+	}
+	mf, ok := got.families["container_memory_working_set_bytes"]
+	if !ok {
+		t.Fatalf("pushed families = %v", sortedKeys(got.families))
+	}
+	if !hasLabel(mf.Metric[0].Label, "team") {
+		t.Errorf("enriched label missing from pushed metric: %v", mf.Metric[0].Label)
+	}
+	if mf.Metric[0].TimestampMs != nil {
+		t.Errorf("pushed metric has a timestamp: %v", mf.Metric[0].GetTimestampMs())
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness tracks whether the proxy is ready to serve enriched metrics.
+// It becomes ready once the namespace cache has synced and the kubelet
+// has been scraped successfully at least once.
+type Readiness struct {
+	cacheSynced atomic.Bool
+	scraped     atomic.Bool
+}
+
+// NewReadiness creates a new Readiness instance that is not ready yet.
+func NewReadiness() *Readiness {
+	return &Readiness{}
+}
+
+// SetCacheSynced marks the namespace cache as synced.
+func (r *Readiness) SetCacheSynced() {
+	r.cacheSynced.Store(true)
+}
+
+// CacheSynced reports whether the namespace cache has synced.
+func (r *Readiness) CacheSynced() bool {
+	return r.cacheSynced.Load()
+}
+
+// SetScraped marks the kubelet as successfully scraped.
+func (r *Readiness) SetScraped() {
+	r.scraped.Store(true)
+}
+
+// Ready reports whether both the namespace cache has synced and the kubelet was scraped.
+func (r *Readiness) Ready() bool {
+	return r.cacheSynced.Load() && r.scraped.Load()
+}
+
+// readyzHandler reports the readiness state without contacting the kubelet.
+func readyzHandler(readiness *Readiness) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		switch {
+		case !readiness.CacheSynced():
+			setRetryAfter(w, cacheSyncRetryAfter)
+			http.Error(w, "namespace cache not synced", http.StatusServiceUnavailable)
+		case !readiness.Ready():
+			setRetryAfter(w, cacheSyncRetryAfter)
+			http.Error(w, "kubelet not scraped yet", http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}
+}
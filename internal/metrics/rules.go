@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"slices"
+	"sync/atomic"
+)
+
+// EnrichmentRules are the options selecting the namespace labels and annotations attached to metrics
+// and renaming the kubelet labels. Unlike the other options, they can be replaced while the proxy runs
+// with ServerRunnable.SetEnrichmentRules.
+type EnrichmentRules struct {
+	ExcludeNamespaces   []string
+	LabelAllowlist      []string
+	LabelDenylist       []string
+	AnnotationAllowlist []string
+	RenameLabels        map[string]string
+}
+
+// EnrichmentRules returns the enrichment rules set in opts.
+func (o *ServerRunnableOpts) EnrichmentRules() EnrichmentRules {
+	return EnrichmentRules{
+		ExcludeNamespaces:   o.ExcludeNamespaces,
+		LabelAllowlist:      o.LabelAllowlist,
+		LabelDenylist:       o.LabelDenylist,
+		AnnotationAllowlist: o.AnnotationAllowlist,
+		RenameLabels:        o.RenameLabels,
+	}
+}
+
+// SetEnrichmentRules replaces the enrichment rules of every endpoint. Scrapes already enriching
+// finish with the previous rules, the following ones use the new rules.
+func (sr *ServerRunnable) SetEnrichmentRules(rules EnrichmentRules) {
+	sr.opts.rules.Store(&rules)
+}
+
+// currentRules returns the rules last set with SetEnrichmentRules, or the ones of opts.
+// A scrape takes them once, so it is enriched with a single set of rules.
+func (o *ServerRunnableOpts) currentRules() EnrichmentRules {
+	if o.rules != nil {
+		if rules := o.rules.Load(); rules != nil {
+			return *rules
+		}
+	}
+	return o.EnrichmentRules()
+}
+
+// newRulesPointer holds the rules shared by the copies of opts made for every endpoint.
+func newRulesPointer(opts *ServerRunnableOpts) *atomic.Pointer[EnrichmentRules] {
+	p := &atomic.Pointer[EnrichmentRules]{}
+	rules := opts.EnrichmentRules()
+	p.Store(&rules)
+	return p
+}
+
+// namespaceExcluded reports whether the metrics of ns are served without namespace labels.
+func (r *EnrichmentRules) namespaceExcluded(ns string) bool {
+	return slices.Contains(r.ExcludeNamespaces, ns)
+}
+
+// labelAllowed reports whether the namespace label key may be attached to metrics.
+// The allowlist is applied first, then the denylist removes from the survivors.
+func (r *EnrichmentRules) labelAllowed(key string) bool {
+	if len(r.LabelAllowlist) > 0 && !slices.Contains(r.LabelAllowlist, key) {
+		return false
+	}
+	return !slices.Contains(r.LabelDenylist, key)
+}
+
+// annotationAllowed reports whether the namespace annotation key may be attached to metrics.
+func (r *EnrichmentRules) annotationAllowed(key string) bool {
+	return slices.Contains(r.AnnotationAllowlist, key)
+}
@@ -2,12 +2,28 @@ package metrics
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/relabel"
 )
 
 // ServerRunnable is a struct that implements Runnable interface.
@@ -20,76 +36,644 @@ type ServerRunnable struct {
 	nodeNameOrIP  string
 	nodePort      string
 	nodePath      string
+
+	tlsCertFile string
+	tlsKeyFile  string
+
+	mux *http.ServeMux
+	// endpoints holds the options of every registered endpoint by local path.
+	endpoints map[string]*ServerRunnableOpts
+	// opts is shared by every endpoint, only NodePath differs between them.
+	opts ServerRunnableOpts
 }
 
+// NodeNameEnv is the environment variable holding the name of the local node in LocalNodeOnly mode,
+// usually set from spec.nodeName with the downward API.
+const NodeNameEnv = "NODE_NAME"
+
+// PodNameEnv is the environment variable the default of ServerRunnableOpts.Instance is read from,
+// usually set from metadata.name with the downward API.
+const PodNameEnv = "POD_NAME"
+
+// Endpoint maps a path served by the proxy to a kubelet metrics path.
+type Endpoint struct {
+	// Path is the path served by the proxy, e.g. /metrics/resource.
+	Path string `yaml:"path"`
+	// KubeletPath is relative to the kubelet root, e.g. metrics/resource.
+	// When the kube-apiserver is used, it is relative to the node proxy path.
+	KubeletPath string `yaml:"kubeletPath"`
+}
+
+// Endpoints of the kubelet that are optionally served besides /metrics and /metrics/cadvisor.
+var (
+	ResourceMetricsEndpoint = Endpoint{Path: "/metrics/resource", KubeletPath: "metrics/resource"}
+	ProbeMetricsEndpoint    = Endpoint{Path: "/metrics/probes", KubeletPath: "metrics/probes"}
+)
+
 // ServerRunnableOpts is a struct that contains options for ServerRunnable.
 type ServerRunnableOpts struct {
-	RestConfig *rest.Config
+	RestConfig *rest.Config `yaml:"-"`
+
+	KubeApiserver string `yaml:"kubeApiserver"`
+	NodeNameOrIP  string `yaml:"nodeNameOrIP"`
+	NodePort      string `yaml:"nodePort"`
+	NodePath      string `yaml:"-"`
+	// Scheme of the kubelet or kube-apiserver URL, http or https. Defaults to DefaultScheme.
+	// Plain http is only meant for read-only kubelet ports and test harnesses.
+	Scheme string `yaml:"scheme"`
+
+	// Nodes are fetched concurrently and merged into one response, every metric labeled with the name of
+	// its node under NodeLabelName, "node" by default. NodeNameOrIP is not scraped when Nodes is set.
+	// A node failing to respond is logged and skipped unless all nodes fail.
+	Nodes []NodeTarget `yaml:"nodes"`
+
+	// LocalNodeOnly targets the kubelet of the node the proxy runs on and takes precedence over KubeApiserver,
+	// which is ignored. The node name is read from the NodeNameEnv environment variable and resolved
+	// to its InternalIP like with ResolveNodeIP. Without the variable, the kubelet is reached on 127.0.0.1,
+	// which requires host networking.
+	LocalNodeOnly bool `yaml:"localNodeOnly"`
+
+	// UnixSocketPath is a Unix domain socket the kubelet is reached on, e.g. on hardened nodes without
+	// a kubelet TCP port. It takes precedence over NodeNameOrIP, NodePort, LocalNodeOnly and KubeApiserver,
+	// which are ignored: only the connection goes through the socket, requests keep their kubelet path.
+	UnixSocketPath string `yaml:"unixSocketPath"`
+
+	// ResolveNodeIP treats NodeNameOrIP as a node name and fetches from the InternalIP of that Node,
+	// read with NodeReader. It has no effect without NodeReader or when the kube-apiserver is used.
+	ResolveNodeIP bool          `yaml:"resolveNodeIP"`
+	NodeReader    client.Reader `yaml:"-"`
+
+	// InsecureSkipVerify disables verification of the kubelet serving certificate.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+	// KubeletCAFile is a PEM CA bundle used to verify the kubelet serving certificate.
+	// It takes precedence over InsecureSkipVerify.
+	KubeletCAFile string `yaml:"kubeletCAFile"`
+	// UpstreamProxyURL is a forward proxy kubelet requests are sent through, e.g. http://proxy:3128.
+	// It overrides the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, which are used when empty.
+	UpstreamProxyURL string `yaml:"upstreamProxyURL"`
+	// UpstreamHeaders are added to every kubelet request, e.g. for an auth gateway in front of the kubelet.
+	// The credentials of the rest config are only replaced when their header, e.g. Authorization, is listed.
+	UpstreamHeaders map[string]string `yaml:"upstreamHeaders"`
+	// Transport sends the kubelet requests instead of the transport built from RestConfig, e.g. a fake in tests.
+	// The RestConfig credentials, KubeletCAFile, InsecureSkipVerify, UpstreamProxyURL and UnixSocketPath
+	// do not apply to it.
+	Transport http.RoundTripper `yaml:"-"`
+
+	// NamespaceSelector restricts the namespaces whose labels are stored to those it matches.
+	// Nil stores every namespace. In the config file it is written as a selector string, e.g. "team,tier=web".
+	NamespaceSelector *metav1.LabelSelector `yaml:"-"`
+	// ExcludeNamespaces are never stored nor injected, their metrics are served without namespace labels,
+	// e.g. kube-system.
+	ExcludeNamespaces []string `yaml:"excludeNamespaces"`
+	// OnlyEnriched drops the metrics whose namespace label does not match a stored namespace,
+	// including metrics without the label and those of ExcludeNamespaces.
+	OnlyEnriched bool `yaml:"onlyEnriched"`
+
+	// NamespaceLabelKey is the metric label holding the namespace name.
+	// Defaults to DefaultNamespaceLabelKey when empty.
+	NamespaceLabelKey string `yaml:"namespaceLabelKey"`
+	// LabelAllowlist restricts which namespace labels are attached to metrics.
+	// An empty allowlist attaches all namespace labels.
+	LabelAllowlist []string `yaml:"labelAllowlist"`
+	// LabelDenylist removes namespace labels that survived the allowlist.
+	LabelDenylist []string `yaml:"labelDenylist"`
+	// LabelPrefix is prepended to the name of every injected label.
+	LabelPrefix string `yaml:"labelPrefix"`
+	// AnnotationAllowlist lists namespace annotations attached to metrics as labels.
+	AnnotationAllowlist []string `yaml:"annotationAllowlist"`
+	// NamespaceCreationTime attaches the creation time of the namespace of a metric, in unix seconds,
+	// as the namespace_created label, e.g. for age-based cost allocation.
+	NamespaceCreationTime bool `yaml:"namespaceCreationTime"`
+	// PodLabelAllowlist enables pod label enrichment: the listed labels of the Pod a metric belongs to,
+	// found by its namespace and "pod" labels, are attached to the metric. Pods are not watched when empty
+	// and PodOwnerLabels is not set.
+	// Only listed labels are stored and attached, to keep the cardinality under control.
+	PodLabelAllowlist []string `yaml:"podLabelAllowlist"`
+	// PodOwnerLabels attaches the workload owning the pod of a metric as the owner_kind and owner_name labels,
+	// e.g. Deployment and the name of the Deployment of its ReplicaSet. Pods without an owner get neither.
+	PodOwnerLabels bool `yaml:"podOwnerLabels"`
+	// PodMetrics holds the pod labels and owners stored by the pod reconciler. Nothing is attached when nil.
+	PodMetrics *PodMetrics `yaml:"-"`
+	// MaxInjectedLabels caps the namespace labels, annotations, creation time and pod labels attached to a single metric,
+	// taken in key order. Zero means no cap.
+	MaxInjectedLabels int `yaml:"maxInjectedLabels"`
+	// NormalizeLabelValues trims and lowercases the values of the namespace labels, annotations and pod labels
+	// attached to metrics, so e.g. team=Frontend and team=frontend end up in the same series. Names are kept.
+	NormalizeLabelValues bool `yaml:"normalizeLabelValues"`
+
+	// DropLabels are removed from the kubelet metrics before enrichment, e.g. the cadvisor id and image labels.
+	// Injected labels are never dropped.
+	DropLabels []string `yaml:"dropLabels"`
+
+	// RenameLabels renames labels of the kubelet metrics, old name to new name, before enrichment.
+	// A label is not renamed when the metric already has a label with the new name.
+	RenameLabels map[string]string `yaml:"renameLabels"`
+
+	// StaticLabels are added to every metric, e.g. cluster: prod-eu.
+	// A label the metric already has is left alone.
+	StaticLabels map[string]string `yaml:"staticLabels"`
+	// LabelPrecedence orders the sources of the labels attached to every metric, see the LabelSource constants.
+	// A source applied earlier wins a name clash, while the labels of the kubelet itself always win.
+	// Sources left out follow in their DefaultLabelPrecedence order: namespace, pod, static and node.
+	LabelPrecedence []string `yaml:"labelPrecedence"`
+
+	// StripTimestamps removes the explicit timestamps some kubelet metrics carry, so the scraper
+	// uses the scrape time instead. Timestamps are kept by default.
+	StripTimestamps bool `yaml:"stripTimestamps"`
+
+	// NodeLabelName is the label set to NodeNameOrIP on every metric that does not have it yet.
+	// No node label is added when empty.
+	NodeLabelName string `yaml:"nodeLabelName"`
+
+	// Instance is set as the kmp_instance label of every metric, to tell which replica of the proxy
+	// served it. Defaults to the PodNameEnv environment variable, no label is added when both are empty.
+	Instance string `yaml:"instance"`
+
+	// ServeResourceMetrics and ServeProbeMetrics additionally serve the kubelet
+	// /metrics/resource and /metrics/probes endpoints.
+	ServeResourceMetrics bool `yaml:"serveResourceMetrics"`
+	ServeProbeMetrics    bool `yaml:"serveProbeMetrics"`
+	// ExtraEndpoints are further kubelet paths served through the same fetch and enrich pipeline.
+	ExtraEndpoints []Endpoint `yaml:"extraEndpoints"`
+
+	// ProbeAllowedPaths are the kubelet paths that can be fetched and enriched on demand with
+	// GET /probe?path=<kubelet path>, e.g. /metrics/resource. /probe is not served when empty.
+	ProbeAllowedPaths []string `yaml:"probeAllowedPaths"`
+
+	// PushGatewayURL enables the push mode of NewPushRunnable: every PushInterval, PushKubeletPath
+	// is fetched and enriched and pushed to the Pushgateway under PushJob and PushGroupingKey.
+	// Defaults are DefaultPushInterval, DefaultPushJob and DefaultPushKubeletPath.
+	PushGatewayURL  string            `yaml:"pushGatewayURL"`
+	PushInterval    time.Duration     `yaml:"pushInterval"`
+	PushJob         string            `yaml:"pushJob"`
+	PushGroupingKey map[string]string `yaml:"pushGroupingKey"`
+	PushKubeletPath string            `yaml:"pushKubeletPath"`
+
+	// OTLPEndpoint enables the OTLP export of NewOTLPRunnable: every OTLPInterval, OTLPKubeletPath
+	// is fetched and enriched and exported to this OTLP/gRPC host:port, over TLS unless OTLPInsecure is set.
+	// Defaults are DefaultOTLPInterval and DefaultOTLPKubeletPath.
+	OTLPEndpoint    string        `yaml:"otlpEndpoint"`
+	OTLPInterval    time.Duration `yaml:"otlpInterval"`
+	OTLPInsecure    bool          `yaml:"otlpInsecure"`
+	OTLPKubeletPath string        `yaml:"otlpKubeletPath"`
+
+	// MetricNameKeep restricts the exported metric families to names matching one of the regexes.
+	// MetricNameDrop removes families whose name matches one of the regexes.
+	// Regexes are fully anchored and a name matching MetricNameKeep is never dropped.
+	MetricNameKeep []string `yaml:"metricNameKeep"`
+	MetricNameDrop []string `yaml:"metricNameDrop"`
+	// Preset names one of the MetricPresets, e.g. resource-basic, to only export its metric names.
+	// MetricNameKeep replaces the preset and MetricNameDrop removes names from it.
+	Preset string `yaml:"preset"`
+
+	// RelabelConfigs are Prometheus-style relabeling rules applied to every metric after enrichment.
+	// They can only be set from the config file.
+	RelabelConfigs []relabel.RelabelConfig `yaml:"relabelConfigs"`
+
+	// FetchTimeout bounds a single kubelet fetch. Zero means no timeout besides the request context.
+	FetchTimeout time.Duration `yaml:"fetchTimeout"`
+	// FetchMaxAttempts is the number of attempts for a kubelet fetch, retrying network errors and 5xx.
+	// Values below 2 disable retries.
+	FetchMaxAttempts int `yaml:"fetchMaxAttempts"`
+	// FetchRetryBaseDelay is the delay before the first retry, doubled for every following one.
+	FetchRetryBaseDelay time.Duration `yaml:"fetchRetryBaseDelay"`
+	// Preflight makes the proxy fetch the kubelet metrics once at startup and exit when it fails.
+	// See ServerRunnable.Preflight.
+	Preflight bool `yaml:"preflight"`
+
+	// LenientParsing skips malformed metric families of the kubelet response, logging and counting them
+	// in kmp_parse_errors_total, instead of failing the scrape. The response is buffered to be parsed again.
+	LenientParsing bool `yaml:"lenientParsing"`
+
+	// MaxResponseBytes is the largest kubelet response read, larger responses fail the fetch.
+	// Defaults to DefaultMaxResponseBytes when zero.
+	MaxResponseBytes int64 `yaml:"maxResponseBytes"`
+
+	// MaxConcurrentScrapes bounds the number of kubelet fetches running at the same time. Zero means no limit.
+	MaxConcurrentScrapes int `yaml:"maxConcurrentScrapes"`
+	// CircuitBreakerThreshold is the number of consecutive failed fetches of a kubelet URL after which
+	// it is not contacted for CircuitBreakerCooldown, and scrapes are answered with 503 right away.
+	// Zero disables the circuit breaker. The cooldown defaults to DefaultCircuitBreakerCooldown.
+	CircuitBreakerThreshold int           `yaml:"circuitBreakerThreshold"`
+	CircuitBreakerCooldown  time.Duration `yaml:"circuitBreakerCooldown"`
+	// ScrapeQueueTimeout is how long a scrape waits for a free fetch slot before it is answered with 429.
+	// Zero waits until the scrape request is cancelled.
+	ScrapeQueueTimeout time.Duration `yaml:"scrapeQueueTimeout"`
+
+	// CacheTTL is how long a kubelet response is reused. Zero disables caching.
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+	// CacheTTLs overrides CacheTTL for the endpoints served on the given local paths,
+	// e.g. a longer TTL for the heavier /metrics/cadvisor. Zero disables caching of the endpoint.
+	CacheTTLs map[string]time.Duration `yaml:"cacheTTLs"`
+	// MinScrapeInterval is the shortest time between two fetches of the same endpoint, whoever scrapes it.
+	// Scrapes arriving sooner are served the last kubelet response, so the TTLs of CacheTTL and CacheTTLs
+	// shorter than it, including zero, are raised to it.
+	MinScrapeInterval time.Duration `yaml:"minScrapeInterval"`
 
-	KubeApiserver string
-	NodeNameOrIP  string
-	NodePort      string
-	NodePath      string
+	// BindAddress is the host:port the proxy listens on. Defaults to ":<port>", all interfaces.
+	BindAddress string `yaml:"bindAddress"`
+
+	// AuthTokenFile holds a bearer token required to scrape the metrics endpoints.
+	// Authentication is disabled when empty.
+	AuthTokenFile string `yaml:"authTokenFile"`
+
+	// TLSCertFile and TLSKeyFile enable serving the proxy over HTTPS when both are set.
+	// The certificate is reloaded when the files change.
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+
+	// EnablePprof serves the net/http/pprof handlers under /debug/pprof/, protected like the metrics endpoints.
+	EnablePprof bool `yaml:"enablePprof"`
+	// EnableDebugEndpoints serves the stored namespace labels on /debug/namespaces, the Preview of an endpoint
+	// on /debug/preview and its un-enriched kubelet metrics on /metrics/raw, protected like the metrics endpoints.
+	// Without AuthTokenFile, anyone reaching the proxy can read the raw kubelet output.
+	EnableDebugEndpoints bool `yaml:"enableDebugEndpoints"`
+
+	// RegisterManagerMetrics also registers the kmp_* metrics of the proxy with the controller-runtime
+	// registry, so they are served by the manager metrics endpoint next to the controller metrics.
+	RegisterManagerMetrics bool `yaml:"registerManagerMetrics"`
+
+	// JSONErrors answers failed scrapes with a JSON body holding a sanitized message and a code,
+	// e.g. {"error": "kubelet did not respond in time", "code": "timeout"}, instead of the plain error text.
+	JSONErrors bool `yaml:"jsonErrors"`
+	// TextContentType replaces the Content-Type of responses in the text format, e.g. to pin
+	// "text/plain; version=0.0.4" for scrapers expecting it. Other formats keep the negotiated one.
+	TextContentType string `yaml:"textContentType"`
+
+	// AccessLog logs every request served by the proxy with its method, path, status, size and duration.
+	AccessLog bool `yaml:"accessLog"`
+	// AccessLogVerbosity is the logr verbosity of the access log, e.g. 1 to only log at debug level.
+	AccessLogVerbosity int `yaml:"accessLogVerbosity"`
+
+	// Readiness gates the metrics endpoints until the namespace cache is synced and is served on /readyz.
+	// When nil, a Readiness with the cache already marked as synced is used.
+	Readiness *Readiness `yaml:"-"`
+
+	breaker *circuitBreaker
+	cache   *fetchCache
+	// rules holds the enrichment rules, shared by every endpoint so SetEnrichmentRules applies to all of them.
+	rules       *atomic.Pointer[EnrichmentRules]
+	client      *kubeletClient
+	limiter     *scrapeLimiter
+	nodeAddress *nodeAddressResolver
+	// kubeletPath is the served kubelet path relative to the node, used to build NodePath for Nodes.
+	kubeletPath string
+	// localPath is the path the endpoint is served on.
+	localPath string
+	// cacheTTL is how long the endpoint reuses kubelet responses, CacheTTL unless CacheTTLs sets it,
+	// and at least MinScrapeInterval.
+	cacheTTL time.Duration
+	// nameFilter is MetricNameKeep, MetricNameDrop and Preset compiled once, shared by every endpoint.
+	nameFilter  *metricNameFilter
+	selfMetrics *proxyMetrics
 }
 
-// NewServerRunnable is a constructor that creates http.Server and handler.
-func NewServerRunnable(
-	restConfig *rest.Config,
-	port string,
-	nm *NamespaceMetrics,
-	kubeApiserver, nodeNameOrIP, nodePort string,
-) *ServerRunnable {
-	mux := http.NewServeMux()
-	nodePath := "/"
-	if kubeApiserver != "" {
-		nodePath = fmt.Sprintf("/api/v1/nodes/%s/proxy/", nodeNameOrIP)
+// Validate reports options that would make every scrape fail.
+func (opts *ServerRunnableOpts) Validate() error {
+	if _, err := newMetricNameFilter(opts); err != nil {
+		return err
+	}
+	for i, node := range opts.Nodes {
+		if node.Name == "" {
+			return fmt.Errorf("node %d: name must be set", i)
+		}
+	}
+	if err := validateLabelPrecedence(opts.LabelPrecedence); err != nil {
+		return err
+	}
+	if opts.TextContentType != "" && expfmt.Format(opts.TextContentType).FormatType() != expfmt.TypeTextPlain {
+		return fmt.Errorf("invalid text content type %q: must be text/plain with version %s", opts.TextContentType,
+			expfmt.TextVersion)
+	}
+	if opts.UnixSocketPath != "" && len(opts.Nodes) > 0 {
+		return fmt.Errorf("nodes can not be scraped through the kubelet Unix socket %q", opts.UnixSocketPath)
+	}
+	for _, ep := range opts.ExtraEndpoints {
+		if !strings.HasPrefix(ep.Path, "/") || ep.KubeletPath == "" {
+			return fmt.Errorf("invalid endpoint %q -> %q: path must start with / and kubelet path must be set",
+				ep.Path, ep.KubeletPath)
+		}
+	}
+	switch opts.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("invalid scheme %q: must be http or https", opts.Scheme)
 	}
+	for path := range opts.CacheTTLs {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid cache TTL endpoint %q: path must start with /", path)
+		}
+	}
+	for name, value := range opts.UpstreamHeaders {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid upstream header %q", name)
+		}
+	}
+	if opts.UpstreamProxyURL != "" {
+		if u, err := url.Parse(opts.UpstreamProxyURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid upstream proxy URL %q: scheme and host must be set", opts.UpstreamProxyURL)
+		}
+	}
+	if opts.PushGatewayURL != "" {
+		if u, err := url.Parse(opts.PushGatewayURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid Pushgateway URL %q: scheme and host must be set", opts.PushGatewayURL)
+		}
+	}
+	for name := range opts.StaticLabels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid static label name %q", name)
+		}
+	}
+	if _, err := metav1.LabelSelectorAsSelector(opts.NamespaceSelector); err != nil {
+		return fmt.Errorf("namespace selector: %w", err)
+	}
+	for i := range opts.RelabelConfigs {
+		if err := opts.RelabelConfigs[i].Validate(); err != nil {
+			return fmt.Errorf("relabel config %d: %w", i, err)
+		}
+	}
+	return nil
+}
 
-	sharedHandlerMetrics := Handler(nm, &ServerRunnableOpts{
-		KubeApiserver: kubeApiserver,
-		RestConfig:    restConfig,
-		NodeNameOrIP:  nodeNameOrIP,
-		NodePort:      nodePort,
-		NodePath:      fmt.Sprintf("%smetrics", nodePath),
-	})
+// NewServerRunnable is a constructor that creates http.Server and handler.
+// NodePath of opts is ignored, it is derived for every served endpoint.
+// It returns an error when the kubelet port or the port the proxy listens on is not a valid port number.
+func NewServerRunnable(port string, nm *NamespaceMetrics, opts ServerRunnableOpts) (*ServerRunnable, error) {
+	return NewServerRunnableWithOptions(opts.RestConfig, nm, WithServerRunnableOpts(opts), WithPort(port))
+}
 
-	sharedHandlerCadvisorMetrics := Handler(nm, &ServerRunnableOpts{
-		KubeApiserver: kubeApiserver,
-		RestConfig:    restConfig,
-		NodeNameOrIP:  nodeNameOrIP,
-		NodePort:      nodePort,
-		NodePath:      fmt.Sprintf("%smetrics/cadvisor", nodePath),
-	})
+// newServerRunnable creates the ServerRunnable once all options are applied.
+func newServerRunnable(port string, nm *NamespaceMetrics, opts ServerRunnableOpts) (*ServerRunnable, error) {
+	addr := opts.BindAddress
+	if addr == "" {
+		addr = ":" + port
+	}
+	if err := validatePorts(addr, &opts); err != nil {
+		return nil, err
+	}
+	nameFilter, err := newMetricNameFilter(&opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.nameFilter = nameFilter
 
-	mux.Handle("/metrics", sharedHandlerMetrics)
-	mux.Handle("/metrics/cadvisor", sharedHandlerCadvisorMetrics)
+	mux := http.NewServeMux()
+	if opts.LocalNodeOnly {
+		opts.KubeApiserver = ""
+		opts.NodeNameOrIP = "127.0.0.1"
+		if nodeName := os.Getenv(NodeNameEnv); nodeName != "" {
+			opts.NodeNameOrIP = nodeName
+			opts.ResolveNodeIP = true
+		}
+	}
+	if opts.Instance == "" {
+		opts.Instance = os.Getenv(PodNameEnv)
+	}
+	if opts.UnixSocketPath != "" {
+		opts.KubeApiserver = ""
+		opts.NodeNameOrIP = "localhost"
+		opts.ResolveNodeIP = false
+	}
+	opts.client = &kubeletClient{}
+	opts.rules = newRulesPointer(&opts)
+	opts.selfMetrics = newProxyMetrics(nm)
+	if opts.RegisterManagerMetrics {
+		if err := opts.selfMetrics.registerWith(ctrlmetrics.Registry); err != nil {
+			log.Printf("Failed to register proxy metrics with the manager registry: %v\n", err)
+		}
+	}
+	if opts.Readiness == nil {
+		opts.Readiness = NewReadiness()
+		opts.Readiness.SetCacheSynced()
+	}
+	if opts.CacheTTL > 0 || len(opts.CacheTTLs) > 0 || opts.MinScrapeInterval > 0 {
+		opts.cache = newFetchCache()
+	}
+	if opts.ResolveNodeIP && opts.NodeReader != nil {
+		opts.nodeAddress = newNodeAddressResolver(opts.NodeReader, opts.NodeNameOrIP)
+	}
+	if opts.CircuitBreakerThreshold > 0 {
+		opts.breaker = newCircuitBreaker(opts.CircuitBreakerThreshold, opts.CircuitBreakerCooldown,
+			opts.selfMetrics.observeBreakerState)
+	}
+	if opts.MaxConcurrentScrapes > 0 {
+		opts.limiter = newScrapeLimiter(opts.MaxConcurrentScrapes, opts.ScrapeQueueTimeout)
+	}
 
-	return &ServerRunnable{
-		restConfig: restConfig,
+	sr := &ServerRunnable{
+		restConfig: opts.RestConfig,
 		httpServer: &http.Server{
-			Addr:    ":" + port,
+			Addr:    addr,
 			Handler: mux,
 		},
 		namespaceMetrics: nm,
-		kubeApiserver:    kubeApiserver,
-		nodeNameOrIP:     nodeNameOrIP,
-		nodePort:         nodePort,
+		kubeApiserver:    opts.KubeApiserver,
+		nodeNameOrIP:     opts.NodeNameOrIP,
+		nodePort:         opts.NodePort,
+		nodePath:         nodePathPrefix(opts.KubeApiserver, opts.NodeNameOrIP),
+		tlsCertFile:      opts.TLSCertFile,
+		tlsKeyFile:       opts.TLSKeyFile,
+		mux:              mux,
+		endpoints:        make(map[string]*ServerRunnableOpts),
+		opts:             opts,
+	}
+
+	endpoints := []Endpoint{
+		{Path: "/metrics", KubeletPath: "metrics"},
+		{Path: "/metrics/cadvisor", KubeletPath: "metrics/cadvisor"},
+	}
+	if opts.ServeResourceMetrics {
+		endpoints = append(endpoints, ResourceMetricsEndpoint)
+	}
+	if opts.ServeProbeMetrics {
+		endpoints = append(endpoints, ProbeMetricsEndpoint)
+	}
+	for _, ep := range append(endpoints, opts.ExtraEndpoints...) {
+		sr.RegisterEndpoint(ep.Path, ep.KubeletPath)
+	}
+
+	if len(opts.ProbeAllowedPaths) > 0 {
+		mux.Handle("/probe", bearerAuth(opts.AuthTokenFile, sr.probeHandler(opts.ProbeAllowedPaths)))
+	}
+	mux.Handle("/proxy-metrics", bearerAuth(opts.AuthTokenFile, opts.selfMetrics.handler()))
+	mux.HandleFunc("/healthz", healthzHandler)
+	if opts.EnablePprof {
+		mux.Handle("/debug/pprof/", bearerAuth(opts.AuthTokenFile, http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", bearerAuth(opts.AuthTokenFile, http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", bearerAuth(opts.AuthTokenFile, http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", bearerAuth(opts.AuthTokenFile, http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", bearerAuth(opts.AuthTokenFile, http.HandlerFunc(pprof.Trace)))
+	}
+	if opts.EnableDebugEndpoints {
+		mux.Handle("/debug/namespaces", bearerAuth(opts.AuthTokenFile, NamespacesHandler(nm)))
+		mux.Handle("/debug/preview", bearerAuth(opts.AuthTokenFile, sr.previewHandler()))
+		mux.Handle("/metrics/raw", bearerAuth(opts.AuthTokenFile, sr.rawHandler()))
+	}
+	mux.Handle("/readyz", readyzHandler(opts.Readiness))
+	if opts.AccessLog {
+		sr.httpServer.Handler = accessLog(opts.AccessLogVerbosity, mux)
+	}
+
+	return sr, nil
+}
+
+// ScrapedNodeName returns the name of the single node whose kubelet is scraped, or "" when several nodes
+// are scraped or the node is only known by its address. It is used to only watch the pods of that node.
+func (opts *ServerRunnableOpts) ScrapedNodeName() string {
+	switch {
+	case len(opts.Nodes) > 0:
+		return ""
+	case opts.UnixSocketPath != "" || opts.LocalNodeOnly:
+		return os.Getenv(NodeNameEnv)
+	case (opts.KubeApiserver != "" || opts.ResolveNodeIP) && net.ParseIP(opts.NodeNameOrIP) == nil:
+		return opts.NodeNameOrIP
+	default:
+		return ""
 	}
 }
 
+// validatePorts checks the port of the listen address addr and the kubelet ports of opts,
+// which would otherwise only fail on the first scrape with a confusing connection error.
+func validatePorts(addr string, opts *ServerRunnableOpts) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid bind address %q: %w", addr, err)
+	}
+	// Port 0 picks any free port to listen on.
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid bind address %q: port must be a number between 0 and 65535", addr)
+	}
+	if opts.UnixSocketPath == "" {
+		if err := validateKubeletPort(opts.NodePort); err != nil {
+			return fmt.Errorf("invalid node port: %w", err)
+		}
+	}
+	for _, node := range opts.Nodes {
+		if node.Port == "" {
+			continue
+		}
+		if err := validateKubeletPort(node.Port); err != nil {
+			return fmt.Errorf("invalid port of node %q: %w", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateKubeletPort checks that port is a number between 1 and 65535.
+func validateKubeletPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%q is not a number between 1 and 65535", port)
+	}
+	return nil
+}
+
+// RegisterEndpoint serves the kubelet path kubeletPath, enriched, on localPath.
+// kubeletPath is relative to the kubelet root, or to the node proxy path when the kube-apiserver is used.
+// It must be called before Start and panics if localPath is already registered.
+func (sr *ServerRunnable) RegisterEndpoint(localPath, kubeletPath string) {
+	opts := sr.endpointOpts(localPath, kubeletPath)
+	sr.endpoints[localPath] = opts
+	sr.mux.Handle(localPath, bearerAuth(opts.AuthTokenFile, Handler(sr.namespaceMetrics, opts)))
+}
+
+// endpointOpts returns a copy of the options serving kubeletPath on localPath.
+func (sr *ServerRunnable) endpointOpts(localPath, kubeletPath string) *ServerRunnableOpts {
+	opts := sr.opts
+	opts.localPath = localPath
+	opts.kubeletPath = strings.TrimPrefix(kubeletPath, "/")
+	opts.NodePath = sr.nodePath + opts.kubeletPath
+	opts.cacheTTL = opts.CacheTTL
+	if ttl, ok := opts.CacheTTLs[localPath]; ok {
+		opts.cacheTTL = ttl
+	}
+	opts.cacheTTL = max(opts.cacheTTL, opts.MinScrapeInterval)
+	return &opts
+}
+
+// probeHandler serves GET /probe?path=<kubelet path>, fetching and enriching one of the allowed
+// kubelet paths on demand. Other paths are answered with 403, so the endpoint can not be used
+// to reach arbitrary kubelet APIs. The self-metrics of each probed path are labelled with its
+// own local path, e.g. /probe?path=/metrics/resource.
+func (sr *ServerRunnable) probeHandler(allowed []string) http.Handler {
+	handlers := make(map[string]http.Handler, len(allowed))
+	for _, kubeletPath := range allowed {
+		kubeletPath = strings.TrimPrefix(kubeletPath, "/")
+		handlers[kubeletPath] = Handler(sr.namespaceMetrics, sr.endpointOpts("/probe?path=/"+kubeletPath, kubeletPath))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeError(w, &sr.opts, scrapeError{status: http.StatusBadRequest, code: ErrorCodeBadRequest,
+				message: "missing path query parameter"}, "missing path query parameter")
+			return
+		}
+		handler, ok := handlers[strings.TrimPrefix(path, "/")]
+		if !ok {
+			writeError(w, &sr.opts, scrapeError{status: http.StatusForbidden, code: ErrorCodePathNotAllowed,
+				message: "kubelet path is not allowed"}, fmt.Sprintf("kubelet path %q is not allowed", path))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// nodePathPrefix returns the path kubelet paths of the node are relative to,
+// the node proxy path when the kube-apiserver is used.
+func nodePathPrefix(kubeApiserver, nodeName string) string {
+	if kubeApiserver != "" {
+		return fmt.Sprintf("/api/v1/nodes/%s/proxy/", nodeName)
+	}
+	return "/"
+}
+
+// healthzHandler reports that the process is alive without contacting the kubelet.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok"))
+}
+
 // Start will be called automatically when mgr.Start(...).
+// It returns the serve error if the server fails before the context is done.
 func (sr *ServerRunnable) Start(ctx context.Context) error {
-	log.Printf("Starting custom metrics server on %s\n", sr.httpServer.Addr)
+	serve := sr.httpServer.ListenAndServe
+	if sr.tlsCertFile != "" && sr.tlsKeyFile != "" {
+		certWatcher, err := certwatcher.New(sr.tlsCertFile, sr.tlsKeyFile)
+		if err != nil {
+			return fmt.Errorf("metrics server certificate: %w", err)
+		}
+		go func() {
+			if err := certWatcher.Start(ctx); err != nil {
+				log.Printf("Metrics server certificate watcher error: %v\n", err)
+			}
+		}()
+
+		sr.httpServer.TLSConfig = &tls.Config{GetCertificate: certWatcher.GetCertificate}
+		serve = func() error { return sr.httpServer.ListenAndServeTLS("", "") }
+		log.Printf("Starting custom metrics server on %s with TLS\n", sr.httpServer.Addr)
+	} else {
+		log.Printf("Starting custom metrics server on %s\n", sr.httpServer.Addr)
+	}
 
 	// Start server in a separate goroutine to not block Start().
+	errCh := make(chan error, 1)
 	go func() {
-		if err := sr.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("Metrics server error: %v\n", err)
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
 		}
+		close(errCh)
 	}()
 
-	// Wait until context is done.
-	<-ctx.Done()
+	// Wait until context is done or the server fails.
+	select {
+	case err, ok := <-errCh:
+		if ok {
+			return fmt.Errorf("metrics server on %s: %w", sr.httpServer.Addr, err)
+		}
+		return nil
+	case <-ctx.Done():
+	}
 
 	log.Printf("Shutting down metrics server on %s...\n", sr.httpServer.Addr)
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,1772 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/Uburro/kubelet-meta-proxy/internal/version"
+)
+
+func TestServerRunnableStartReturnsListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	sr := newTestServerRunnable(t, port, NewNamespaceMetrics(), ServerRunnableOpts{
+		RestConfig:   &rest.Config{},
+		NodeNameOrIP: "localhost",
+		NodePort:     "10250",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := sr.Start(ctx); err == nil {
+		t.Fatal("expected Start to return an error when the port is already in use")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Start returned only after the context expired")
+	}
+}
+
+// newFakeKubelet starts a TLS server serving testKubeletMetrics and returns
+// options pointing at it together with a counter of upstream requests.
+func newFakeKubelet(t testing.TB, handler http.HandlerFunc) (ServerRunnableOpts, *atomic.Int64) {
+	t.Helper()
+	hits := &atomic.Int64{}
+	if handler == nil {
+		handler = func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(testKubeletMetrics))
+		}
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("split host port: %v", err)
+	}
+	return ServerRunnableOpts{
+		RestConfig:   &rest.Config{TLSClientConfig: rest.TLSClientConfig{Insecure: true}},
+		NodeNameOrIP: host,
+		NodePort:     port,
+	}, hits
+}
+
+// newTestServerRunnable calls NewServerRunnable, failing the test on error.
+func newTestServerRunnable(t testing.TB, port string, nm *NamespaceMetrics, opts ServerRunnableOpts) *ServerRunnable {
+	t.Helper()
+	sr, err := NewServerRunnable(port, nm, opts)
+	if err != nil {
+		t.Fatalf("new server runnable: %v", err)
+	}
+	return sr
+}
+
+func serve(t *testing.T, sr *ServerRunnable, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	sr.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+// retryAfter returns the Retry-After header of rec in seconds, failing the test unless it is a positive number.
+func retryAfter(t *testing.T, rec *httptest.ResponseRecorder) int {
+	t.Helper()
+	v := rec.Header().Get("Retry-After")
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", v)
+	}
+	return seconds
+}
+
+func TestNewServerRunnableWithOptions(t *testing.T) {
+	kubelet, hits := newFakeKubelet(t, nil)
+	sr, err := NewServerRunnableWithOptions(kubelet.RestConfig, NewNamespaceMetrics(),
+		WithPort("9090"),
+		WithNode(kubelet.NodeNameOrIP, kubelet.NodePort),
+		WithCacheTTL(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("new server runnable: %v", err)
+	}
+
+	if sr.httpServer.Addr != ":9090" {
+		t.Errorf("Addr = %q, want :9090", sr.httpServer.Addr)
+	}
+	for i := 0; i < 2; i++ {
+		if rec := serve(t, sr, "/metrics"); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1 with caching", got)
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{name: "defaults", want: "https://localhost:10250/metrics"},
+		{
+			name: "node",
+			opts: []Option{WithNode("10.0.0.7", "10255")},
+			want: "https://10.0.0.7:10255/metrics",
+		},
+		{
+			name: "kube-apiserver",
+			opts: []Option{WithNode("worker-1", "443"), WithKubeApiserver("apiserver.example")},
+			want: "https://apiserver.example:443/api/v1/nodes/worker-1/proxy/metrics",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, err := NewServerRunnableWithOptions(&rest.Config{}, NewNamespaceMetrics(), tt.opts...)
+			if err != nil {
+				t.Fatalf("new server runnable: %v", err)
+			}
+			opts := sr.opts
+			opts.NodePath = sr.nodePath + "metrics"
+			if got := kubeletURL(&opts); got != tt.want {
+				t.Errorf("kubeletURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// roundTripperFunc is a stub http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestServerRunnableWithTransport(t *testing.T) {
+	var gotURL string
+	stub := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotURL = req.URL.String()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/plain; version=0.0.4"}},
+			Body:       io.NopCloser(strings.NewReader(testKubeletMetrics)),
+			Request:    req,
+		}, nil
+	})
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+
+	sr, err := NewServerRunnableWithOptions(&rest.Config{}, nm, WithNode("worker-1", "10250"), WithTransport(stub))
+	if err != nil {
+		t.Fatalf("new server runnable: %v", err)
+	}
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if gotURL != "https://worker-1:10250/metrics/cadvisor" {
+		t.Errorf("kubelet URL = %q, want https://worker-1:10250/metrics/cadvisor", gotURL)
+	}
+	if !strings.Contains(rec.Body.String(), `team="frontend"`) {
+		t.Errorf("expected the canned metrics to be enriched:\n%s", rec.Body.String())
+	}
+}
+
+func TestServerRunnableWithTransportWithoutRestConfig(t *testing.T) {
+	stub := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/plain; version=0.0.4"}},
+			Body:       io.NopCloser(strings.NewReader(testKubeletMetrics)),
+			Request:    req,
+		}, nil
+	})
+	opts := ServerRunnableOpts{NodeNameOrIP: "worker-1", NodePort: "10250", Transport: stub, EnableDebugEndpoints: true}
+	sr, err := NewServerRunnableWithOptions(nil, NewNamespaceMetrics(), WithServerRunnableOpts(opts))
+	if err != nil {
+		t.Fatalf("new server runnable: %v", err)
+	}
+
+	for _, path := range []string{"/metrics/cadvisor", "/debug/preview", "/metrics/raw"} {
+		if rec := serve(t, sr, path); rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, body: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+	if err := sr.Preflight(context.Background()); err != nil {
+		t.Errorf("preflight: %v", err)
+	}
+}
+
+func TestServerRunnableBindAddress(t *testing.T) {
+	sr := newTestServerRunnable(t, "8080", NewNamespaceMetrics(),
+		ServerRunnableOpts{RestConfig: &rest.Config{}, NodePort: "10250"})
+	if sr.httpServer.Addr != ":8080" {
+		t.Errorf("default Addr = %q, want :8080", sr.httpServer.Addr)
+	}
+
+	sr = newTestServerRunnable(t, "8080", NewNamespaceMetrics(), ServerRunnableOpts{
+		RestConfig:  &rest.Config{},
+		NodePort:    "10250",
+		BindAddress: "127.0.0.1:9090",
+	})
+	if sr.httpServer.Addr != "127.0.0.1:9090" {
+		t.Errorf("Addr = %q, want 127.0.0.1:9090", sr.httpServer.Addr)
+	}
+
+	sr, err := NewServerRunnableWithOptions(&rest.Config{}, NewNamespaceMetrics(), WithBindAddress("10.1.2.3:8080"))
+	if err != nil {
+		t.Fatalf("new server runnable: %v", err)
+	}
+	if sr.httpServer.Addr != "10.1.2.3:8080" {
+		t.Errorf("Addr with options = %q, want 10.1.2.3:8080", sr.httpServer.Addr)
+	}
+}
+
+func TestNewServerRunnableValidatesPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    string
+		opts    ServerRunnableOpts
+		wantErr string
+	}{
+		{name: "valid", port: "8080", opts: ServerRunnableOpts{NodePort: "10250"}},
+		{name: "any free port", port: "0", opts: ServerRunnableOpts{NodePort: "65535"}},
+		{
+			name: "valid bind address",
+			opts: ServerRunnableOpts{NodePort: "10250", BindAddress: "[::1]:9090"},
+		},
+		{name: "empty node port", port: "8080", wantErr: "invalid node port"},
+		{name: "non-numeric node port", port: "8080", opts: ServerRunnableOpts{NodePort: "kubelet"}, wantErr: "invalid node port"},
+		{name: "node port out of range", port: "8080", opts: ServerRunnableOpts{NodePort: "65536"}, wantErr: "invalid node port"},
+		{name: "node port zero", port: "8080", opts: ServerRunnableOpts{NodePort: "0"}, wantErr: "invalid node port"},
+		{name: "non-numeric port", port: "http", opts: ServerRunnableOpts{NodePort: "10250"}, wantErr: "invalid bind address"},
+		{
+			name:    "bind address without port",
+			opts:    ServerRunnableOpts{NodePort: "10250", BindAddress: "127.0.0.1"},
+			wantErr: "invalid bind address",
+		},
+		{
+			name:    "bind address port out of range",
+			opts:    ServerRunnableOpts{NodePort: "10250", BindAddress: "127.0.0.1:70000"},
+			wantErr: "invalid bind address",
+		},
+		{
+			name:    "aggregated node port",
+			port:    "8080",
+			opts:    ServerRunnableOpts{NodePort: "10250", Nodes: []NodeTarget{{Name: "worker-1", Port: "-1"}}},
+			wantErr: `invalid port of node "worker-1"`,
+		},
+		{
+			name:    "invalid metric name filter",
+			port:    "8080",
+			opts:    ServerRunnableOpts{NodePort: "10250", MetricNameKeep: []string{"container_("}},
+			wantErr: "metric name keep filter",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.RestConfig = &rest.Config{}
+			_, err := NewServerRunnable(tt.port, NewNamespaceMetrics(), tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScrapedNodeName(t *testing.T) {
+	t.Setenv(NodeNameEnv, "worker-1")
+	tests := []struct {
+		name string
+		opts ServerRunnableOpts
+		want string
+	}{
+		{name: "local node", opts: ServerRunnableOpts{LocalNodeOnly: true}, want: "worker-1"},
+		{name: "unix socket", opts: ServerRunnableOpts{UnixSocketPath: "/var/run/kubelet.sock"}, want: "worker-1"},
+		{name: "resolved node", opts: ServerRunnableOpts{NodeNameOrIP: "worker-2", ResolveNodeIP: true}, want: "worker-2"},
+		{
+			name: "kube-apiserver proxy",
+			opts: ServerRunnableOpts{NodeNameOrIP: "worker-2", KubeApiserver: "10.0.0.1"},
+			want: "worker-2",
+		},
+		{name: "node address", opts: ServerRunnableOpts{NodeNameOrIP: "10.0.0.2", ResolveNodeIP: true}},
+		{name: "unresolved node", opts: ServerRunnableOpts{NodeNameOrIP: "worker-2"}},
+		{
+			name: "several nodes",
+			opts: ServerRunnableOpts{LocalNodeOnly: true, Nodes: []NodeTarget{{Name: "worker-1"}, {Name: "worker-2"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.ScrapedNodeName(); got != tt.want {
+				t.Errorf("ScrapedNodeName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerRunnableCachesKubeletResponses(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	opts.CacheTTL = time.Minute
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	for i := 0; i < 5; i++ {
+		if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1", got)
+	}
+
+	serve(t, sr, "/metrics")
+	if got := hits.Load(); got != 2 {
+		t.Errorf("upstream hits after other path = %d, want 2", got)
+	}
+}
+
+func TestServerRunnablePerEndpointCacheTTLs(t *testing.T) {
+	var metricsHits, cadvisorHits atomic.Int64
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics/cadvisor" {
+			cadvisorHits.Add(1)
+		} else {
+			metricsHits.Add(1)
+		}
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	opts.CacheTTL = time.Millisecond
+	opts.CacheTTLs = map[string]time.Duration{"/metrics/cadvisor": time.Minute}
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	for i := 0; i < 3; i++ {
+		for _, path := range []string{"/metrics", "/metrics/cadvisor"} {
+			if rec := serve(t, sr, path); rec.Code != http.StatusOK {
+				t.Fatalf("%s: status = %d, body: %s", path, rec.Code, rec.Body.String())
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := cadvisorHits.Load(); got != 1 {
+		t.Errorf("cadvisor upstream hits = %d, want 1 with a one minute TTL", got)
+	}
+	if got := metricsHits.Load(); got != 3 {
+		t.Errorf("metrics upstream hits = %d, want 3 with the shared 1ms TTL", got)
+	}
+}
+
+func TestServerRunnableWithoutCacheTTLFetchesEveryTime(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	for i := 0; i < 3; i++ {
+		serve(t, sr, "/metrics/cadvisor")
+	}
+	if got := hits.Load(); got != 3 {
+		t.Errorf("upstream hits = %d, want 3", got)
+	}
+}
+
+func TestServerRunnableMinScrapeInterval(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	opts.MinScrapeInterval = time.Minute
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1 within the minimum scrape interval", got)
+	}
+
+	// Another endpoint has its own interval.
+	serve(t, sr, "/metrics")
+	if got := hits.Load(); got != 2 {
+		t.Errorf("upstream hits = %d, want 2 after scraping another endpoint", got)
+	}
+}
+
+func BenchmarkServerRunnableScrape(b *testing.B) {
+	opts, _ := newFakeKubelet(b, nil)
+	sr := newTestServerRunnable(b, "0", NewNamespaceMetrics(), opts)
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		sr.httpServer.Handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func BenchmarkServerRunnableScrape5MB(b *testing.B) {
+	payload := []byte(largeCadvisorPayload(5 << 20))
+	opts, _ := newFakeKubelet(b, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(payload)
+	})
+	sr := newTestServerRunnable(b, "0", NewNamespaceMetrics(), opts)
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		sr.httpServer.Handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestServerRunnableGzipResponse(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	plain := serve(t, sr, "/metrics/cadvisor")
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("unexpected Content-Encoding %q", plain.Header().Get("Content-Encoding"))
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	sr.httpServer.Handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if string(body) != plain.Body.String() {
+		t.Errorf("decompressed body differs from plain body:\n%s\n---\n%s", body, plain.Body.String())
+	}
+}
+
+func TestServerRunnableDecompressesGzipKubeletResponse(t *testing.T) {
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding = %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte(testKubeletMetrics))
+		_ = gz.Close()
+	})
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "container_cpu_usage_seconds_total") {
+		t.Errorf("decompressed metrics missing from response:\n%s", rec.Body.String())
+	}
+}
+
+func TestServerRunnableOpenMetrics(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	sr.httpServer.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/openmetrics-text") {
+		t.Errorf("Content-Type = %q, want application/openmetrics-text", got)
+	}
+	if body := rec.Body.String(); !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("OpenMetrics output lacks the trailing # EOF:\n%s", body)
+	}
+
+	plain := serve(t, sr, "/metrics/cadvisor")
+	if got, want := plain.Header().Get("Content-Type"), string(expfmt.NewFormat(expfmt.TypeTextPlain)); got != want {
+		t.Errorf("Content-Type without Accept = %q, want %q", got, want)
+	}
+	if strings.Contains(plain.Body.String(), "# EOF") {
+		t.Errorf("text output contains # EOF:\n%s", plain.Body.String())
+	}
+}
+
+func TestServerRunnableContentType(t *testing.T) {
+	tests := []struct {
+		name            string
+		accept          string
+		textContentType string
+		want            string
+	}{
+		{
+			name: "text",
+			want: "text/plain; version=0.0.4; charset=utf-8",
+		},
+		{
+			name:   "openmetrics 1.0.0",
+			accept: "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5",
+			want:   "application/openmetrics-text; version=1.0.0; charset=utf-8",
+		},
+		{
+			name:   "openmetrics 0.0.1",
+			accept: "application/openmetrics-text;version=0.0.1",
+			want:   "application/openmetrics-text; version=0.0.1; charset=utf-8",
+		},
+		{
+			name:   "protobuf",
+			accept: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+			want:   "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited",
+		},
+		{
+			name:            "pinned text",
+			textContentType: "text/plain; version=0.0.4",
+			want:            "text/plain; version=0.0.4",
+		},
+		{
+			name:            "pinned text with openmetrics",
+			accept:          "application/openmetrics-text;version=1.0.0",
+			textContentType: "text/plain; version=0.0.4",
+			want:            "application/openmetrics-text; version=1.0.0; charset=utf-8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, _ := newFakeKubelet(t, nil)
+			opts.TextContentType = tt.textContentType
+			sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			sr.httpServer.Handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	opts := ServerRunnableOpts{TextContentType: "application/json"}
+	if err := opts.Validate(); err == nil {
+		t.Error("expected an error for a text content type that is not text/plain")
+	}
+}
+
+func TestServerRunnableProtobuf(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	sr := newTestServerRunnable(t, "0", nm, opts)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+	req.Header.Set("Accept",
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3")
+	sr.httpServer.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	if got := rec.Header().Get("Content-Type"); expfmt.Format(got).FormatType() != expfmt.TypeProtoDelim {
+		t.Fatalf("Content-Type = %q, want %q", got, format)
+	}
+
+	decoder := expfmt.NewDecoder(rec.Body, format)
+	families := map[string]*dto.MetricFamily{}
+	for {
+		mf := &dto.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		families[mf.GetName()] = mf
+	}
+
+	mf, ok := families["container_memory_working_set_bytes"]
+	if !ok || len(families) != 3 {
+		t.Fatalf("decoded families = %v", sortedKeys(families))
+	}
+	if !hasLabel(mf.Metric[0].Label, "team") {
+		t.Errorf("enriched label missing from protobuf output: %v", mf.Metric[0].Label)
+	}
+}
+
+func TestServerRunnableFetchesKubeletText(t *testing.T) {
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		if accept := r.Header.Get("Accept"); accept != "" {
+			t.Errorf("kubelet request Accept = %q, want none", accept)
+		}
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	sr.httpServer.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerRunnableHealthz(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := serve(t, sr, "/healthz")
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("healthz = %d %q, want 200 \"ok\"", rec.Code, rec.Body.String())
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("upstream hits = %d, want 0", got)
+	}
+}
+
+func TestServerRunnableReadyz(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	opts.Readiness = NewReadiness()
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := serve(t, sr, "/readyz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before sync = %d, want 503", rec.Code)
+	}
+	retryAfter(t, rec)
+
+	opts.Readiness.SetCacheSynced()
+	rec = serve(t, sr, "/readyz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before first scrape = %d, want 503", rec.Code)
+	}
+	retryAfter(t, rec)
+	if got := hits.Load(); got != 0 {
+		t.Fatalf("readyz hit the kubelet %d times", got)
+	}
+
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Fatalf("scrape = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(t, sr, "/readyz"); rec.Code != http.StatusOK {
+		t.Fatalf("readyz after scrape = %d, want 200", rec.Code)
+	}
+}
+
+func TestServerRunnableWaitsForCacheSync(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	opts.Readiness = NewReadiness()
+	nm := NewNamespaceMetrics()
+	sr := newTestServerRunnable(t, "0", nm, opts)
+
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if got := retryAfter(t, rec); got != int(cacheSyncRetryAfter.Seconds()) {
+		t.Errorf("Retry-After = %d, want %d", got, int(cacheSyncRetryAfter.Seconds()))
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("upstream hits before sync = %d, want 0", got)
+	}
+
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	opts.Readiness.SetCacheSynced()
+	rec = serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `team="frontend"`) {
+		t.Errorf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerRunnablePprof(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	for _, path := range []string{"/debug/pprof/", "/debug/namespaces", "/metrics/raw"} {
+		if rec := serve(t, sr, path); rec.Code != http.StatusNotFound {
+			t.Errorf("debug endpoints disabled: %s status = %d, want 404", path, rec.Code)
+		}
+	}
+
+	opts.EnablePprof = true
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, sr, "/debug/pprof/"); rec.Code != http.StatusOK {
+		t.Errorf("pprof enabled: status = %d, want 200", rec.Code)
+	}
+	if rec := serve(t, sr, "/debug/pprof/heap"); rec.Code != http.StatusOK {
+		t.Errorf("pprof heap profile: status = %d, want 200", rec.Code)
+	}
+	// pprof does not expose the namespace labels nor the kubelet output.
+	for _, path := range []string{"/debug/namespaces", "/debug/preview", "/metrics/raw"} {
+		if rec := serve(t, sr, path); rec.Code != http.StatusNotFound {
+			t.Errorf("pprof enabled: %s status = %d, want 404", path, rec.Code)
+		}
+	}
+
+	opts.EnablePprof = false
+	opts.EnableDebugEndpoints = true
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, sr, "/debug/namespaces"); rec.Code != http.StatusOK {
+		t.Errorf("debug namespaces: status = %d, want 200", rec.Code)
+	}
+	if rec := serve(t, sr, "/debug/pprof/"); rec.Code != http.StatusNotFound {
+		t.Errorf("debug endpoints enabled: pprof status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServerRunnableRawMetrics(t *testing.T) {
+	// Unsorted families, a comment and a timestamp, which parsing and encoding again would not keep.
+	const raw = `# Scraped by the test kubelet.
+kubelet_running_pods 12
+# HELP container_cpu_usage_seconds_total Cumulative cpu time consumed.
+# TYPE container_cpu_usage_seconds_total counter
+container_cpu_usage_seconds_total{namespace="frontend",pod="app"} 1.5 1700000000000
+`
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/plain" {
+			http.Error(w, "unexpected Accept header "+r.Header.Get("Accept"), http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(raw))
+	})
+	opts.EnableDebugEndpoints = true
+	opts.MetricNameDrop = []string{"kubelet_.*"}
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	sr := newTestServerRunnable(t, "0", nm, opts)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics/raw?path=/metrics/cadvisor", nil)
+	req.Header.Set("Accept", "text/plain")
+	sr.httpServer.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Body.String(); got != raw {
+		t.Errorf("raw metrics differ from the kubelet response:\n%s\n---\n%s", got, raw)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q, want the kubelet one", got)
+	}
+
+	if rec := serve(t, sr, "/metrics/raw?path=/unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown path: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServerRunnableRawMetricsErrors(t *testing.T) {
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	opts.EnableDebugEndpoints = true
+	opts.JSONErrors = true
+	opts.CircuitBreakerThreshold = 1
+	opts.CircuitBreakerCooldown = time.Minute
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := serve(t, sr, "/metrics/raw?path=/metrics/cadvisor")
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), `"code":"upstream_status"`) {
+		t.Fatalf("kubelet failure: status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	rec = serve(t, sr, "/metrics/raw?path=/metrics/cadvisor")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"code":"circuit_open"`) {
+		t.Fatalf("open circuit: status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if got := retryAfter(t, rec); got != 60 {
+		t.Errorf("open circuit: Retry-After = %d, want the 60s cooldown", got)
+	}
+}
+
+func TestServerRunnableCountsFetchErrors(t *testing.T) {
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code == http.StatusOK {
+			t.Fatalf("expected scrape to fail when the kubelet returns 500")
+		}
+	}
+
+	rec := serve(t, sr, "/proxy-metrics")
+	want := `kmp_kubelet_fetch_errors_total{path="/metrics/cadvisor"} 2`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected proxy metrics to contain %s:\n%s", want, rec.Body.String())
+	}
+}
+
+func TestServerRunnableCircuitBreaker(t *testing.T) {
+	opts, hits := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	opts.CircuitBreakerThreshold = 2
+	opts.CircuitBreakerCooldown = time.Minute
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusBadGateway {
+			t.Fatalf("scrape %d: status = %d, want 502", i, rec.Code)
+		}
+	}
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if got := retryAfter(t, rec); got != 60 {
+		t.Errorf("Retry-After = %d, want the 60s cooldown", got)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("kubelet hit %d times, want 2", got)
+	}
+	url := kubeletURL(sr.endpointOpts("/metrics/cadvisor", "metrics/cadvisor"))
+	if got := testutil.ToFloat64(sr.opts.selfMetrics.breakerState.WithLabelValues(url)); got != float64(breakerOpen) {
+		t.Errorf("kmp_circuit_breaker_state = %v, want %v", got, float64(breakerOpen))
+	}
+}
+
+func TestServerRunnableLastSuccessfulScrape(t *testing.T) {
+	var failing atomic.Bool
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		if failing.Load() {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	lastSuccess := func() float64 {
+		return testutil.ToFloat64(sr.opts.selfMetrics.lastSuccess.WithLabelValues("/metrics/cadvisor"))
+	}
+
+	serve(t, sr, "/metrics/cadvisor")
+	first := lastSuccess()
+	if first == 0 {
+		t.Fatal("expected the gauge to be set after a successful scrape")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	serve(t, sr, "/metrics/cadvisor")
+	second := lastSuccess()
+	if second <= first {
+		t.Errorf("gauge did not advance: %v then %v", first, second)
+	}
+
+	failing.Store(true)
+	time.Sleep(10 * time.Millisecond)
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code == http.StatusOK {
+		t.Fatal("expected the scrape to fail")
+	}
+	if got := lastSuccess(); got != second {
+		t.Errorf("gauge changed on a failed scrape: %v, want %v", got, second)
+	}
+}
+
+func TestServerRunnableBuildInfo(t *testing.T) {
+	defer func(v, c string) { version.Version, version.Commit = v, c }(version.Version, version.Commit)
+	version.Version, version.Commit = "v1.2.3", "abc123"
+
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), ServerRunnableOpts{RestConfig: &rest.Config{}, NodePort: "10250"})
+	rec := serve(t, sr, "/proxy-metrics")
+
+	want := fmt.Sprintf(`kmp_build_info{commit="abc123",goversion=%q,version="v1.2.3"} 1`, runtime.Version())
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected proxy metrics to contain %s:\n%s", want, rec.Body.String())
+	}
+}
+
+func TestServerRunnableCachedNamespaces(t *testing.T) {
+	nm := NewNamespaceMetrics()
+	sr := newTestServerRunnable(t, "0", nm, ServerRunnableOpts{RestConfig: &rest.Config{}, NodePort: "10250"})
+
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	nm.ApplyLabelDiff("backend", nm.DiffLabels("backend", map[string]string{"team": "backend"}))
+	if got := testutil.ToFloat64(sr.opts.selfMetrics.cachedNamespaces); got != 2 {
+		t.Fatalf("kmp_cached_namespaces = %v, want 2", got)
+	}
+	nm.Delete("frontend")
+	if got := testutil.ToFloat64(sr.opts.selfMetrics.cachedNamespaces); got != 1 {
+		t.Errorf("kmp_cached_namespaces = %v after delete, want 1", got)
+	}
+	if rec := serve(t, sr, "/proxy-metrics"); !strings.Contains(rec.Body.String(), "kmp_cached_namespaces 1") {
+		t.Errorf("expected proxy metrics to contain kmp_cached_namespaces 1:\n%s", rec.Body.String())
+	}
+}
+
+func TestServerRunnableSetEnrichmentRules(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	opts.LabelAllowlist = []string{"team"}
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend", "tier": "web"})
+	sr := newTestServerRunnable(t, "0", nm, opts)
+	sr.RegisterEndpoint("/extra", "metrics/cadvisor")
+
+	body := serve(t, sr, "/metrics/cadvisor").Body.String()
+	if !strings.Contains(body, `team="frontend"`) || strings.Contains(body, `tier="web"`) {
+		t.Fatalf("unexpected labels before the reload:\n%s", body)
+	}
+
+	rules := opts.EnrichmentRules()
+	rules.LabelAllowlist = []string{"tier"}
+	sr.SetEnrichmentRules(rules)
+
+	// Every endpoint, including those registered before, uses the new rules.
+	for _, path := range []string{"/metrics/cadvisor", "/extra"} {
+		body := serve(t, sr, path).Body.String()
+		if strings.Contains(body, `team="frontend"`) || !strings.Contains(body, `tier="web"`) {
+			t.Errorf("%s: unexpected labels after the reload:\n%s", path, body)
+		}
+	}
+}
+
+func TestServerRunnableRegisterManagerMetrics(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	opts.RegisterManagerMetrics = true
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	t.Cleanup(func() {
+		for _, c := range sr.opts.selfMetrics.collectors() {
+			ctrlmetrics.Registry.Unregister(c)
+		}
+	})
+	serve(t, sr, "/metrics/cadvisor")
+
+	families, err := ctrlmetrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	found := map[string]bool{}
+	for _, mf := range families {
+		found[mf.GetName()] = true
+	}
+	for _, name := range []string{"kmp_build_info", "kmp_kubelet_fetch_duration_seconds", "kmp_last_successful_scrape_timestamp_seconds"} {
+		if !found[name] {
+			t.Errorf("%s is missing from the manager registry", name)
+		}
+	}
+}
+
+func TestServerRunnableInsecureSkipVerify(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	// No TLS settings at all, rest.TransportFor returns a transport without TLSClientConfig.
+	opts.RestConfig = &rest.Config{}
+
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code == http.StatusOK {
+		t.Fatal("expected scrape of a self-signed kubelet to fail without InsecureSkipVerify")
+	}
+
+	opts.InsecureSkipVerify = true
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if tc := http.DefaultTransport.(*http.Transport).TLSClientConfig; tc != nil && tc.InsecureSkipVerify {
+		t.Error("http.DefaultTransport must not be mutated")
+	}
+}
+
+func TestServerRunnableUpstreamProxy(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	kubeletAddr := net.JoinHostPort(opts.NodeNameOrIP, opts.NodePort)
+
+	var tunneled atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "expected CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		tunneled.Store(r.Host)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			_ = upstream.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+
+	opts.UpstreamProxyURL = proxy.URL
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := tunneled.Load().(string); got != kubeletAddr {
+		t.Errorf("proxy tunneled to %q, want %q", got, kubeletAddr)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("kubelet hits = %d, want 1", hits.Load())
+	}
+}
+
+func TestServerRunnableUpstreamHeaders(t *testing.T) {
+	var headers atomic.Value
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		headers.Store(r.Header.Clone())
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	opts.RestConfig.BearerToken = "kubelet-token"
+	opts.UpstreamHeaders = map[string]string{"X-Gateway-Token": "secret"}
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	got := headers.Load().(http.Header)
+	if got.Get("X-Gateway-Token") != "secret" {
+		t.Errorf("X-Gateway-Token = %q, want secret", got.Get("X-Gateway-Token"))
+	}
+	if got.Get("Authorization") != "Bearer kubelet-token" {
+		t.Errorf("Authorization = %q, want the rest config token", got.Get("Authorization"))
+	}
+
+	// An explicitly set header replaces the rest config credentials.
+	opts.UpstreamHeaders = map[string]string{"Authorization": "Bearer gateway-token"}
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if got := headers.Load().(http.Header).Get("Authorization"); got != "Bearer gateway-token" {
+		t.Errorf("Authorization = %q, want Bearer gateway-token", got)
+	}
+}
+
+func TestServerRunnableFetchTimeout(t *testing.T) {
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	opts.FetchTimeout = 50 * time.Millisecond
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	start := time.Now()
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504, body: %s", rec.Code, rec.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timeout fired after %s", elapsed)
+	}
+	if !strings.Contains(rec.Body.String(), "did not respond within 50ms") {
+		t.Errorf("expected descriptive timeout error, got %q", rec.Body.String())
+	}
+}
+
+func TestServerRunnablePreflight(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	opts.FetchMaxAttempts = 3
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if err := sr.Preflight(context.Background()); err != nil {
+		t.Fatalf("preflight: %v", err)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("kubelet hits = %d, want 1", got)
+	}
+
+	// A closed listener leaves a port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	_ = ln.Close()
+	opts.NodeNameOrIP = "127.0.0.1"
+	opts.NodePort = port
+	opts.FetchTimeout = time.Second
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	err = sr.Preflight(context.Background())
+	if err == nil {
+		t.Fatal("preflight against an unreachable kubelet succeeded")
+	}
+	if !strings.Contains(err.Error(), "127.0.0.1:"+port) {
+		t.Errorf("error %q does not name the kubelet", err)
+	}
+}
+
+func TestServerRunnableFailedScrapeStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		notSynced  bool
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name: "timeout",
+			handler: func(_ http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			},
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   ErrorCodeTimeout,
+		},
+		{
+			name: "upstream rejected",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, "secret kubelet error", http.StatusForbidden)
+			},
+			wantStatus: http.StatusBadGateway,
+			wantCode:   ErrorCodeUpstreamRejected,
+		},
+		{
+			name: "upstream status",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, "secret kubelet error", http.StatusNotFound)
+			},
+			wantStatus: http.StatusBadGateway,
+			wantCode:   ErrorCodeUpstreamStatus,
+		},
+		{
+			name: "malformed response",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("secret kubelet error{\n"))
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   ErrorCodeParseFailed,
+		},
+		{
+			name:       "cache not synced",
+			notSynced:  true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   ErrorCodeCacheNotSynced,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, _ := newFakeKubelet(t, tt.handler)
+			opts.FetchTimeout = 50 * time.Millisecond
+			opts.JSONErrors = true
+			if tt.notSynced {
+				opts.Readiness = NewReadiness()
+			}
+			sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+			rec := serve(t, sr, "/metrics/cadvisor")
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			// The status does not depend on the error body.
+			opts.JSONErrors = false
+			plain := serve(t, newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts), "/metrics/cadvisor")
+			if plain.Code != tt.wantStatus {
+				t.Errorf("status without JSON errors = %d, want %d", plain.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var body errorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode body %q: %v", rec.Body.String(), err)
+			}
+			if body.Code != tt.wantCode || body.Error == "" {
+				t.Errorf("body = %+v, want code %q and a message", body, tt.wantCode)
+			}
+			if strings.Contains(body.Error, "secret") || strings.Contains(body.Error, opts.NodeNameOrIP) {
+				t.Errorf("error message leaks internal details: %q", body.Error)
+			}
+		})
+	}
+}
+
+func TestServerRunnableScrapeTimeoutHeader(t *testing.T) {
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	})
+	opts.FetchTimeout = 30 * time.Second
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "1.5")
+	start := time.Now()
+	sr.httpServer.Handler.ServeHTTP(rec, req)
+	elapsed := time.Since(start)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504, body: %s", rec.Code, rec.Body.String())
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("fetch cancelled after %s, want about 1s", elapsed)
+	}
+	if !strings.Contains(rec.Body.String(), "did not respond within 1s") {
+		t.Errorf("expected the derived timeout in the error, got %q", rec.Body.String())
+	}
+}
+
+func TestServerRunnableMaxResponseBytes(t *testing.T) {
+	opts, hits := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		// Stream well past the limit without ever ending the payload.
+		for i := 0; i < 1000; i++ {
+			if _, err := fmt.Fprintf(w, "container_memory_working_set_bytes{pod=\"app-%d\"} %d\n", i, i); err != nil {
+				return
+			}
+		}
+	})
+	opts.MaxResponseBytes = 1024
+	opts.FetchMaxAttempts = 3
+	opts.FetchRetryBaseDelay = time.Millisecond
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500, body: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "exceeds the limit of 1024 bytes") {
+		t.Errorf("expected an explicit size error, got %q", rec.Body.String())
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, oversized responses must not be retried", got)
+	}
+
+	opts.MaxResponseBytes = 1 << 20
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Errorf("status within the limit = %d, body: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerRunnableLenientParsing(t *testing.T) {
+	const input = `# HELP container_cpu_usage_seconds_total Cumulative cpu time consumed.
+# TYPE container_cpu_usage_seconds_total counter
+container_cpu_usage_seconds_total{container="app",namespace="frontend",pod="app-1"} 12.5
+# TYPE broken_metric gauge
+broken_metric{pod="app-1" 1
+# TYPE kubelet_running_pods gauge
+kubelet_running_pods 2
+`
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(input))
+	})
+
+	strict := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, strict, "/metrics/cadvisor"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("strict status = %d, want 500", rec.Code)
+	}
+
+	opts.LenientParsing = true
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("lenient status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	for _, want := range []string{
+		`container_cpu_usage_seconds_total{container="app",namespace="frontend",pod="app-1"} 12.5`,
+		`kubelet_running_pods 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected %s in output:\n%s", want, rec.Body.String())
+		}
+	}
+	if strings.Contains(rec.Body.String(), "broken_metric") {
+		t.Errorf("malformed family was served:\n%s", rec.Body.String())
+	}
+	if got := testutil.ToFloat64(sr.opts.selfMetrics.parseErrors.WithLabelValues("/metrics/cadvisor")); got != 1 {
+		t.Errorf("kmp_parse_errors_total = %v, want 1", got)
+	}
+}
+
+func TestServerRunnableRetriesTransientFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		failStatus  int
+		maxAttempts int
+		wantCode    int
+		wantHits    int64
+	}{
+		{name: "5xx is retried until success", failStatus: http.StatusInternalServerError, maxAttempts: 3,
+			wantCode: http.StatusOK, wantHits: 3},
+		{name: "attempts are bounded", failStatus: http.StatusBadGateway, maxAttempts: 2,
+			wantCode: http.StatusBadGateway, wantHits: 2},
+		{name: "4xx is not retried", failStatus: http.StatusForbidden, maxAttempts: 3,
+			wantCode: http.StatusBadGateway, wantHits: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			opts, hits := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+				if calls.Add(1) <= 2 {
+					http.Error(w, "flaky", tt.failStatus)
+					return
+				}
+				_, _ = w.Write([]byte(testKubeletMetrics))
+			})
+			opts.FetchMaxAttempts = tt.maxAttempts
+			opts.FetchRetryBaseDelay = time.Millisecond
+			sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+			if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d, body: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestServerRunnableAdditionalEndpoints(t *testing.T) {
+	var paths sync.Map
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path, true)
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, sr, "/metrics/resource"); rec.Code == http.StatusOK {
+		t.Fatal("/metrics/resource is served although it is not enabled")
+	}
+
+	opts.ServeResourceMetrics = true
+	opts.ExtraEndpoints = []Endpoint{{Path: "/custom/pods", KubeletPath: "/metrics/pods"}}
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	for path, upstream := range map[string]string{
+		"/metrics/resource": "/metrics/resource",
+		"/custom/pods":      "/metrics/pods",
+	} {
+		rec := serve(t, sr, path)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "container_cpu_usage_seconds_total") {
+			t.Errorf("%s: status = %d, body: %s", path, rec.Code, rec.Body.String())
+		}
+		if _, ok := paths.Load(upstream); !ok {
+			t.Errorf("%s was not proxied to the kubelet %s endpoint", path, upstream)
+		}
+	}
+}
+
+func TestServerRunnableRegisterEndpoint(t *testing.T) {
+	var paths sync.Map
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path, true)
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	opts.NodeLabelName = "node"
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	sr.RegisterEndpoint("/metrics/probes", "metrics/probes")
+
+	rec := serve(t, sr, "/metrics/probes")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `node="`+opts.NodeNameOrIP+`"`) {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := paths.Load("/metrics/probes"); !ok {
+		t.Error("/metrics/probes was not proxied to the kubelet probes endpoint")
+	}
+
+	// Through the kube-apiserver the kubelet path is relative to the node proxy path.
+	opts.KubeApiserver, opts.NodeNameOrIP = opts.NodeNameOrIP, "worker-1"
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	sr.RegisterEndpoint("/metrics/probes", "metrics/probes")
+	serve(t, sr, "/metrics/probes")
+	if _, ok := paths.Load("/api/v1/nodes/worker-1/proxy/metrics/probes"); !ok {
+		t.Error("/metrics/probes was not proxied through the kube-apiserver node proxy")
+	}
+}
+
+func TestServerRunnableProbe(t *testing.T) {
+	var requested atomic.Value
+	opts, hits := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(r.URL.Path)
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	opts.ProbeAllowedPaths = []string{"/metrics/resource"}
+	nm := NewNamespaceMetrics()
+	nm.Set("frontend", map[string]string{"team": "frontend"})
+	sr := newTestServerRunnable(t, "0", nm, opts)
+
+	rec := serve(t, sr, "/probe?path=/metrics/resource")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("allowed path: status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := requested.Load().(string); got != "/metrics/resource" {
+		t.Errorf("kubelet path = %q, want /metrics/resource", got)
+	}
+	if !strings.Contains(rec.Body.String(), `team="frontend"`) {
+		t.Errorf("probe response is not enriched:\n%s", rec.Body.String())
+	}
+
+	for _, path := range []string{"/probe?path=/configz", "/probe?path=/metrics/resource/../../pods"} {
+		if rec := serve(t, sr, path); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want 403", path, rec.Code)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("kubelet hits = %d, want 1", hits.Load())
+	}
+}
+
+func TestServerRunnableProbeSelfMetricsAndErrors(t *testing.T) {
+	opts, _ := newFakeKubelet(t, nil)
+	opts.ProbeAllowedPaths = []string{"/metrics/resource", "/metrics/probes"}
+	opts.JSONErrors = true
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	for _, path := range []string{"/probe?path=/metrics/resource", "/probe?path=/metrics/probes"} {
+		if rec := serve(t, sr, path); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body: %s", path, rec.Code, rec.Body.String())
+		}
+		if got := testutil.ToFloat64(sr.opts.selfMetrics.lastSuccess.WithLabelValues(path)); got == 0 {
+			t.Errorf("kmp_last_successful_scrape_timestamp_seconds{path=%q} was not set", path)
+		}
+	}
+	if got := testutil.CollectAndCount(sr.opts.selfMetrics.lastSuccess); got != 2 {
+		t.Errorf("last successful scrape series = %d, want one per probed path", got)
+	}
+
+	for _, tt := range []struct {
+		path     string
+		wantCode int
+		wantErr  string
+	}{
+		{path: "/probe", wantCode: http.StatusBadRequest, wantErr: ErrorCodeBadRequest},
+		{path: "/probe?path=/configz", wantCode: http.StatusForbidden, wantErr: ErrorCodePathNotAllowed},
+	} {
+		rec := serve(t, sr, tt.path)
+		var body errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: decode body %q: %v", tt.path, rec.Body.String(), err)
+		}
+		if rec.Code != tt.wantCode || body.Code != tt.wantErr {
+			t.Errorf("%s: status = %d, code = %q, want %d %q", tt.path, rec.Code, body.Code, tt.wantCode, tt.wantErr)
+		}
+	}
+}
+
+func TestServerRunnableLimitsConcurrentScrapes(t *testing.T) {
+	const maxScrapes = 3
+	var inFlight, peak atomic.Int64
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	opts.MaxConcurrentScrapes = maxScrapes
+	opts.ScrapeQueueTimeout = 30 * time.Second
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			sr.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, body: %s", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > maxScrapes {
+		t.Errorf("upstream concurrency = %d, want at most %d", got, maxScrapes)
+	}
+}
+
+func TestServerRunnableRejectsScrapesAfterQueueTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 1)
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	opts.MaxConcurrentScrapes = 1
+	opts.ScrapeQueueTimeout = 10 * time.Millisecond
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		sr.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		done <- rec.Code
+	}()
+	<-started
+
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", rec.Code)
+	}
+	// The queue timeout is rounded up to a whole second.
+	if got := retryAfter(t, rec); got != 1 {
+		t.Errorf("Retry-After = %d, want 1", got)
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first scrape status = %d, want 200", code)
+	}
+}
+
+func TestServerRunnableResolvesNodeIP(t *testing.T) {
+	opts, hits := newFakeKubelet(t, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker-1"},
+		Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+			{Type: corev1.NodeHostName, Address: "worker-1"},
+			{Type: corev1.NodeInternalIP, Address: opts.NodeNameOrIP},
+		}},
+	}
+	opts.NodeNameOrIP = "worker-1"
+	opts.ResolveNodeIP = true
+	opts.NodeReader = fake.NewClientBuilder().WithObjects(node).Build()
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("upstream hits = %d, want 2", got)
+	}
+
+	// The address is cached, the Node is not read again.
+	if err := opts.NodeReader.(client.Client).Delete(context.Background(), node); err != nil {
+		t.Fatalf("delete node: %v", err)
+	}
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Fatalf("status after node deletion = %d, body: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerRunnableLocalNodeOnly(t *testing.T) {
+	var paths sync.Map
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path, true)
+		_, _ = w.Write([]byte(testKubeletMetrics))
+	})
+	opts.NodeReader = fake.NewClientBuilder().WithObjects(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker-1"},
+		Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+			{Type: corev1.NodeInternalIP, Address: opts.NodeNameOrIP},
+		}},
+	}).Build()
+	opts.NodeNameOrIP = "ignored"
+	opts.KubeApiserver = "apiserver.invalid"
+	opts.LocalNodeOnly = true
+
+	t.Setenv(NodeNameEnv, "worker-1")
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if sr.opts.KubeApiserver != "" || sr.opts.NodeNameOrIP != "worker-1" {
+		t.Fatalf("local node options = %q via %q, want worker-1 directly", sr.opts.NodeNameOrIP, sr.opts.KubeApiserver)
+	}
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := paths.Load("/metrics/cadvisor"); !ok {
+		t.Error("the local kubelet was not scraped directly")
+	}
+
+	t.Setenv(NodeNameEnv, "")
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	localOpts := sr.opts
+	localOpts.NodePath = "/metrics"
+	if got, want := kubeletURL(&localOpts), "https://127.0.0.1:"+opts.NodePort+"/metrics"; got != want {
+		t.Errorf("kubeletURL() without %s = %q, want %q", NodeNameEnv, got, want)
+	}
+}
+
+func TestServerRunnableAggregatesNodes(t *testing.T) {
+	first, _ := newFakeKubelet(t, nil)
+	second, _ := newFakeKubelet(t, nil)
+	broken, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+
+	opts := first
+	opts.Nodes = []NodeTarget{
+		{Name: "worker-1", Address: first.NodeNameOrIP, Port: first.NodePort},
+		{Name: "worker-2", Address: second.NodeNameOrIP, Port: second.NodePort},
+		{Name: "worker-3", Address: broken.NodeNameOrIP, Port: broken.NodePort},
+	}
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	rec := serve(t, sr, "/metrics/cadvisor")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`kubelet_running_pods{node="worker-1"} 2`,
+		`kubelet_running_pods{node="worker-2"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in output:\n%s", want, body)
+		}
+	}
+	if n := strings.Count(body, "# TYPE kubelet_running_pods gauge"); n != 1 {
+		t.Errorf("TYPE line emitted %d times, want once:\n%s", n, body)
+	}
+	if strings.Contains(body, "worker-3") {
+		t.Errorf("failed node contributed metrics:\n%s", body)
+	}
+
+	selfMetrics := serve(t, sr, "/proxy-metrics").Body.String()
+	want := `kmp_aggregated_node_errors_total{node="worker-3",path="/metrics/cadvisor"} 1`
+	if !strings.Contains(selfMetrics, want) {
+		t.Errorf("expected %s in proxy metrics:\n%s", want, selfMetrics)
+	}
+
+	opts.Nodes = opts.Nodes[2:]
+	sr = newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+	if rec := serve(t, sr, "/metrics/cadvisor"); rec.Code != http.StatusBadGateway {
+		t.Errorf("status with all nodes failing = %d, want 502", rec.Code)
+	}
+}
+
+func TestServerRunnableServesTLS(t *testing.T) {
+	ca := newTestCA(t, "proxy-ca")
+	opts, _ := newFakeKubelet(t, nil)
+	opts.TLSCertFile, opts.TLSKeyFile = ca.writeServerCert(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	sr := newTestServerRunnable(t, port, NewNamespaceMetrics(), opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- sr.Start(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if resp, err = client.Get("https://127.0.0.1:" + port + "/metrics/cadvisor"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("https scrape: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "container_cpu_usage_seconds_total") {
+		t.Errorf("status = %d, body: %s", resp.StatusCode, body)
+	}
+}
+
+func TestServerRunnableAccessLog(t *testing.T) {
+	opts, _ := newFakeKubelet(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("not a metric {"))
+	})
+	opts.AccessLog = true
+	sr := newTestServerRunnable(t, "0", NewNamespaceMetrics(), opts)
+
+	var lines []string
+	logger := funcr.New(func(prefix, args string) {
+		lines = append(lines, prefix+" "+args)
+	}, funcr.Options{})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics/cadvisor", nil)
+	sr.httpServer.Handler.ServeHTTP(rec, req.WithContext(log.IntoContext(req.Context(), logger)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500, body: %s", rec.Code, rec.Body.String())
+	}
+
+	var accessLine string
+	for _, line := range lines {
+		if strings.Contains(line, "served request") {
+			accessLine = line
+		}
+	}
+	for _, want := range []string{`"method"="GET"`, `"path"="/metrics/cadvisor"`, `"status"=500`, `"size"=`, `"duration"=`} {
+		if !strings.Contains(accessLine, want) {
+			t.Errorf("access log %q does not contain %s", accessLine, want)
+		}
+	}
+}
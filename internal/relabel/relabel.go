@@ -0,0 +1,200 @@
+// Package relabel applies a subset of Prometheus relabel_configs to enriched metrics.
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Action is the relabeling action performed when a rule matches.
+type Action string
+
+const (
+	// Replace sets TargetLabel to Replacement expanded with the regex match.
+	// The label is removed when the replacement is empty.
+	Replace Action = "replace"
+	// Keep drops the metric when the regex does not match.
+	Keep Action = "keep"
+	// Drop drops the metric when the regex matches.
+	Drop Action = "drop"
+)
+
+// Defaults applied to every rule read from YAML, matching Prometheus.
+const (
+	DefaultSeparator   = ";"
+	DefaultRegex       = "(.*)"
+	DefaultReplacement = "$1"
+)
+
+// RelabelConfig is a single relabeling rule. Field names follow Prometheus relabel_configs.
+type RelabelConfig struct {
+	// SourceLabels are joined with Separator and matched against Regex.
+	// A missing label reads as an empty value.
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	// Regex is anchored on both ends. A nil regex matches everything.
+	Regex       Regexp `yaml:"regex"`
+	TargetLabel string `yaml:"target_label"`
+	Replacement string `yaml:"replacement"`
+	Action      Action `yaml:"action"`
+}
+
+// UnmarshalYAML applies the Prometheus defaults and validates the rule.
+func (c *RelabelConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain RelabelConfig
+	cfg := plain{
+		Separator:   DefaultSeparator,
+		Regex:       MustNewRegexp(DefaultRegex),
+		Replacement: DefaultReplacement,
+		Action:      Replace,
+	}
+	if err := value.Decode(&cfg); err != nil {
+		return err
+	}
+	*c = RelabelConfig(cfg)
+	return c.Validate()
+}
+
+// Validate reports rules that can never be applied.
+func (c *RelabelConfig) Validate() error {
+	switch c.Action {
+	case Replace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %q requires target_label", c.Action)
+		}
+	case Keep, Drop:
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+	return nil
+}
+
+// Regexp is a regular expression anchored on both ends that can be read from YAML.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegexp compiles s anchored on both ends.
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return Regexp{}, err
+	}
+	return Regexp{Regexp: re, original: s}, nil
+}
+
+// MustNewRegexp is like NewRegexp but panics if s does not compile.
+func MustNewRegexp(s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// String returns the expression as it was written, without the anchors.
+func (r Regexp) String() string {
+	return r.original
+}
+
+// UnmarshalYAML compiles the regex from a YAML string.
+func (r *Regexp) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	re, err := NewRegexp(s)
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex %q: %w", s, err)
+	}
+	*r = re
+	return nil
+}
+
+// Relabel applies cfgs to the labels of metric, a series of the family name, in order.
+// It returns false when a keep or drop rule removes the metric.
+// name is the value of the model.MetricNameLabel source label. The metric can not be renamed:
+// rules targeting that label are skipped.
+func Relabel(name string, metric *dto.Metric, cfgs []RelabelConfig) bool {
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		value := sourceValue(name, metric, cfg)
+
+		var match []int
+		if cfg.Regex.Regexp != nil {
+			match = cfg.Regex.FindStringSubmatchIndex(value)
+		} else {
+			match = []int{0, len(value)}
+		}
+
+		switch cfg.Action {
+		case Keep:
+			if match == nil {
+				return false
+			}
+		case Drop:
+			if match != nil {
+				return false
+			}
+		case Replace:
+			if match == nil {
+				continue
+			}
+			target, replacement := cfg.TargetLabel, cfg.Replacement
+			if cfg.Regex.Regexp != nil {
+				target = string(cfg.Regex.ExpandString(nil, target, value, match))
+				replacement = string(cfg.Regex.ExpandString(nil, replacement, value, match))
+			}
+			if !model.LabelName(target).IsValid() || target == model.MetricNameLabel {
+				continue
+			}
+			setLabel(metric, target, replacement)
+		}
+	}
+	return true
+}
+
+func sourceValue(metricName string, metric *dto.Metric, cfg *RelabelConfig) string {
+	values := make([]string, len(cfg.SourceLabels))
+	for i, name := range cfg.SourceLabels {
+		if name == model.MetricNameLabel {
+			values[i] = metricName
+			continue
+		}
+		for _, lbl := range metric.Label {
+			if lbl.GetName() == name {
+				values[i] = lbl.GetValue()
+				break
+			}
+		}
+	}
+	return strings.Join(values, cfg.Separator)
+}
+
+// setLabel sets the label name to value, removing it when value is empty.
+func setLabel(metric *dto.Metric, name, value string) {
+	for i, lbl := range metric.Label {
+		if lbl.GetName() != name {
+			continue
+		}
+		if value == "" {
+			metric.Label = append(metric.Label[:i], metric.Label[i+1:]...)
+		} else {
+			lbl.Value = proto.String(value)
+		}
+		return
+	}
+	if value != "" {
+		metric.Label = append(metric.Label, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(value),
+		})
+	}
+}
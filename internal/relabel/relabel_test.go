@@ -0,0 +1,134 @@
+package relabel
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+func newMetric(labels ...string) *dto.Metric {
+	m := &dto.Metric{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return m
+}
+
+func labelValue(m *dto.Metric, name string) (string, bool) {
+	for _, lbl := range m.Label {
+		if lbl.GetName() == name {
+			return lbl.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+func loadConfigs(t *testing.T, text string) []RelabelConfig {
+	t.Helper()
+	var cfgs []RelabelConfig
+	if err := yaml.Unmarshal([]byte(text), &cfgs); err != nil {
+		t.Fatalf("unmarshal relabel configs: %v", err)
+	}
+	return cfgs
+}
+
+func TestRelabelDrop(t *testing.T) {
+	cfgs := loadConfigs(t, `
+- source_labels: [namespace]
+  regex: kube-.*
+  action: drop
+`)
+
+	if Relabel("container_cpu_usage_seconds_total", newMetric("namespace", "kube-system", "pod", "coredns"), cfgs) {
+		t.Error("metric in kube-system was not dropped")
+	}
+	if !Relabel("container_cpu_usage_seconds_total", newMetric("namespace", "frontend", "pod", "app"), cfgs) {
+		t.Error("metric in frontend was dropped")
+	}
+}
+
+func TestRelabelDropByName(t *testing.T) {
+	cfgs := loadConfigs(t, `
+- source_labels: [__name__, namespace]
+  regex: container_network_.*;kube-system
+  action: drop
+- source_labels: [__name__]
+  target_label: __name__
+  replacement: renamed
+`)
+
+	if Relabel("container_network_receive_bytes_total", newMetric("namespace", "kube-system"), cfgs) {
+		t.Error("network metric in kube-system was not dropped")
+	}
+	m := newMetric("namespace", "kube-system")
+	if !Relabel("container_cpu_usage_seconds_total", m, cfgs) {
+		t.Error("cpu metric in kube-system was dropped")
+	}
+	if v, ok := labelValue(m, "__name__"); ok {
+		t.Errorf("__name__ was set as a label to %q", v)
+	}
+}
+
+func TestRelabelKeep(t *testing.T) {
+	cfgs := loadConfigs(t, `
+- source_labels: [team]
+  regex: frontend|backend
+  action: keep
+`)
+
+	if !Relabel("container_cpu_usage_seconds_total", newMetric("team", "backend"), cfgs) {
+		t.Error("metric with a matching team was dropped")
+	}
+	if Relabel("container_cpu_usage_seconds_total", newMetric("namespace", "default"), cfgs) {
+		t.Error("metric without a team label was kept")
+	}
+}
+
+func TestRelabelReplace(t *testing.T) {
+	cfgs := loadConfigs(t, `
+- source_labels: [namespace, pod]
+  separator: /
+  regex: (.+)/(.+)-[0-9]+
+  target_label: workload
+  replacement: $1/$2
+- source_labels: [tier]
+  target_label: tier
+  replacement: tier-$1
+- source_labels: [owner]
+  regex: .*
+  target_label: owner
+  replacement: ""
+`)
+
+	m := newMetric("namespace", "frontend", "pod", "app-1", "tier", "web", "owner", "alice")
+	if !Relabel("container_cpu_usage_seconds_total", m, cfgs) {
+		t.Fatal("metric was dropped by replace rules")
+	}
+	if v, _ := labelValue(m, "workload"); v != "frontend/app" {
+		t.Errorf("workload = %q, want %q", v, "frontend/app")
+	}
+	if v, _ := labelValue(m, "tier"); v != "tier-web" {
+		t.Errorf("tier = %q, want %q", v, "tier-web")
+	}
+	if _, ok := labelValue(m, "owner"); ok {
+		t.Error("owner label was not removed by an empty replacement")
+	}
+}
+
+func TestUnmarshalRelabelConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown action":         "- action: hashmod\n",
+		"replace without target": "- source_labels: [a]\n",
+		"invalid regex":          "- regex: \"(\"\n  action: drop\n",
+	}
+	for name, text := range tests {
+		t.Run(name, func(t *testing.T) {
+			var cfgs []RelabelConfig
+			if err := yaml.Unmarshal([]byte(text), &cfgs); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
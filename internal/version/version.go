@@ -0,0 +1,12 @@
+// Package version holds the build information of the binary, set with linker flags:
+//
+//	go build -ldflags "-X github.com/Uburro/kubelet-meta-proxy/internal/version.Version=v0.1.0 \
+//		-X github.com/Uburro/kubelet-meta-proxy/internal/version.Commit=$(git rev-parse HEAD)"
+package version
+
+var (
+	// Version is the released version of the binary.
+	Version = "dev"
+	// Commit is the git commit the binary was built from.
+	Commit = "unknown"
+)